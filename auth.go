@@ -0,0 +1,344 @@
+//-----------------------------------------------------------------------------
+// Copyright (C) Microsoft. All rights reserved.
+// Licensed under the MIT license.
+// See LICENSE.txt file in the project root for full license information.
+//-----------------------------------------------------------------------------
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//
+// The server can limit the clients that are allowed to run tests by their IP
+// address, and can require clients to authenticate using a pre-shared key.
+//
+// Authentication is a challenge and response carried in the SYN and ACK
+// messages of the handshake. The server replies to the first SYN message with
+// a random challenge in the ACK message, and the client sends its SYN message
+// again, along with the HMAC-SHA256 of the challenge using the pre-shared key.
+//
+// Tests other than TCP Bandwidth and Latency don't do a handshake on each
+// connection, e.g. UDP and HTTP tests, and neither does the exchange of
+// results at the end of a test. For these, the client opens an authenticated
+// session using the same handshake, with test type All as it covers all tests
+// of the client, and keeps it open while the test runs. The server accepts
+// traffic from the IP address of the client only while a session from that
+// address is open.
+//
+
+const authChallengeLen = 32
+
+// Rejections of the same client for the same reason are logged at most once
+// in this interval, so that rejected traffic doesn't flood the log.
+const authRejectLogInterval = 10 * time.Second
+
+// At most this many rejected clients are remembered per log, rejections of
+// other clients aren't logged until the remembered ones expire.
+const authRejectLogMaxClients = 1024
+
+var (
+	errAuthNotAllowed = errors.New("client address is not allowed by the server")
+	errAuthRequired   = errors.New("server requires authentication, use -psk to specify the pre-shared key")
+	errAuthFailed     = errors.New("authentication failed, pre-shared key doesn't match")
+)
+
+//
+// ethrRejectedError is returned by the handshake on the client, when the
+// server rejects the client, so that it can be told apart from failures to
+// talk to the server.
+//
+type ethrRejectedError struct {
+	reason string
+}
+
+func (e *ethrRejectedError) Error() string {
+	return e.reason
+}
+
+var gPSK []byte
+var gAllowList []*net.IPNet
+var gDenyList []*net.IPNet
+var gAuthEnabled bool
+
+var gAuthSessionsLock sync.Mutex
+var gAuthSessions atomic.Value
+
+var gAuthRejectedLock sync.Mutex
+var gAuthRejected = newRejectLog()
+
+func initServerAuth(serverParam ethrServerParam) {
+	gPSK = serverParam.psk
+	gAllowList = serverParam.allowList
+	gDenyList = serverParam.denyList
+	gAuthEnabled = gPSK != nil || gAllowList != nil || gDenyList != nil
+	gAuthSessions.Store(make(map[string]int))
+}
+
+func computeAuthResponse(psk, challenge []byte) []byte {
+	mac := hmac.New(sha256.New, psk)
+	mac.Write(challenge)
+	return mac.Sum(nil)
+}
+
+//
+// parseClientIP returns the IP address of the client, without the zone of
+// IPv6 link local addresses, same as the address of UDP packets.
+//
+func parseClientIP(server string) net.IP {
+	if i := strings.IndexByte(server, '%'); i >= 0 {
+		server = server[:i]
+	}
+	return net.ParseIP(server)
+}
+
+func ipNetsToString(nets []*net.IPNet) string {
+	s := make([]string, len(nets))
+	for i, n := range nets {
+		s[i] = n.String()
+	}
+	return strings.Join(s, ", ")
+}
+
+func isClientAddrAllowed(ip net.IP) bool {
+	for _, n := range gDenyList {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if gAllowList == nil {
+		return true
+	}
+	for _, n := range gAllowList {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+//
+// srvrCheckClient checks traffic from a client that doesn't carry a handshake
+// of its own. It is allowed if the address of the client is allowed, and if
+// the server requires authentication, the client has a session open.
+//
+func srvrCheckClient(ip net.IP) error {
+	if !gAuthEnabled {
+		return nil
+	}
+	if !isClientAddrAllowed(ip) {
+		return errAuthNotAllowed
+	}
+	if gPSK != nil {
+		sessions := gAuthSessions.Load().(map[string]int)
+		if sessions[ip.String()] == 0 {
+			return errAuthRequired
+		}
+	}
+	return nil
+}
+
+//
+// srvrAuthorizeClient checks the address of the client and runs the challenge
+// and response with it, if the server requires authentication. It returns the
+// SYN message of the client that passed authentication. The client is told
+// why it is rejected, if so.
+//
+func srvrAuthorizeClient(server string, conn net.Conn, ethrMsg *EthrMsg) (*EthrMsg, error) {
+	if !gAuthEnabled {
+		return ethrMsg, nil
+	}
+	ip := parseClientIP(server)
+	if !isClientAddrAllowed(ip) {
+		srvrRejectClient(server, conn, ethrMsg.Version, errAuthNotAllowed)
+		return nil, errAuthNotAllowed
+	}
+	if gPSK == nil {
+		return ethrMsg, nil
+	}
+	challenge := make([]byte, authChallengeLen)
+	_, err := rand.Read(challenge)
+	if err != nil {
+		ui.printErr("Failed to generate authentication challenge. Error: %v", err)
+		return nil, err
+	}
+	ackMsg := createAckMsg(ethrMsg.Version)
+	ackMsg.Ack.Challenge = challenge
+	err = sendSessionMsg(conn, ackMsg)
+	if err != nil {
+		return nil, err
+	}
+	version := ethrMsg.Version
+	ethrMsg = recvSessionMsg(conn)
+	if ethrMsg.Type != EthrSyn || ethrMsg.Syn == nil || len(ethrMsg.Syn.Auth) == 0 {
+		// The client closed the connection, as it has no pre-shared key.
+		srvrLogRejected(server, errAuthRequired)
+		return nil, errAuthRequired
+	}
+	if !hmac.Equal(ethrMsg.Syn.Auth, computeAuthResponse(gPSK, challenge)) {
+		srvrRejectClient(server, conn, version, errAuthFailed)
+		return nil, errAuthFailed
+	}
+	return ethrMsg, nil
+}
+
+func srvrRejectClient(server string, conn net.Conn, clientVersion EthrMsgVer, err error) {
+	srvrLogRejected(server, err)
+	ackMsg := createAckMsg(clientVersion)
+	ackMsg.Ack.Error = err.Error()
+	sendSessionMsg(conn, ackMsg)
+}
+
+func srvrLogRejected(server string, err error) {
+	gAuthRejectedLock.Lock()
+	ok := gAuthRejected.shouldLog(server, err, time.Now())
+	gAuthRejectedLock.Unlock()
+	if ok {
+		ui.printErr("Rejected client %s. Error: %v", server, err)
+	}
+}
+
+//
+// ethrRejectLog rate limits logging of rejected clients. It isn't safe for
+// concurrent use: UDP packet handlers each keep their own, so that rejected
+// datagrams don't take a global lock, the other servers share gAuthRejected.
+//
+type ethrRejectLog struct {
+	last  map[string]time.Time
+	swept time.Time
+}
+
+func newRejectLog() *ethrRejectLog {
+	return &ethrRejectLog{last: make(map[string]time.Time)}
+}
+
+//
+// shouldLog returns whether the rejection of the client for the error is to
+// be logged now. Entries older than authRejectLogInterval are evicted once
+// every interval, so that the log doesn't grow with every client that was
+// ever rejected.
+//
+func (l *ethrRejectLog) shouldLog(server string, err error, now time.Time) bool {
+	if now.Sub(l.swept) >= authRejectLogInterval {
+		for k, t := range l.last {
+			if now.Sub(t) >= authRejectLogInterval {
+				delete(l.last, k)
+			}
+		}
+		l.swept = now
+	}
+	key := server + " " + err.Error()
+	last, found := l.last[key]
+	if found && now.Sub(last) < authRejectLogInterval {
+		return false
+	}
+	if !found && len(l.last) >= authRejectLogMaxClients {
+		return false
+	}
+	l.last[key] = now
+	return true
+}
+
+func (l *ethrRejectLog) log(server string, err error) {
+	if l.shouldLog(server, err, time.Now()) {
+		ui.printErr("Rejected client %s. Error: %v", server, err)
+	}
+}
+
+//
+// srvrRunAuthSession keeps an authenticated session of the client open, until
+// the client closes it at the end of its test. The client is counted as
+// running tests while the session is open.
+//
+func srvrRunAuthSession(server string, conn net.Conn, ethrMsg *EthrMsg) {
+	clientVersion := ethrMsg.Version
+	ip := parseClientIP(server)
+	err := srvrAdmitClient(ip)
+	if err != nil {
+		srvrRejectClient(server, conn, clientVersion, err)
+		return
+	}
+	defer srvrReleaseClient(ip)
+	ackMsg := srvrCreateAckMsg(clientVersion)
+	clientParam := ethrMsg.Syn.ClientParam
+	if ethrMsg.Syn.TestID.Protocol == UDP && clientParam.UDPOffload {
+		srvrEnableUDPGRO()
+	}
+	if ethrMsg.Syn.TestID.Protocol == UDP && (clientParam.RecvBufferSize > 0 || clientParam.UDPOffload) &&
+		ackMsg.Version > 0 {
+		ackMsg.Ack.SockOpts = srvrSetUDPReadBuffer(int(clientParam.RecvBufferSize))
+	}
+	err = sendSessionMsg(conn, ackMsg)
+	if err != nil {
+		return
+	}
+	srvrUpdateAuthSessions(ip.String(), 1)
+	defer srvrUpdateAuthSessions(ip.String(), -1)
+	io.Copy(ioutil.Discard, conn)
+}
+
+//
+// Sessions are looked up for every packet of UDP tests, so the map of
+// sessions is replaced on each update, instead of taking a lock to look up.
+//
+func srvrUpdateAuthSessions(ip string, delta int) {
+	gAuthSessionsLock.Lock()
+	defer gAuthSessionsLock.Unlock()
+	sessions := gAuthSessions.Load().(map[string]int)
+	newSessions := make(map[string]int, len(sessions)+1)
+	for k, v := range sessions {
+		newSessions[k] = v
+	}
+	newSessions[ip] += delta
+	if newSessions[ip] <= 0 {
+		delete(newSessions, ip)
+	}
+	gAuthSessions.Store(newSessions)
+}
+
+//
+// clientOpenAuthSession opens a session with the server for the test. Servers
+// that don't require authentication don't need the session, so the test runs
+// even if the session can't be connected, e.g. for UDP tests through a
+// firewall that blocks TCP. Once connected, the handshake of the session also
+// checks that the server supports the test, so the test fails if it fails.
+// The SYN message of the session has the protocol of the test, so that the
+// server can size its UDP socket for UDP tests.
+//
+func clientOpenAuthSession(test *ethrTest) error {
+	if gIsExternalClient || test.testID.Protocol == ICMP {
+		return nil
+	}
+	conn, err := ethrDialEx(TCP, test.dialAddr, gLocalIP, 0, int(gTTL), int(gTOS))
+	if err != nil {
+		ui.printDbg("Failed to open session with Ethr server. Error: %v", err)
+		return nil
+	}
+	ack, err := handshakeWithServer(test, conn, EthrTestID{test.testID.Protocol, All}, test.clientParam)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if test.testID.Protocol == UDP && ack != nil && ack.SockOpts != nil {
+		ui.printMsg("Ethr server UDP socket: %s", sockOptsToString(*ack.SockOpts, UDP))
+	}
+	test.authConn = conn
+	return nil
+}
+
+func clientCloseAuthSession(test *ethrTest) {
+	if test.authConn != nil {
+		test.authConn.Close()
+		test.authConn = nil
+	}
+}
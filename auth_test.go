@@ -0,0 +1,61 @@
+//-----------------------------------------------------------------------------
+// Copyright (C) Microsoft. All rights reserved.
+// Licensed under the MIT license.
+// See LICENSE.txt file in the project root for full license information.
+//-----------------------------------------------------------------------------
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRejectLog(t *testing.T) {
+	l := newRejectLog()
+	now := time.Now()
+	steps := []struct {
+		name   string
+		server string
+		err    error
+		after  time.Duration
+		log    bool
+	}{
+		{"first rejection", "10.0.0.1", errAuthFailed, 0, true},
+		{"same rejection", "10.0.0.1", errAuthFailed, time.Second, false},
+		{"other error", "10.0.0.1", errAuthRequired, 0, true},
+		{"other client", "10.0.0.2", errAuthFailed, 0, true},
+		{"within interval", "10.0.0.1", errAuthFailed, authRejectLogInterval - 2*time.Second, false},
+		{"after interval", "10.0.0.1", errAuthFailed, time.Second, true},
+	}
+	for _, s := range steps {
+		now = now.Add(s.after)
+		if got := l.shouldLog(s.server, s.err, now); got != s.log {
+			t.Errorf("%s: got %v, want %v", s.name, got, s.log)
+		}
+	}
+	// Expired entries are evicted, only the new rejection remains.
+	l.shouldLog("10.0.0.3", errAuthFailed, now.Add(authRejectLogInterval))
+	if len(l.last) != 1 {
+		t.Errorf("got %d entries after eviction, want 1", len(l.last))
+	}
+}
+
+func TestRejectLogMaxClients(t *testing.T) {
+	l := newRejectLog()
+	now := time.Now()
+	for i := 0; i < authRejectLogMaxClients; i++ {
+		if !l.shouldLog(fmt.Sprint(i), errAuthFailed, now) {
+			t.Fatalf("rejection of client %d isn't logged", i)
+		}
+	}
+	if l.shouldLog("new", errAuthFailed, now) {
+		t.Errorf("rejection of a client beyond the maximum is logged")
+	}
+	if !l.shouldLog("new", errAuthFailed, now.Add(authRejectLogInterval)) {
+		t.Errorf("rejection of a client isn't logged after the others expired")
+	}
+	if len(l.last) != 1 {
+		t.Errorf("got %d entries after eviction, want 1", len(l.last))
+	}
+}
@@ -0,0 +1,273 @@
+//-----------------------------------------------------------------------------
+// Copyright (C) Microsoft. All rights reserved.
+// Licensed under the MIT license.
+// See LICENSE.txt file in the project root for full license information.
+//-----------------------------------------------------------------------------
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+//
+// The results of a run of the client can be compared with a baseline, i.e.
+// the log file of an earlier run, e.g. from before an upgrade of the kernel
+// or the NIC firmware. Results are read from the RunResult entries of the
+// log, which sum all destinations of an interval, and the RunLatencyResult
+// entries, and each metric of a protocol is averaged over all of the entries
+// of a run, so the baseline should be a log file of its own, written with
+// "-o", of a run with the same parameters. The first interval of each test
+// ramps up, so it is left out, unless the run has no other. A metric that is
+// worse than in the baseline by more than the tolerance, or that is missing
+// from the run, is a regression, and Ethr then exits with exitCodeRegression.
+// Two saved log files can be compared the same way without running a test.
+//
+type ethrBaselineMetric struct {
+	name          string
+	lowerIsBetter bool
+}
+
+var baselineMetrics = []ethrBaselineMetric{
+	{"Bits/s", false},
+	{"Conn/s", false},
+	{"Pkts/s", false},
+	{"Latency Avg", true},
+	{"Latency P50", true},
+	{"Latency P90", true},
+	{"Latency P95", true},
+	{"Latency P99", true},
+	{"Latency P99.9", true},
+	{"Latency P99.99", true},
+}
+
+type ethrResultMean struct {
+	sum   float64
+	count uint64
+}
+
+func (m *ethrResultMean) value() float64 {
+	return m.sum / float64(m.count)
+}
+
+//
+// ethrRunResults keeps the mean of each metric of each protocol of a run, and
+// separately that of the first intervals of its tests.
+//
+type ethrRunResults struct {
+	lock    sync.Mutex
+	results map[string]map[string]*ethrResultMean
+	warmup  map[string]map[string]*ethrResultMean
+}
+
+// Results of the running client, only kept when comparing with a baseline.
+var gRunResults *ethrRunResults
+
+func newRunResults() *ethrRunResults {
+	return &ethrRunResults{
+		results: make(map[string]map[string]*ethrResultMean),
+		warmup:  make(map[string]map[string]*ethrResultMean),
+	}
+}
+
+func (r *ethrRunResults) add(proto, metric string, v float64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	addResult(r.results, proto, metric, v)
+}
+
+func addResult(results map[string]map[string]*ethrResultMean, proto, metric string, v float64) {
+	metrics, found := results[proto]
+	if !found {
+		metrics = make(map[string]*ethrResultMean)
+		results[proto] = metrics
+	}
+	m, found := metrics[metric]
+	if !found {
+		m = &ethrResultMean{}
+		metrics[metric] = m
+	}
+	m.sum += v
+	m.count++
+}
+
+func (r *ethrRunResults) get(proto, metric string) (v float64, ok bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	m, found := r.results[proto][metric]
+	if !found {
+		m, found = r.warmup[proto][metric]
+	}
+	if !found {
+		return
+	}
+	return m.value(), true
+}
+
+func (r *ethrRunResults) protocols() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var protos []string
+	for _, p := range []EthrProtocol{TCP, UDP, ICMP, HTTP, HTTPS, QUIC} {
+		_, found := r.results[protoToString(p)]
+		if _, warmup := r.warmup[protoToString(p)]; found || warmup {
+			protos = append(protos, protoToString(p))
+		}
+	}
+	return protos
+}
+
+//
+// addRunResult adds the metrics that apply to the test of the result, e.g.
+// packets/s only apply to UDP.
+//
+func (r *ethrRunResults) addRunResult(d *logRunResult) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	results := r.results
+	if d.Interval == 0 {
+		results = r.warmup
+	}
+	if d.Test == testToString(Cps) {
+		addResult(results, d.Protocol, "Conn/s", float64(d.ConnectionsPerSecond))
+		return
+	}
+	addResult(results, d.Protocol, "Bits/s", float64(d.BitsPerSecond))
+	if d.Protocol == protoToString(UDP) {
+		addResult(results, d.Protocol, "Pkts/s", float64(d.PacketsPerSecond))
+	}
+}
+
+func (r *ethrRunResults) addRunLatency(d *logRunLatencyResult) {
+	r.add(d.Protocol, "Latency Avg", float64(d.Avg))
+	r.add(d.Protocol, "Latency P50", float64(d.P50))
+	r.add(d.Protocol, "Latency P90", float64(d.P90))
+	r.add(d.Protocol, "Latency P95", float64(d.P95))
+	r.add(d.Protocol, "Latency P99", float64(d.P99))
+	r.add(d.Protocol, "Latency P99.9", float64(d.P999))
+	r.add(d.Protocol, "Latency P99.99", float64(d.P9999))
+}
+
+//
+// loadRunResults reads the results of a run from its log file.
+//
+func loadRunResults(fileName string) (*ethrRunResults, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := newRunResults()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		var msg logMessage
+		if json.Unmarshal(line, &msg) != nil {
+			continue
+		}
+		switch msg.Type {
+		case "RunResult":
+			var d logRunResult
+			if json.Unmarshal(line, &d) == nil {
+				r.addRunResult(&d)
+			}
+		case "RunLatencyResult":
+			var d logRunLatencyResult
+			if json.Unmarshal(line, &d) == nil {
+				r.addRunLatency(&d)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(r.protocols()) == 0 {
+		return nil, fmt.Errorf("no test results in %s", fileName)
+	}
+	return r, nil
+}
+
+func mustLoadRunResults(fileName string) *ethrRunResults {
+	r, err := loadRunResults(fileName)
+	if err != nil {
+		fmt.Printf("Error: unable to read results from %s: %v\n", fileName, err)
+		os.Exit(1)
+	}
+	return r
+}
+
+//
+// runComparison compares the results of two saved log files, without running
+// a test.
+//
+func runComparison(baselineFile, fileName string, tolerance float64) {
+	initClientUI("")
+	baseline := mustLoadRunResults(baselineFile)
+	results := mustLoadRunResults(fileName)
+	if compareWithBaseline(baseline, results, baselineFile, tolerance) {
+		os.Exit(exitCodeRegression)
+	}
+}
+
+func baselineValueToString(metric ethrBaselineMetric, v float64) string {
+	if metric.lowerIsBetter {
+		return durationToString(time.Duration(v))
+	}
+	return numberToUnit(uint64(v))
+}
+
+//
+// compareWithBaseline shows the change of each metric of the baseline in the
+// results of the run, and returns whether any of them regressed by more than
+// the given tolerance in percent.
+//
+func compareWithBaseline(baseline, results *ethrRunResults, name string, tolerance float64) (regressed bool) {
+	ui.printMsg("- - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - -")
+	ui.printMsg("Comparison with baseline: %s, tolerance: %g%%", name, tolerance)
+	ui.printMsg("Protocol   Metric              Baseline       Current     Change")
+	for _, proto := range baseline.protocols() {
+		for _, metric := range baselineMetrics {
+			bv, ok := baseline.get(proto, metric.name)
+			if !ok {
+				continue
+			}
+			bs := baselineValueToString(metric, bv)
+			v, ok := results.get(proto, metric.name)
+			if !ok {
+				ui.printMsg("  %-5s    %-14s   %11s   %11s   %8s   MISSING", proto, metric.name, bs, "--", "--")
+				regressed = true
+				continue
+			}
+			if bv == 0 && v == 0 {
+				continue
+			}
+			s := baselineValueToString(metric, v)
+			if bv == 0 {
+				ui.printMsg("  %-5s    %-14s   %11s   %11s   %8s", proto, metric.name, bs, s, "--")
+				continue
+			}
+			change := (v - bv) * 100 / bv
+			worse := -change
+			if metric.lowerIsBetter {
+				worse = change
+			}
+			verdict := ""
+			if worse > tolerance {
+				verdict = "   REGRESSION"
+				regressed = true
+			}
+			ui.printMsg("  %-5s    %-14s   %11s   %11s   %+7.2f%%%s", proto, metric.name, bs, s, change, verdict)
+		}
+	}
+	if regressed {
+		ui.printMsg("Result: regression against the baseline")
+	} else {
+		ui.printMsg("Result: no regression against the baseline")
+	}
+	return
+}
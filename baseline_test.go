@@ -0,0 +1,133 @@
+//-----------------------------------------------------------------------------
+// Copyright (C) Microsoft. All rights reserved.
+// Licensed under the MIT license.
+// See LICENSE.txt file in the project root for full license information.
+//-----------------------------------------------------------------------------
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeRunLog(t *testing.T, entries ...interface{}) string {
+	var lines []string
+	for _, e := range entries {
+		if s, ok := e.(string); ok {
+			lines = append(lines, s)
+			continue
+		}
+		b, err := json.Marshal(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, string(b))
+	}
+	dir, err := ioutil.TempDir("", "ethr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	fileName := filepath.Join(dir, "run.log")
+	err = ioutil.WriteFile(fileName, []byte(strings.Join(lines, "\n")+"\n"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fileName
+}
+
+func TestLoadRunResults(t *testing.T) {
+	fileName := writeRunLog(t,
+		`{"Time":"2020-01-01T00:00:00Z","Type":"INFO","Message":"Ethr started"}`,
+		"not a log entry",
+		// Formatted results aren't compared, only the numbers of RunResult.
+		logTestResults{Type: "TestResult", Protocol: "TCP", BitsPerSecond: "9.99G"},
+		logRunResult{Type: "RunResult", Protocol: "TCP", Test: "Bandwidth", Interval: 0, BitsPerSecond: 100},
+		logRunResult{Type: "RunResult", Protocol: "TCP", Test: "Bandwidth", Interval: 1, BitsPerSecond: 1000},
+		logRunResult{Type: "RunResult", Protocol: "TCP", Test: "Bandwidth", Interval: 2, BitsPerSecond: 2000},
+		logRunResult{Type: "RunResult", Protocol: "UDP", Test: "Packets/s", Interval: 0, BitsPerSecond: 80, PacketsPerSecond: 10},
+		logRunResult{Type: "RunResult", Protocol: "HTTP", Test: "Connections/s", Interval: 1, ConnectionsPerSecond: 500},
+		logRunLatencyResult{Type: "RunLatencyResult", Protocol: "TCP", Count: 10, Avg: 10, P50: 10, P90: 20, P95: 30, P99: 40, P999: 50, P9999: 60},
+		logRunLatencyResult{Type: "RunLatencyResult", Protocol: "TCP", Count: 10, Avg: 30, P50: 20, P90: 40, P95: 50, P99: 60, P999: 70, P9999: 80},
+	)
+	r, err := loadRunResults(fileName)
+	if err != nil {
+		t.Fatalf("failed to load results: %v", err)
+	}
+	tests := []struct {
+		name   string
+		proto  string
+		metric string
+		want   float64
+		ok     bool
+	}{
+		{"first interval left out", "TCP", "Bits/s", 1500, true},
+		{"no packets/s for TCP", "TCP", "Pkts/s", 0, false},
+		{"only first interval", "UDP", "Pkts/s", 10, true},
+		{"only first interval, bandwidth", "UDP", "Bits/s", 80, true},
+		{"connections/s", "HTTP", "Conn/s", 500, true},
+		{"no bandwidth for connections/s", "HTTP", "Bits/s", 0, false},
+		{"latency", "TCP", "Latency Avg", 20, true},
+		{"latency percentile", "TCP", "Latency P99.99", 70, true},
+		{"no latency", "UDP", "Latency P50", 0, false},
+	}
+	for _, tt := range tests {
+		v, ok := r.get(tt.proto, tt.metric)
+		if v != tt.want || ok != tt.ok {
+			t.Errorf("%s: got %v, %v, want %v, %v", tt.name, v, ok, tt.want, tt.ok)
+		}
+	}
+	if protos := strings.Join(r.protocols(), ","); protos != "TCP,UDP,HTTP" {
+		t.Errorf("got protocols %s, want TCP,UDP,HTTP", protos)
+	}
+	_, err = loadRunResults(writeRunLog(t, logTestResults{Type: "TestResult", Protocol: "TCP", BitsPerSecond: "1G"}))
+	if err == nil {
+		t.Errorf("loaded results of a log without RunResult entries")
+	}
+	_, err = loadRunResults(filepath.Join(os.TempDir(), "ethr-no-such-file.log"))
+	if err == nil {
+		t.Errorf("loaded results of a missing file")
+	}
+}
+
+func TestCompareWithBaseline(t *testing.T) {
+	initClientUI("")
+	tests := []struct {
+		name      string
+		metric    string
+		baseline  float64
+		current   float64
+		missing   bool
+		tolerance float64
+		regressed bool
+	}{
+		{"same", "Bits/s", 1000, 1000, false, 5, false},
+		{"bandwidth within tolerance", "Bits/s", 1000, 960, false, 5, false},
+		{"bandwidth at tolerance", "Bits/s", 1000, 950, false, 5, false},
+		{"bandwidth beyond tolerance", "Bits/s", 1000, 940, false, 5, true},
+		{"bandwidth improved", "Bits/s", 1000, 2000, false, 5, false},
+		{"zero tolerance", "Conn/s", 1000, 999, false, 0, true},
+		{"latency within tolerance", "Latency P99", float64(time.Millisecond), float64(1040 * time.Microsecond), false, 5, false},
+		{"latency beyond tolerance", "Latency P99", float64(time.Millisecond), float64(1100 * time.Microsecond), false, 5, true},
+		{"latency improved", "Latency P99", float64(time.Millisecond), float64(500 * time.Microsecond), false, 5, false},
+		{"missing", "Bits/s", 1000, 0, true, 5, true},
+		{"zero baseline", "Pkts/s", 0, 100, false, 5, false},
+	}
+	for _, tt := range tests {
+		baseline, results := newRunResults(), newRunResults()
+		baseline.add("TCP", tt.metric, tt.baseline)
+		if !tt.missing {
+			results.add("TCP", tt.metric, tt.current)
+		} else {
+			results.add("TCP", "Latency Avg", 1)
+		}
+		if regressed := compareWithBaseline(baseline, results, tt.name, tt.tolerance); regressed != tt.regressed {
+			t.Errorf("%s: regressed is %v, want %v", tt.name, regressed, tt.regressed)
+		}
+	}
+}
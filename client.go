@@ -7,24 +7,25 @@ package main
 
 import (
 	//	"bytes"
-	//	"crypto/tls"
 	//	"crypto/x509"
 
 	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptrace"
 	"net/url"
-	"sort"
 	"strconv"
 	"sync"
 	"sync/atomic"
 
-	//	"io"
-	//	"io/ioutil"
 	"net"
-	//	"net/http"
 	"os"
 	"os/signal"
 
@@ -39,6 +40,11 @@ import (
 )
 
 var gIgnoreCert bool
+var gUseTLS bool
+var gNoKeepAlive bool
+var gSequentialTests bool
+var gConcurrentTests bool
+var gCompareCongestionControl bool
 
 const (
 	done       = 0
@@ -73,21 +79,143 @@ func initClient(title string) {
 	initClientUI(title)
 }
 
-func handshakeWithServer(test *ethrTest, conn net.Conn) (err error) {
-	ethrMsg := createSynMsg(test.testID, test.clientParam)
+//
+// Servers that predate versions of messages don't advertise the tests that
+// they support, so these are assumed to be the tests of the last such version.
+//
+var legacyServerTests = []EthrTestID{
+	{TCP, Bandwidth}, {TCP, Cps}, {TCP, Latency}, {TCP, Ping}, {TCP, TraceRoute}, {TCP, MyTraceRoute},
+	{UDP, Bandwidth}, {UDP, Pps},
+}
+
+// Time to wait for the server to reply to the SYN message, so that the client
+// doesn't hang if it is not talking to an Ethr server.
+const handshakeTimeout = 5 * time.Second
+
+var errNoAck = errors.New("no valid response from server, it may not be an Ethr server, or it may run an incompatible version of Ethr")
+
+//
+// handshakeWithServer sends the SYN message for testID, which is the test
+// itself, or the session of the test, and checks that the server can run the
+// test, using the capabilities that it advertises in its ACK message, which is
+// returned.
+//
+func handshakeWithServer(test *ethrTest, conn net.Conn, testID EthrTestID, clientParam EthrClientParam) (ack *EthrMsgAck, err error) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+	ethrMsg := createSynMsg(testID, clientParam, ui.getTitle())
 	err = sendSessionMsg(conn, ethrMsg)
 	if err != nil {
 		ui.printDbg("Failed to send SYN message to Ethr server. Error: %v", err)
 		return
 	}
 	ethrMsg = recvSessionMsg(conn)
+	if ethrMsg.Type == EthrAck && ethrMsg.Ack != nil && len(ethrMsg.Ack.Challenge) > 0 {
+		if gPSK == nil {
+			err = &ethrRejectedError{errAuthRequired.Error()}
+			recordServerReject(err)
+			return
+		}
+		synMsg := createSynMsg(testID, clientParam, ui.getTitle())
+		synMsg.Syn.Auth = computeAuthResponse(gPSK, ethrMsg.Ack.Challenge)
+		err = sendSessionMsg(conn, synMsg)
+		if err != nil {
+			ui.printDbg("Failed to send SYN message to Ethr server. Error: %v", err)
+			return
+		}
+		ethrMsg = recvSessionMsg(conn)
+	}
 	if ethrMsg.Type != EthrAck {
-		ui.printDbg("Failed to receive ACK message from Ethr server. Error: %v", err)
-		err = os.ErrInvalid
+		err = errNoAck
+		return
+	}
+	if ethrMsg.Ack != nil && ethrMsg.Ack.Error != "" {
+		err = &ethrRejectedError{ethrMsg.Ack.Error}
+		recordServerReject(err)
+		return
+	}
+	ack = ethrMsg.Ack
+	version := negotiateMsgVersion(ethrMsg.Version)
+	atomic.StoreUint32(&test.msgVersion, uint32(version))
+	tests, useTLS := legacyServerTests, false
+	var ccs, zcs []string
+	if version > 0 && ethrMsg.Ack != nil {
+		ui.printDbg("Ethr server version: %s, protocol version: %d", ethrMsg.Ack.ServerVersion, version)
+		tests, useTLS, ccs = ethrMsg.Ack.Tests, ethrMsg.Ack.TLS, ethrMsg.Ack.CongestionControls
+		zcs = ethrMsg.Ack.ZeroCopyModes
+		if clientParam.BufferSize > ethrMsg.Ack.Limits.MaxBufferSize {
+			err = fmt.Errorf("buffer size of %d bytes is larger than %d bytes, the largest allowed by the server",
+				clientParam.BufferSize, ethrMsg.Ack.Limits.MaxBufferSize)
+			return
+		}
+		if testID.Type == All {
+			clientCheckBwLimit(test, ethrMsg.Ack.Limits)
+		}
+	} else {
+		ui.printDbg("Ethr server runs an older version of Ethr, protocol version: 0")
+		test.noResults = true
+	}
+	if !isTestInList(test.testID, tests) {
+		err = fmt.Errorf("Ethr server doesn't support %s %s tests, it may run an older version of Ethr",
+			protoToString(test.testID.Protocol), testToString(test.testID.Type))
+		return
+	}
+	if gUseTLS && !useTLS {
+		err = errors.New("Ethr server doesn't support TLS, it may run an older version of Ethr")
+		return
+	}
+	cc := clientParam.CongestionControl
+	if cc != "" && (clientParam.Reverse || clientParam.Bidirectional) && !isStringInList(cc, ccs) {
+		err = fmt.Errorf("Ethr server can't use the %s congestion control algorithm, it may not be available "+
+			"on the server, or it may run an older version of Ethr", cc)
+		return
+	}
+	zc := clientParam.ZeroCopy
+	if zc != "" && (clientParam.Reverse || clientParam.Bidirectional) && !isStringInList(zc, zcs) {
+		err = fmt.Errorf("Ethr server can't send data in the %s zero copy mode, it may not run on Linux, "+
+			"or it may run an older version of Ethr", zc)
 	}
 	return
 }
 
+//
+// clientCheckBwLimit tells the user if the server throttles the bandwidth of
+// the test, as the client can't tell it apart from the bandwidth of the path.
+//
+func clientCheckBwLimit(test *ethrTest, limits EthrLimits) {
+	if limits.MaxBandwidth == 0 || test.testID.Type != Bandwidth {
+		return
+	}
+	bwRate := test.clientParam.BwRate * uint64(getNumStreams(test.clientParam))
+	if bwRate == 0 || bwRate > limits.MaxBandwidth {
+		ui.printMsg("Ethr server limits bandwidth to %sbits/s per client, the test is throttled.",
+			bytesToRate(limits.MaxBandwidth))
+	}
+}
+
+func isTestInList(testID EthrTestID, tests []EthrTestID) bool {
+	for _, t := range tests {
+		if t == testID {
+			return true
+		}
+	}
+	return false
+}
+
+//
+// clientHandshakeTLS runs the TLS handshake on a new connection to the server.
+// The client config has no session cache, so every connection does a full
+// handshake.
+//
+func clientHandshakeTLS(test *ethrTest, conn net.Conn) (net.Conn, error) {
+	tc := tls.Client(conn, test.tlsConfig)
+	err := tc.Handshake()
+	if err != nil {
+		return conn, err
+	}
+	return &ethrTLSConn{tc, conn}, nil
+}
+
 func getServerIPandPort(server string) (string, string, string, error) {
 	hostName := ""
 	hostIP := ""
@@ -117,41 +245,75 @@ func getServerIPandPort(server string) (string, string, string, error) {
 	return hostName, hostIP, port, err
 }
 
-func runClient(testID EthrTestID, title string, clientParam EthrClientParam, server string) {
+func runClient(testID EthrTestID, title string, clientParam EthrClientParam, servers []string, ccs []string) {
 	initClient(title)
-	hostName, hostIP, port, err := getServerIPandPort(server)
-	if err != nil {
+	if len(ccs) > 1 {
+		runCongestionControlComparison(testID, clientParam, servers[0], ccs)
 		return
 	}
-	ip := net.ParseIP(hostIP)
-	if ip != nil {
-		if ip.To4() != nil {
-			gIPVersion = ethrIPv4
-		} else {
-			gIPVersion = ethrIPv6
+	if len(ccs) == 1 {
+		clientParam.CongestionControl = ccs[0]
+	}
+	var tests []*ethrTest
+	for _, server := range servers {
+		test := newClientTest(testID, clientParam, server)
+		if test != nil {
+			tests = append(tests, test)
 		}
-	} else {
+	}
+	if len(tests) == 0 {
 		return
 	}
+	if len(servers) == 1 {
+		gIPVersion = getIPVersion(tests[0].remoteIP)
+		runTest(tests[0])
+		return
+	}
+	if gSequentialTests {
+		runTestsSequentially(tests)
+	} else {
+		runTestsConcurrently(tests)
+	}
+}
+
+//
+// newClientTest resolves the given destination and creates the test to run
+// against it. Errors are printed here, and nil is returned for destinations
+// that can't be used.
+//
+func newClientTest(testID EthrTestID, clientParam EthrClientParam, server string) *ethrTest {
+	hostName, hostIP, port, err := getServerIPandPort(server)
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(hostIP)
+	if ip == nil {
+		return nil
+	}
 
 	if gIsExternalClient {
+		if port == "" && testID.Protocol == HTTP {
+			port = "80"
+		} else if port == "" && testID.Protocol == HTTPS {
+			port = "443"
+		}
 		if testID.Protocol != ICMP && port == "" {
 			ui.printErr("In external mode, port cannot be empty for TCP tests.")
-			return
+			return nil
 		}
 	} else {
 		if port != "" {
 			ui.printErr("In client mode, port (%s) cannot be specified in destination (%s).", port, server)
 			ui.printMsg("Hint: Use external mode (-x).")
-			return
+			return nil
 		}
 		port = gEthrPortStr
 	}
 	ui.printMsg("Using destination: %s, ip: %s, port: %s", hostName, hostIP, port)
 	test, err := newTest(hostIP, testID, clientParam)
 	if err != nil {
-		ui.printErr("Failed to create the new test.")
-		return
+		ui.printErr("Failed to create the new test for destination: %s.", server)
+		return nil
 	}
 	test.remoteAddr = server
 	test.remoteIP = hostIP
@@ -161,16 +323,151 @@ func runClient(testID EthrTestID, title string, clientParam EthrClientParam, ser
 	} else {
 		test.dialAddr = fmt.Sprintf("[%s]:%s", hostIP, port)
 	}
-	runTest(test)
+	if gUseTLS || testID.Protocol == HTTP || testID.Protocol == HTTPS || testID.Protocol == QUIC {
+		test.tlsConfig = &tls.Config{
+			ServerName:         hostName,
+			InsecureSkipVerify: gIgnoreCert,
+		}
+	}
+	if testID.Protocol == QUIC {
+		test.tlsConfig.NextProtos = []string{quicALPN}
+		test.quicAddr = net.JoinHostPort(hostIP, getQUICPortStr())
+		ui.printMsg("Using QUIC port: %s", getQUICPortStr())
+	}
+	if testID.Protocol == HTTP || testID.Protocol == HTTPS {
+		test.httpURL = getHTTPURL(server, hostName, port, testID.Protocol)
+		ui.printMsg("Using URL: %s", test.httpURL)
+	}
+	if clientParam.CongestionControl != "" {
+		ui.printMsg("Using congestion control algorithm: %s", clientParam.CongestionControl)
+	}
+	return test
 }
 
-func runTest(test *ethrTest) {
-	toStop := make(chan int, 16)
+func getIPVersion(ipStr string) ethrIPVer {
+	ip := net.ParseIP(ipStr)
+	if ip != nil && ip.To4() != nil {
+		return ethrIPv4
+	}
+	return ethrIPv6
+}
+
+func runTest(test *ethrTest) (clientFin, serverFin *EthrMsgFin) {
+	gInterval = 0
+	startStatsTimer()
+	toStop := startTest(test)
+	reason := <-toStop
+	stopStatsTimer()
+	clientFin, serverFin = stopTest(test)
+	ui.emitTestSummary(test, clientFin, serverFin)
+	recordStopReason(reason)
+	printStopReason(reason, test.clientParam.Duration)
+	return
+}
+
+//
+// Tests against multiple destinations are run one after another, each with
+// its own results, and the results of all of them are summarized at the end.
+//
+func runTestsSequentially(tests []*ethrTest) {
+	clientFins := make([]*EthrMsgFin, len(tests))
+	serverFins := make([]*EthrMsgFin, len(tests))
+	for i, test := range tests {
+		ui.printMsg("Running test against destination: %s, ip: %s", test.remoteAddr, test.remoteIP)
+		gIPVersion = getIPVersion(test.remoteIP)
+		clientFins[i], serverFins[i] = runTest(test)
+	}
+	ui.emitAggregateSummary(tests, clientFins, serverFins)
+}
+
+//
+// To compare congestion control algorithms, the test is run with each of them,
+// one after another, and the results of all of them are summarized at the end.
+//
+func runCongestionControlComparison(testID EthrTestID, clientParam EthrClientParam, server string, ccs []string) {
+	gCompareCongestionControl = true
+	var tests []*ethrTest
+	var clientFins, serverFins []*EthrMsgFin
+	for _, cc := range ccs {
+		clientParam.CongestionControl = cc
+		test := newClientTest(testID, clientParam, server)
+		if test == nil {
+			return
+		}
+		gIPVersion = getIPVersion(test.remoteIP)
+		clientFin, serverFin := runTest(test)
+		// The test against the same destination is created again for the next
+		// algorithm.
+		deleteTest(test)
+		tests = append(tests, test)
+		clientFins = append(clientFins, clientFin)
+		serverFins = append(serverFins, serverFin)
+	}
+	ui.emitAggregateSummary(tests, clientFins, serverFins)
+}
+
+//
+// Tests against multiple destinations are run at the same time. Each interval
+// shows a row for each destination and a [SUM] row for all of them, and the
+// summary at the end does the same for the results of the whole test.
+//
+func runTestsConcurrently(tests []*ethrTest) {
+	gIPVersion = getIPVersion(tests[0].remoteIP)
+	for _, test := range tests {
+		if getIPVersion(test.remoteIP) != gIPVersion {
+			ui.printErr("All destinations must use the same IP version. Hint: Use -4 or -6.")
+			return
+		}
+	}
+	gConcurrentTests = true
+	gInterval = 0
+	clientFins := make([]*EthrMsgFin, len(tests))
+	serverFins := make([]*EthrMsgFin, len(tests))
+	reasons := make([]int, len(tests))
+	var wg sync.WaitGroup
 	startStatsTimer()
+	for i, test := range tests {
+		toStop := startTest(test)
+		wg.Add(1)
+		go func(i int, test *ethrTest, toStop chan int) {
+			defer wg.Done()
+			reasons[i] = <-toStop
+			clientFins[i], serverFins[i] = stopTest(test)
+		}(i, test, toStop)
+	}
+	wg.Wait()
+	stopStatsTimer()
+	ui.emitAggregateSummary(tests, clientFins, serverFins)
+	// Report the reason that ended any of the tests early, if there is one.
+	reason := reasons[0]
+	for _, r := range reasons {
+		if r == interrupt || r == disconnect {
+			reason = r
+		}
+	}
+	recordStopReason(reason)
+	printStopReason(reason, tests[0].clientParam.Duration)
+}
+
+func startTest(test *ethrTest) chan int {
+	toStop := make(chan int, 16)
 	gap := test.clientParam.Gap
 	duration := test.clientParam.Duration
-	runDurationTimer(duration, toStop)
 	test.isActive = true
+	test.startTime = time.Now()
+	test.startCPUTime()
+	err := clientOpenAuthSession(test)
+	if err != nil {
+		if _, ok := err.(*ethrRejectedError); ok {
+			ui.printErr("Ethr server rejected the client. Error: %v", err)
+		} else {
+			ui.printErr("Failed in handshake with the server. Error: %v", err)
+		}
+		test.noResults = true
+		toStop <- disconnect
+		return toStop
+	}
+	runDurationTimer(duration, toStop)
 	if test.testID.Protocol == TCP {
 		if test.testID.Type == Bandwidth {
 			tcpRunBandwidthTest(test, toStop)
@@ -191,6 +488,24 @@ func runTest(test *ethrTest) {
 		if test.testID.Type == Bandwidth ||
 			test.testID.Type == Pps {
 			runUDPBandwidthAndPpsTest(test)
+		} else if test.testID.Type == Latency {
+			go runUDPLatencyTest(test, gap)
+		}
+	} else if test.testID.Protocol == HTTP || test.testID.Protocol == HTTPS {
+		if test.testID.Type == Bandwidth {
+			httpRunBandwidthTest(test, toStop)
+		} else if test.testID.Type == Latency {
+			go httpRunLatencyTest(test, gap, toStop)
+		} else if test.testID.Type == Cps {
+			go httpRunCpsTest(test)
+		}
+	} else if test.testID.Protocol == QUIC {
+		if test.testID.Type == Bandwidth {
+			quicRunBandwidthTest(test, toStop)
+		} else if test.testID.Type == Latency {
+			go runTCPLatencyTest(test, gap, toStop)
+		} else if test.testID.Type == Cps {
+			go quicRunCpsTest(test)
 		}
 	} else if test.testID.Protocol == ICMP {
 		VerifyPermissionForTest(test.testID)
@@ -203,12 +518,40 @@ func runTest(test *ethrTest) {
 		}
 	}
 	handleInterrupt(toStop)
-	reason := <-toStop
-	stopStatsTimer()
+	return toStop
+}
+
+func stopTest(test *ethrTest) (clientFin, serverFin *EthrMsgFin) {
 	close(test.done)
+	elapsed := time.Since(test.startTime)
 	if test.testID.Type == Ping {
 		time.Sleep(2 * time.Second)
 	}
+	// Wait for the traffic to stop so that the totals are final before exchanging them.
+	test.wg.Wait()
+	test.isActive = false
+	cpu, otherTests := test.stopCPUTime()
+	clientFin = &EthrMsgFin{
+		TestID:            test.testID,
+		Bytes:             atomic.LoadUint64(&test.testResult.totalBw),
+		ReverseBytes:      atomic.LoadUint64(&test.testResult.totalRevBw),
+		Packets:           atomic.LoadUint64(&test.testResult.totalPps),
+		Connections:       atomic.LoadUint64(&test.testResult.totalCps),
+		Elapsed:           elapsed,
+		CongestionControl: test.takeCongestionControl(),
+		CPUTime:           cpu,
+		OtherTests:        otherTests,
+	}
+	if !gIsExternalClient && !test.noResults && isResultExchangeSupported(test.testID) {
+		serverFin = clientExchangeResults(test, clientFin)
+		recordTestLoss(test, clientFin, serverFin)
+	}
+	scenarioAddSummary(test, clientFin, serverFin)
+	clientCloseAuthSession(test)
+	return
+}
+
+func printStopReason(reason int, duration time.Duration) {
 	switch reason {
 	case done:
 		ui.printMsg("Ethr done, measurement complete.")
@@ -220,49 +563,121 @@ func runTest(test *ethrTest) {
 	case disconnect:
 		ui.printMsg("Ethr done, connection terminated.")
 	}
+}
+
+func isResultExchangeSupported(testID EthrTestID) bool {
+	switch testID.Protocol {
+	case TCP:
+		return testID.Type == Bandwidth || testID.Type == Cps
+	case UDP:
+		return testID.Type == Bandwidth || testID.Type == Pps
+	case HTTP, HTTPS, QUIC:
+		return testID.Type == Bandwidth || testID.Type == Cps
+	}
+	return false
+}
+
+func clientExchangeResults(test *ethrTest, clientFin *EthrMsgFin) (serverFin *EthrMsgFin) {
+	conn, err := ethrDialEx(TCP, test.dialAddr, gLocalIP, gClientPort, int(gTTL), int(gTOS))
+	if err != nil {
+		ui.printDbg("Failed to connect to Ethr server for results exchange. Error: %v", err)
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	err = sendSessionMsg(conn, createFinMsg(EthrMsgVer(atomic.LoadUint32(&test.msgVersion)), clientFin))
+	if err != nil {
+		return
+	}
+	ethrMsg := recvSessionMsg(conn)
+	if ethrMsg.Type == EthrFin && ethrMsg.Fin != nil {
+		serverFin = ethrMsg.Fin
+	} else {
+		ui.printDbg("Failed to receive FIN message from Ethr server.")
+	}
 	return
 }
 
 func tcpRunBandwidthTest(test *ethrTest, toStop chan int) {
-	var wg sync.WaitGroup
-	tcpRunBanwidthTestThreads(test, &wg)
+	tcpRunBanwidthTestThreads(test, &test.wg)
 	go func(wg *sync.WaitGroup) {
 		wg.Wait()
 		toStop <- disconnect
-	}(&wg)
+	}(&test.wg)
 }
 
 func tcpRunBanwidthTestThreads(test *ethrTest, wg *sync.WaitGroup) {
-	for th := uint32(0); th < test.clientParam.NumThreads; th++ {
+	//
+	// In bidirectional mode, the first half of connections send data to the
+	// server and the second half receive data from it. Direction of each
+	// connection is sent to the server using Reverse in its own SYN message.
+	//
+	numConns := test.clientParam.NumThreads
+	if test.clientParam.Bidirectional {
+		numConns *= 2
+	}
+	for th := uint32(0); th < numConns; th++ {
+		clientParam := test.clientParam
+		if clientParam.Bidirectional {
+			clientParam.Reverse = th >= test.clientParam.NumThreads
+		}
 		conn, err := ethrDialInc(TCP, test.dialAddr, uint16(th))
 		if err != nil {
 			ui.printErr("Error dialing connection: %v", err)
 			continue
 		}
-		err = handshakeWithServer(test, conn)
+		if clientParam.CongestionControl != "" {
+			err = setCongestionControl(conn, clientParam.CongestionControl)
+			if err != nil {
+				ui.printErr("Failed to set congestion control algorithm %s. Error: %v", clientParam.CongestionControl, err)
+				conn.Close()
+				continue
+			}
+		}
+		if !clientParam.Reverse {
+			test.recordCongestionControl(conn)
+		}
+		if gUseTLS {
+			conn, err = clientHandshakeTLS(test, conn)
+			if err != nil {
+				ui.printErr("Failed in TLS handshake with the server. Error: %v", err)
+				conn.Close()
+				continue
+			}
+		}
+		ack, err := handshakeWithServer(test, conn, test.testID, clientParam)
 		if err != nil {
 			ui.printErr("Failed in handshake with the server. Error: %v", err)
 			conn.Close()
 			continue
 		}
+		atomic.AddUint64(&test.testResult.totalCps, 1)
 		wg.Add(1)
-		go runTCPBandwidthTestHandler(test, conn, wg)
+		go runTCPBandwidthTestHandler(test, conn, clientParam.Reverse, ack, wg)
 	}
 }
 
-func runTCPBandwidthTestHandler(test *ethrTest, conn net.Conn, wg *sync.WaitGroup) {
+func runTCPBandwidthTestHandler(test *ethrTest, conn net.Conn, reverse bool, ack *EthrMsgAck, wg *sync.WaitGroup) {
 	defer wg.Done()
 	defer conn.Close()
-	ec := test.newConn(conn)
+	ec := test.newConn(conn, reverse)
 	rserver, rport, _ := net.SplitHostPort(conn.RemoteAddr().String())
 	lserver, lport, _ := net.SplitHostPort(conn.LocalAddr().String())
 	ui.printMsg("[%3d] local %s port %s connected to %s port %s",
 		ec.fd, lserver, lport, rserver, rport)
+	clientPrintMPTCP(ec.fd, conn)
+	clientPrintSockOpts(test, ec.fd, conn, TCP, ack)
 	size := test.clientParam.BufferSize
 	buff := make([]byte, size)
 	for i := uint32(0); i < size; i++ {
 		buff[i] = byte(i)
 	}
+	dp, err := newDataPath(conn, test.clientParam.ZeroCopy, buff, !reverse)
+	if err != nil {
+		ui.printErr("[%3d] Failed to use zero copy mode %s. Error: %v", ec.fd, test.clientParam.ZeroCopy, err)
+		return
+	}
+	defer dp.close()
 	bufferLen := len(buff)
 	totalBytesToSend := test.clientParam.BwRate
 	sentBytes := uint64(0)
@@ -275,10 +690,10 @@ ExitForLoop:
 		default:
 			n := 0
 			var err error = nil
-			if test.clientParam.Reverse {
-				n, err = conn.Read(buff)
+			if reverse {
+				n, err = dp.recv(buff)
 			} else {
-				n, err = conn.Write(buff[:bytesToSend])
+				n, err = dp.send(buff[:bytesToSend])
 			}
 			if err != nil {
 				ui.printDbg("Error sending/receiving data on a connection for bandwidth test: %v", err)
@@ -286,7 +701,12 @@ ExitForLoop:
 			}
 			atomic.AddUint64(&ec.bw, uint64(n))
 			atomic.AddUint64(&test.testResult.bw, uint64(n))
-			if !test.clientParam.Reverse {
+			if reverse {
+				atomic.AddUint64(&test.testResult.totalRevBw, uint64(n))
+			} else {
+				atomic.AddUint64(&test.testResult.totalBw, uint64(n))
+			}
+			if !reverse {
 				sentBytes += uint64(n)
 				start, waitTime, sentBytes, bytesToSend = enforceThrottle(start, waitTime, totalBytesToSend, sentBytes, bufferLen)
 			}
@@ -296,17 +716,33 @@ ExitForLoop:
 
 func runTCPLatencyTest(test *ethrTest, g time.Duration, toStop chan int) {
 	ui.printMsg("Running latency test: %v, %v", test.clientParam.RttCount, test.clientParam.BufferSize)
-	conn, err := ethrDial(TCP, test.dialAddr)
+	var conn net.Conn
+	var err error
+	if test.testID.Protocol == QUIC {
+		// The latency connection of QUIC tests is a stream of a connection of its own.
+		conn, err = quicDialStream(test)
+	} else {
+		conn, err = ethrDial(TCP, test.dialAddr)
+	}
 	if err != nil {
 		ui.printErr("Error dialing the latency connection: %v", err)
 		return
 	}
 	defer conn.Close()
-	err = handshakeWithServer(test, conn)
+	if gUseTLS {
+		conn, err = clientHandshakeTLS(test, conn)
+		if err != nil {
+			ui.printErr("Failed in TLS handshake with the server. Error: %v", err)
+			return
+		}
+	}
+	ack, err := handshakeWithServer(test, conn, test.testID, test.clientParam)
 	if err != nil {
 		ui.printErr("Failed in handshake with the server. Error: %v", err)
 		return
 	}
+	clientPrintMPTCP(getFd(conn), conn)
+	clientPrintSockOpts(test, getFd(conn), conn, TCP, ack)
 	ui.emitLatencyHdr()
 	buffSize := test.clientParam.BufferSize
 	buff := make([]byte, buffSize)
@@ -315,7 +751,7 @@ func runTCPLatencyTest(test *ethrTest, g time.Duration, toStop chan int) {
 	}
 	blen := len(buff)
 	rttCount := test.clientParam.RttCount
-	latencyNumbers := make([]time.Duration, rttCount)
+	hist := newHistogram()
 ExitForLoop:
 	for {
 	ExitSelect:
@@ -339,12 +775,13 @@ ExitForLoop:
 					break ExitSelect
 				}
 				e2 := time.Since(s1)
-				latencyNumbers[i] = e2
+				hist.record(e2)
 			}
 			// TODO temp code, fix it better, this is to allow server to do
 			// server side latency measurements as well.
 			_, _ = conn.Write(buff)
-			calcAndPrintLatency(test, rttCount, latencyNumbers)
+			printLatency(test, hist, 0)
+			hist.reset()
 			t1 := time.Since(t0)
 			if t1 < g {
 				time.Sleep(g - t1)
@@ -353,42 +790,26 @@ ExitForLoop:
 	}
 }
 
-func calcAndPrintLatency(test *ethrTest, rttCount uint32, latencyNumbers []time.Duration) {
-	sum := int64(0)
-	for _, d := range latencyNumbers {
-		sum += d.Nanoseconds()
-	}
-	elapsed := time.Duration(sum / int64(rttCount))
-	sort.SliceStable(latencyNumbers, func(i, j int) bool {
-		return latencyNumbers[i] < latencyNumbers[j]
-	})
-	//
-	// Special handling for rttCount == 1. This prevents negative index
-	// in the latencyNumber index. The other option is to use
-	// roundUpToZero() but that is more expensive.
-	//
-	rttCountFixed := rttCount
-	if rttCountFixed == 1 {
-		rttCountFixed = 2
-	}
-	avg := elapsed
-	min := latencyNumbers[0]
-	max := latencyNumbers[rttCount-1]
-	p50 := latencyNumbers[((rttCountFixed*50)/100)-1]
-	p90 := latencyNumbers[((rttCountFixed*90)/100)-1]
-	p95 := latencyNumbers[((rttCountFixed*95)/100)-1]
-	p99 := latencyNumbers[((rttCountFixed*99)/100)-1]
-	p999 := latencyNumbers[uint64(((float64(rttCountFixed)*99.9)/100)-1)]
-	p9999 := latencyNumbers[uint64(((float64(rttCountFixed)*99.99)/100)-1)]
+//
+// printLatency shows the latencies of the probes of an interval, and the
+// probes that were lost, i.e. timed out, for tests that can lose them.
+//
+func printLatency(test *ethrTest, hist *ethrHistogram, lost uint32) {
+	if hist.count > 0 {
+		csvAddLatencyResult(test, hist)
+	}
+	logRunLatency(test.session.remoteIP, protoToString(test.testID.Protocol), hist)
 	ui.emitLatencyResults(
 		test.session.remoteIP,
 		protoToString(test.testID.Protocol),
-		avg, min, max, p50, p90, p95, p99, p999, p9999)
+		hist, lost)
 }
 
 func tcpRunCpsTest(test *ethrTest) {
 	for th := uint32(0); th < test.clientParam.NumThreads; th++ {
+		test.wg.Add(1)
 		go func(th uint32) {
+			defer test.wg.Done()
 		ExitForLoop:
 			for {
 				select {
@@ -396,8 +817,17 @@ func tcpRunCpsTest(test *ethrTest) {
 					break ExitForLoop
 				default:
 					conn, err := ethrDialAll(TCP, test.dialAddr)
+					if err == nil && gUseTLS {
+						// Only connections that complete the TLS handshake are counted.
+						tcpconn := conn
+						conn, err = clientHandshakeTLS(test, conn)
+						if err != nil {
+							tcpconn.Close()
+						}
+					}
 					if err == nil {
 						atomic.AddUint64(&test.testResult.cps, 1)
+						atomic.AddUint64(&test.testResult.totalCps, 1)
 						tcpconn, ok := conn.(*net.TCPConn)
 						if ok {
 							tcpconn.SetLinger(0)
@@ -412,6 +842,261 @@ func tcpRunCpsTest(test *ethrTest) {
 	}
 }
 
+//
+// getHTTPURL returns the URL used for HTTP tests. In external mode, the
+// destination is used as is if it is a URL, so that any HTTP server can be
+// tested. Otherwise, the URL points to the root of the given server.
+//
+func getHTTPURL(server, hostName, port string, proto EthrProtocol) string {
+	if gIsExternalClient {
+		u, err := url.Parse(server)
+		if err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" {
+			return server
+		}
+	}
+	scheme := "http"
+	if proto == HTTPS {
+		scheme = "https"
+	}
+	return scheme + "://" + net.JoinHostPort(hostName, port) + "/"
+}
+
+//
+// getHTTPRequestURL returns the URL to request a payload of the given size
+// from the Ethr server. External servers are sent requests for the URL as is.
+//
+func getHTTPRequestURL(test *ethrTest, size uint32) string {
+	if gIsExternalClient {
+		return test.httpURL
+	}
+	return fmt.Sprintf("%s?size=%d", test.httpURL, size)
+}
+
+//
+// newHTTPClient returns an HTTP/1.1 client with its own connection pool, so
+// that the requests of each thread use their own connection, or a new
+// connection for every request when keep-alive is disabled.
+//
+func newHTTPClient(test *ethrTest) *http.Client {
+	tr := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return ethrDialAll(TCP, test.dialAddr)
+		},
+		TLSClientConfig:    test.tlsConfig,
+		TLSNextProto:       make(map[string]func(string, *tls.Conn) http.RoundTripper),
+		DisableKeepAlives:  gNoKeepAlive,
+		DisableCompression: true,
+	}
+	return &http.Client{Transport: tr}
+}
+
+//
+// newHTTPTestContext returns a context that is canceled when the test ends,
+// so that requests in progress don't run past the end of the test.
+//
+func newHTTPTestContext(test *ethrTest) context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-test.done
+		cancel()
+	}()
+	return ctx
+}
+
+func checkHTTPResponse(resp *http.Response) error {
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected response status: %s", resp.Status)
+	}
+	return nil
+}
+
+//
+// httpCountingReader accounts the payload of HTTP requests and responses to
+// a connection of the test, as it is read.
+//
+type httpCountingReader struct {
+	io.Reader
+	ec *ethrConn
+}
+
+func (r *httpCountingReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	if n > 0 {
+		test := r.ec.test
+		atomic.AddUint64(&r.ec.bw, uint64(n))
+		atomic.AddUint64(&test.testResult.bw, uint64(n))
+		if r.ec.reverse {
+			atomic.AddUint64(&test.testResult.totalRevBw, uint64(n))
+		} else {
+			atomic.AddUint64(&test.testResult.totalBw, uint64(n))
+		}
+	}
+	return n, err
+}
+
+func httpRunBandwidthTest(test *ethrTest, toStop chan int) {
+	for th := uint32(0); th < test.clientParam.NumThreads; th++ {
+		test.wg.Add(1)
+		go httpRunBandwidthTestHandler(test, th)
+	}
+	go func(wg *sync.WaitGroup) {
+		wg.Wait()
+		toStop <- disconnect
+	}(&test.wg)
+}
+
+//
+// httpRunBandwidthTestHandler uploads payloads using POST, or downloads them
+// using GET in reverse mode, back to back. Requests of a thread may use many
+// connections, so each thread is shown as a connection, identified by its
+// number.
+//
+func httpRunBandwidthTestHandler(test *ethrTest, th uint32) {
+	defer test.wg.Done()
+	reverse := test.clientParam.Reverse
+	ec := test.newConnWithFd(nil, uintptr(th), reverse)
+	client := newHTTPClient(test)
+	defer client.CloseIdleConnections()
+	ctx := newHTTPTestContext(test)
+	size := test.clientParam.BufferSize
+	buff := make([]byte, size)
+	for i := uint32(0); i < size; i++ {
+		buff[i] = byte(i)
+	}
+	for {
+		select {
+		case <-test.done:
+			return
+		default:
+		}
+		var req *http.Request
+		var err error
+		if reverse {
+			req, err = http.NewRequest(http.MethodGet, getHTTPRequestURL(test, size), nil)
+		} else {
+			req, err = http.NewRequest(http.MethodPost, test.httpURL, &httpCountingReader{bytes.NewReader(buff), ec})
+			if err == nil {
+				req.ContentLength = int64(size)
+			}
+		}
+		if err != nil {
+			ui.printErr("Failed to create HTTP request. Error: %v", err)
+			return
+		}
+		resp, err := client.Do(req.WithContext(ctx))
+		if err == nil {
+			var body io.Reader = resp.Body
+			if reverse {
+				body = &httpCountingReader{resp.Body, ec}
+			}
+			_, err = io.Copy(ioutil.Discard, body)
+			resp.Body.Close()
+			if err == nil {
+				err = checkHTTPResponse(resp)
+			}
+		}
+		if err != nil {
+			if ctx.Err() == nil {
+				ui.printErr("Error in HTTP request for bandwidth test: %v", err)
+			}
+			return
+		}
+		atomic.AddUint64(&test.testResult.totalCps, 1)
+	}
+}
+
+//
+// httpGet requests a payload of the test buffer size and returns the time to
+// first byte of the response, i.e. the time it took to get the status line.
+//
+func httpGet(ctx context.Context, client *http.Client, test *ethrTest) (ttfb time.Duration, err error) {
+	req, err := http.NewRequest(http.MethodGet, getHTTPRequestURL(test, test.clientParam.BufferSize), nil)
+	if err != nil {
+		return
+	}
+	var t0, t1 time.Time
+	trace := &httptrace.ClientTrace{
+		GotFirstResponseByte: func() {
+			t1 = time.Now()
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(ctx, trace))
+	t0 = time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return
+	}
+	_, err = io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return
+	}
+	err = checkHTTPResponse(resp)
+	ttfb = t1.Sub(t0)
+	return
+}
+
+func httpRunLatencyTest(test *ethrTest, g time.Duration, toStop chan int) {
+	ui.printMsg("Running HTTP time to first byte test: %v, %v", test.clientParam.RttCount, test.clientParam.BufferSize)
+	client := newHTTPClient(test)
+	defer client.CloseIdleConnections()
+	ctx := newHTTPTestContext(test)
+	ui.emitLatencyHdr()
+	rttCount := test.clientParam.RttCount
+	hist := newHistogram()
+	for {
+		select {
+		case <-test.done:
+			return
+		default:
+		}
+		t0 := time.Now()
+		for i := uint32(0); i < rttCount; i++ {
+			ttfb, err := httpGet(ctx, client, test)
+			if err != nil {
+				if ctx.Err() == nil {
+					ui.printErr("Error in HTTP request for latency test: %v", err)
+					toStop <- disconnect
+				}
+				return
+			}
+			hist.record(ttfb)
+		}
+		printLatency(test, hist, 0)
+		hist.reset()
+		t1 := time.Since(t0)
+		if t1 < g {
+			time.Sleep(g - t1)
+		}
+	}
+}
+
+func httpRunCpsTest(test *ethrTest) {
+	for th := uint32(0); th < test.clientParam.NumThreads; th++ {
+		test.wg.Add(1)
+		go func() {
+			defer test.wg.Done()
+			client := newHTTPClient(test)
+			defer client.CloseIdleConnections()
+			ctx := newHTTPTestContext(test)
+			for {
+				select {
+				case <-test.done:
+					return
+				default:
+				}
+				_, err := httpGet(ctx, client, test)
+				if err == nil {
+					atomic.AddUint64(&test.testResult.cps, 1)
+					atomic.AddUint64(&test.testResult.totalCps, 1)
+				} else if ctx.Err() == nil {
+					ui.printDbg("Error in HTTP request to %s, error: %v", test.httpURL, err)
+				}
+			}
+		}()
+	}
+}
+
 func clientRunPingTest(test *ethrTest, g time.Duration, warmupCount uint32) {
 	// TODO: Override NumThreads for now, fix it later to support parallel
 	// threads.
@@ -420,12 +1105,12 @@ func clientRunPingTest(test *ethrTest, g time.Duration, warmupCount uint32) {
 		go func() {
 			var sent, rcvd, lost uint32
 			warmupText := "[warmup] "
-			latencyNumbers := make([]time.Duration, 0)
+			hist := newHistogram()
 		ExitForLoop:
 			for {
 				select {
 				case <-test.done:
-					printConnectionLatencyResults(test.dialAddr, test, sent, rcvd, lost, latencyNumbers)
+					printConnectionLatencyResults(test.dialAddr, test, sent, rcvd, lost, hist)
 					break ExitForLoop
 				default:
 					t0 := time.Now()
@@ -437,16 +1122,11 @@ func clientRunPingTest(test *ethrTest, g time.Duration, warmupCount uint32) {
 						latency, err := clientRunPing(test, "")
 						if err == nil {
 							rcvd++
-							latencyNumbers = append(latencyNumbers, latency)
+							hist.record(latency)
 						} else {
 							lost++
 						}
 					}
-					if rcvd >= 1000 {
-						printConnectionLatencyResults(test.dialAddr, test, sent, rcvd, lost, latencyNumbers)
-						latencyNumbers = make([]time.Duration, 0)
-						sent, rcvd, lost = 0, 0, 0
-					}
 					t1 := time.Since(t0)
 					if t1 < g {
 						time.Sleep(g - t1)
@@ -485,14 +1165,15 @@ func tcpRunPing(test *ethrTest, prefix string) (timeTaken time.Duration, err err
 	return
 }
 
-func printConnectionLatencyResults(server string, test *ethrTest, sent, rcvd, lost uint32, latencyNumbers []time.Duration) {
-	fmt.Println("-----------------------------------------------------------------------------------------")
+func printConnectionLatencyResults(server string, test *ethrTest, sent, rcvd, lost uint32, hist *ethrHistogram) {
+	ui.printMsg("-----------------------------------------------------------------------------------------")
 	ui.printMsg("TCP connect statistics for %s:", server)
 	ui.printMsg("  Sent = %d, Received = %d, Lost = %d", sent, rcvd, lost)
+	recordLoss(uint64(sent), uint64(lost))
 	if rcvd > 0 {
 		ui.emitLatencyHdr()
-		calcAndPrintLatency(test, rcvd, latencyNumbers)
-		fmt.Println("-----------------------------------------------------------------------------------------")
+		printLatency(test, hist, lost)
+		ui.printMsg("-----------------------------------------------------------------------------------------")
 	}
 }
 
@@ -628,9 +1309,7 @@ type ethrHopData struct {
 	rcvd     uint32
 	lost     uint32
 	last     time.Duration
-	best     time.Duration
-	worst    time.Duration
-	total    time.Duration
+	hist     *ethrHistogram
 	name     string
 	fullName string
 }
@@ -696,7 +1375,6 @@ func icmpRunTraceRouteInternal(test *ethrTest, gap time.Duration, toStop chan in
 
 func copyInitialHopData(hop int, hopData ethrHopData) {
 	gHop[hop].addr = hopData.addr
-	gHop[hop].best = hopData.last
 	gHop[hop].name = hopData.name
 	gHop[hop].fullName = hopData.fullName
 }
@@ -704,13 +1382,10 @@ func copyInitialHopData(hop int, hopData ethrHopData) {
 func genHopData(hopData *ethrHopData, peerAddr string, elapsed time.Duration) {
 	hopData.addr = peerAddr
 	hopData.last = elapsed
-	if hopData.best > elapsed {
-		hopData.best = elapsed
-	}
-	if hopData.worst < elapsed {
-		hopData.worst = elapsed
+	if hopData.hist == nil {
+		hopData.hist = newHistogram()
 	}
-	hopData.total += elapsed
+	hopData.hist.record(elapsed)
 	hopData.rcvd++
 }
 
@@ -957,43 +1632,85 @@ func icmpRecvMsg(c net.PacketConn, proto EthrProtocol, timeout time.Duration, ne
 
 func runUDPBandwidthAndPpsTest(test *ethrTest) {
 	for th := uint32(0); th < test.clientParam.NumThreads; th++ {
+		test.wg.Add(1)
 		go func(th uint32) {
+			defer test.wg.Done()
+			// Packets/s tests can send packets that are too small for the
+			// header, and then the server doesn't measure loss for these.
 			size := test.clientParam.BufferSize
+			if size < udpDataHdrLen && test.testID.Type != Pps {
+				size = udpDataHdrLen
+			}
+			withHdr := size >= udpDataHdrLen
 			buff := make([]byte, size)
+			if withHdr {
+				binary.BigEndian.PutUint32(buff[0:], udpDataMagic)
+			}
+			seq := uint64(0)
 			conn, err := ethrDialInc(UDP, test.dialAddr, uint16(th))
 			if err != nil {
 				ui.printDbg("Unable to dial UDP, error: %v", err)
 				return
 			}
 			defer conn.Close()
-			ec := test.newConn(conn)
+			ec := test.newConn(conn, false)
 			rserver, rport, _ := net.SplitHostPort(conn.RemoteAddr().String())
 			lserver, lport, _ := net.SplitHostPort(conn.LocalAddr().String())
 			ui.printMsg("[%3d] local %s port %s connected to %s port %s",
 				ec.fd, lserver, lport, rserver, rport)
+			clientPrintSockOpts(test, ec.fd, conn, UDP, nil)
 			bufferLen := len(buff)
 			totalBytesToSend := test.clientParam.BwRate
 			sentBytes := uint64(0)
 			start, waitTime, bytesToSend := beginThrottle(totalBytesToSend, bufferLen)
+			var sender *ethrUDPBatchSender
+			batch := udpSendBatch(int(test.clientParam.Batch), bufferLen, test.clientParam.UDPOffload)
+			if batch > 1 {
+				sender = newUDPBatchSender(newBatchConn(conn.(*net.UDPConn)), batch, bufferLen, test.clientParam.UDPOffload)
+			}
 		ExitForLoop:
 			for {
 				select {
 				case <-test.done:
 					break ExitForLoop
 				default:
-					n, err := conn.Write(buff[:bytesToSend])
-					if err != nil {
-						ui.printDbg("%v", err)
-						continue
+					if bytesToSend < udpDataHdrLen && withHdr {
+						bytesToSend = udpDataHdrLen
 					}
-					if n < bytesToSend {
-						ui.printDbg("Partial write: %d", n)
-						continue
+					n, pkts := 0, 1
+					if sender != nil {
+						var err error
+						n, err = sender.send(&seq, udpBatchCount(batch, totalBytesToSend, sentBytes, bytesToSend), bytesToSend)
+						if err != nil {
+							ui.printDbg("%v", err)
+						}
+						if n == 0 {
+							continue
+						}
+						pkts = (n + bytesToSend - 1) / bytesToSend
+					} else {
+						if withHdr {
+							seq++
+							binary.BigEndian.PutUint64(buff[4:], seq)
+							binary.BigEndian.PutUint64(buff[12:], uint64(time.Now().UnixNano()))
+						}
+						var err error
+						n, err = conn.Write(buff[:bytesToSend])
+						if err != nil {
+							ui.printDbg("%v", err)
+							continue
+						}
+						if n < bytesToSend {
+							ui.printDbg("Partial write: %d", n)
+							continue
+						}
 					}
 					atomic.AddUint64(&ec.bw, uint64(n))
-					atomic.AddUint64(&ec.pps, 1)
+					atomic.AddUint64(&ec.pps, uint64(pkts))
 					atomic.AddUint64(&test.testResult.bw, uint64(n))
-					atomic.AddUint64(&test.testResult.pps, 1)
+					atomic.AddUint64(&test.testResult.pps, uint64(pkts))
+					atomic.AddUint64(&test.testResult.totalBw, uint64(n))
+					atomic.AddUint64(&test.testResult.totalPps, uint64(pkts))
 					if !test.clientParam.Reverse {
 						sentBytes += uint64(n)
 						start, waitTime, sentBytes, bytesToSend = enforceThrottle(start, waitTime, totalBytesToSend, sentBytes, bufferLen)
@@ -1003,3 +1720,83 @@ func runUDPBandwidthAndPpsTest(test *ethrTest) {
 		}(th)
 	}
 }
+
+func runUDPLatencyTest(test *ethrTest, g time.Duration) {
+	ui.printMsg("Running latency test: %v, %v", test.clientParam.RttCount, test.clientParam.BufferSize)
+	conn, err := ethrDial(UDP, test.dialAddr)
+	if err != nil {
+		ui.printErr("Error dialing the latency connection: %v", err)
+		return
+	}
+	defer conn.Close()
+	ui.emitLatencyHdr()
+	// Each probe must be large enough to carry the probe header.
+	buffSize := test.clientParam.BufferSize
+	if buffSize < udpLatencyHdrLen {
+		buffSize = udpLatencyHdrLen
+	}
+	buff := make([]byte, buffSize)
+	for i := uint32(udpLatencyHdrLen); i < buffSize; i++ {
+		buff[i] = byte(i)
+	}
+	binary.BigEndian.PutUint32(buff[0:], udpLatencyMagic)
+	rbuff := make([]byte, buffSize)
+	rttCount := test.clientParam.RttCount
+	hist := newHistogram()
+	seq := uint64(0)
+ExitForLoop:
+	for {
+		select {
+		case <-test.done:
+			break ExitForLoop
+		default:
+			t0 := time.Now()
+			hist.reset()
+			sent, lost := uint32(0), uint32(0)
+			for i := uint32(0); i < rttCount; i++ {
+				// Probes that time out can take a while, so check for the end
+				// of the test between probes as well.
+				select {
+				case <-test.done:
+					break ExitForLoop
+				default:
+				}
+				seq++
+				binary.BigEndian.PutUint64(buff[4:], seq)
+				sent++
+				s1 := time.Now()
+				_, err := conn.Write(buff)
+				if err != nil {
+					ui.printDbg("Error sending data on a connection for latency test: %v", err)
+					lost++
+					continue
+				}
+				conn.SetReadDeadline(s1.Add(udpLatencyTimeout))
+				for {
+					n, err := conn.Read(rbuff)
+					if err != nil {
+						ui.printDbg("Error receiving data on a connection for latency test: %v", err)
+						lost++
+						break
+					}
+					// Ignore late replies to the probes that already timed out.
+					if n < udpLatencyHdrLen ||
+						binary.BigEndian.Uint32(rbuff[0:]) != udpLatencyMagic ||
+						binary.BigEndian.Uint64(rbuff[4:]) != seq {
+						continue
+					}
+					hist.record(time.Since(s1))
+					break
+				}
+			}
+			if sent > 0 {
+				printLatency(test, hist, lost)
+			}
+			recordLoss(uint64(sent), uint64(lost))
+			t1 := time.Since(t0)
+			if t1 < g {
+				time.Sleep(g - t1)
+			}
+		}
+	}
+}
@@ -0,0 +1,490 @@
+//-----------------------------------------------------------------------------
+// Copyright (C) Microsoft. All rights reserved.
+// Licensed under the MIT license.
+// See LICENSE.txt file in the project root for full license information.
+//-----------------------------------------------------------------------------
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+//
+// clientJSONUI prints test results as JSON objects, one per line, to stdout
+// so that they can be consumed by scripts without parsing the text output.
+// All other messages are printed to stderr. Rates are per second and all
+// durations, including latencies, are in nanoseconds.
+//
+type clientJSONUI struct {
+	title   string
+	lock    sync.Mutex
+	encoder *json.Encoder
+	conns   map[*ethrTest][]*jsonConnSummary
+	connMap map[*ethrConn]*jsonConnSummary
+	latency map[string]*jsonLatencySummary
+}
+
+type jsonConnResult struct {
+	ID               uint64
+	Direction        string
+	BitsPerSecond    uint64
+	PacketsPerSecond uint64
+	TCPInfo          *jsonTCPInfo        `json:",omitempty"`
+	Subflows         []jsonSubflowResult `json:",omitempty"`
+}
+
+//
+// jsonSubflowResult is the result of a subflow of an MPTCP connection, where
+// the OS reports it.
+//
+type jsonSubflowResult struct {
+	ID            int
+	LocalAddr     string
+	RemoteAddr    string
+	BitsPerSecond uint64
+	TCPInfo       jsonTCPInfo
+}
+
+//
+// jsonTCPInfo is the state of a TCP connection, where the OS reports it.
+// Retransmits are counted over the interval, and pacing rate is in bits/s.
+//
+type jsonTCPInfo struct {
+	Retransmits      uint64
+	RTT              time.Duration
+	RTTVar           time.Duration
+	CongestionWindow uint32
+	PacingRate       uint64
+}
+
+type jsonHopResult struct {
+	Hop   int
+	Addr  string
+	Sent  uint32
+	Rcvd  uint32
+	Last  time.Duration
+	Avg   time.Duration
+	Best  time.Duration
+	Worst time.Duration
+}
+
+type jsonTestResult struct {
+	Time                 string
+	Title                string
+	Type                 string
+	RemoteAddr           string
+	Protocol             string
+	Test                 string
+	IntervalStart        uint64
+	IntervalEnd          uint64
+	BitsPerSecond        uint64
+	TxBitsPerSecond      uint64
+	RxBitsPerSecond      uint64
+	ConnectionsPerSecond uint64
+	PacketsPerSecond     uint64
+	Connections          []jsonConnResult
+	Hops                 []jsonHopResult `json:",omitempty"`
+}
+
+type jsonLatencyResult struct {
+	Time       string
+	Title      string
+	Type       string
+	RemoteAddr string
+	Protocol   string
+	Count      uint64
+	Lost       uint32
+	Avg        time.Duration
+	Min        time.Duration
+	P50        time.Duration
+	P90        time.Duration
+	P95        time.Duration
+	P99        time.Duration
+	P999       time.Duration
+	P9999      time.Duration
+	Max        time.Duration
+}
+
+type jsonConnSummary struct {
+	ID        uint64
+	Direction string
+	Bytes     uint64
+	Packets   uint64
+}
+
+//
+// jsonLatencySummary has the latency of all samples of the test, and the
+// buckets of their histogram.
+//
+type jsonLatencySummary struct {
+	Count     uint64
+	Lost      uint64
+	Avg       time.Duration
+	Min       time.Duration
+	P50       time.Duration
+	P90       time.Duration
+	P95       time.Duration
+	P99       time.Duration
+	P999      time.Duration
+	P9999     time.Duration
+	Max       time.Duration
+	Histogram []ethrHistogramBucket
+	hist      *ethrHistogram
+}
+
+type jsonEndpointSummary struct {
+	Duration             time.Duration
+	Bytes                uint64
+	ReverseBytes         uint64
+	Packets              uint64
+	Connections          uint64
+	BitsPerSecond        uint64
+	ReverseBitsPerSecond uint64
+	ConnectionsPerSecond uint64
+	PacketsPerSecond     uint64
+	CongestionControl    string `json:",omitempty"`
+	CPUTime              time.Duration
+	CPUTimePerGbit       float64
+	OtherTests           uint32
+}
+
+type jsonDestinationSummary struct {
+	RemoteAddr        string
+	CongestionControl string `json:",omitempty"`
+	Client            *jsonEndpointSummary
+	Server            *jsonEndpointSummary
+}
+
+type jsonAggregateSummary struct {
+	Time         string
+	Title        string
+	Type         string
+	Protocol     string
+	Test         string
+	Destinations []jsonDestinationSummary
+	Client       *jsonEndpointSummary
+	Server       *jsonEndpointSummary
+}
+
+type jsonTestSummary struct {
+	Time        string
+	Title       string
+	Type        string
+	RemoteAddr  string
+	Protocol    string
+	Test        string
+	Client      *jsonEndpointSummary
+	Server      *jsonEndpointSummary
+	Connections []*jsonConnSummary
+	Latency     *jsonLatencySummary
+}
+
+func newClientJSONUI(title string) *clientJSONUI {
+	u := &clientJSONUI{title: title}
+	u.encoder = json.NewEncoder(os.Stdout)
+	u.conns = make(map[*ethrTest][]*jsonConnSummary)
+	u.connMap = make(map[*ethrConn]*jsonConnSummary)
+	u.latency = make(map[string]*jsonLatencySummary)
+	return u
+}
+
+func (u *clientJSONUI) fini() {
+}
+
+func (u *clientJSONUI) getTitle() string {
+	return u.title
+}
+
+func (u *clientJSONUI) printMsg(format string, a ...interface{}) {
+	s := fmt.Sprintf(format, a...)
+	logInfo(s)
+	fmt.Fprintln(os.Stderr, s)
+}
+
+func (u *clientJSONUI) printErr(format string, a ...interface{}) {
+	s := fmt.Sprintf(format, a...)
+	logError(s)
+	fmt.Fprintln(os.Stderr, s)
+}
+
+func (u *clientJSONUI) printDbg(format string, a ...interface{}) {
+	if loggingLevel == LogLevelDebug {
+		s := fmt.Sprintf(format, a...)
+		logDebug(s)
+		fmt.Fprintln(os.Stderr, s)
+	}
+}
+
+func (u *clientJSONUI) paint(seconds uint64) {
+}
+
+func (u *clientJSONUI) emitTestResultBegin() {
+	beginIntervalResults()
+}
+
+func (u *clientJSONUI) emitTestHdr() {
+}
+
+func (u *clientJSONUI) emitLatencyHdr() {
+}
+
+func (u *clientJSONUI) emitLatencyResults(remote, proto string, h *ethrHistogram, lost uint32) {
+	logLatency(remote, proto, h, lost)
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	l := u.latency[remote]
+	if l == nil {
+		l = &jsonLatencySummary{hist: newHistogram()}
+		u.latency[remote] = l
+	}
+	l.hist.merge(h)
+	l.Count = l.hist.count
+	l.Lost += uint64(lost)
+	l.Avg = l.hist.avg()
+	l.Min = l.hist.min
+	l.P50 = l.hist.percentile(50)
+	l.P90 = l.hist.percentile(90)
+	l.P95 = l.hist.percentile(95)
+	l.P99 = l.hist.percentile(99)
+	l.P999 = l.hist.percentile(99.9)
+	l.P9999 = l.hist.percentile(99.99)
+	l.Max = l.hist.max
+	l.Histogram = l.hist.buckets()
+	u.emit(&jsonLatencyResult{
+		Time:       time.Now().UTC().Format(time.RFC3339),
+		Title:      u.title,
+		Type:       "LatencyResult",
+		RemoteAddr: remote,
+		Protocol:   proto,
+		Count:      h.count,
+		Lost:       lost,
+		Avg:        h.avg(),
+		Min:        h.min,
+		P50:        h.percentile(50),
+		P90:        h.percentile(90),
+		P95:        h.percentile(95),
+		P99:        h.percentile(99),
+		P999:       h.percentile(99.9),
+		P9999:      h.percentile(99.99),
+		Max:        h.max,
+	})
+}
+
+//
+// When tests are run against multiple destinations at the same time, results
+// of all destinations for an interval are followed by their sum, which has
+// the type AggregateResult.
+//
+func (u *clientJSONUI) emitTestResultEnd() {
+	agg := collectAggregateResult()
+	if agg == nil {
+		return
+	}
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	u.emit(&jsonTestResult{
+		Time:                 time.Now().UTC().Format(time.RFC3339),
+		Title:                u.title,
+		Type:                 "AggregateResult",
+		Protocol:             protoToString(agg.testID.Protocol),
+		Test:                 testToString(agg.testID.Type),
+		IntervalStart:        gInterval,
+		IntervalEnd:          gInterval + 1,
+		BitsPerSecond:        agg.bw * 8,
+		TxBitsPerSecond:      agg.txBw * 8,
+		RxBitsPerSecond:      agg.rxBw * 8,
+		ConnectionsPerSecond: agg.cps,
+		PacketsPerSecond:     agg.pps,
+		Connections:          []jsonConnResult{},
+	})
+	gInterval++
+}
+
+func (u *clientJSONUI) emitStats(netStats ethrNetStat) {
+}
+
+func (u *clientJSONUI) printTestResults(s []string) {
+}
+
+func (u *clientJSONUI) emitTestResult(s *ethrSession, proto EthrProtocol, seconds uint64) {
+	// TraceRoute prints each hop as it is discovered, it has no per interval results.
+	var testList = []EthrTestType{Bandwidth, Cps, Pps, MyTraceRoute}
+
+	for _, testType := range testList {
+		test, found := s.tests[EthrTestID{proto, testType}]
+		if found && test.isActive {
+			u.emitIntervalResult(test, seconds)
+		}
+	}
+}
+
+func (u *clientJSONUI) emitIntervalResult(test *ethrTest, seconds uint64) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	r := &jsonTestResult{
+		Time:          time.Now().UTC().Format(time.RFC3339),
+		Title:         u.title,
+		Type:          "TestResult",
+		RemoteAddr:    test.session.remoteIP,
+		Protocol:      protoToString(test.testID.Protocol),
+		Test:          testToString(test.testID.Type),
+		IntervalStart: gInterval,
+		IntervalEnd:   gInterval + 1,
+		Connections:   []jsonConnResult{},
+	}
+	if test.testID.Type == MyTraceRoute {
+		r.Hops = []jsonHopResult{}
+		for i := 0; i < gCurHops; i++ {
+			hopData := gHop[i]
+			h := jsonHopResult{Hop: i + 1, Addr: hopData.addr, Sent: hopData.sent, Rcvd: hopData.rcvd}
+			if hopData.rcvd > 0 && hopData.hist != nil {
+				h.Last = hopData.last
+				h.Avg = hopData.hist.avg()
+				h.Best = hopData.hist.min
+				h.Worst = hopData.hist.max
+			}
+			r.Hops = append(r.Hops, h)
+		}
+		u.emit(r)
+		gInterval++
+		return
+	}
+	ir := collectIntervalResult(test, seconds)
+	for _, c := range ir.conns {
+		dir := "TX"
+		if c.ec.reverse {
+			dir = "RX"
+		}
+		cs, found := u.connMap[c.ec]
+		if !found {
+			cs = &jsonConnSummary{ID: uint64(c.ec.fd), Direction: dir}
+			u.connMap[c.ec] = cs
+			u.conns[test] = append(u.conns[test], cs)
+		}
+		cs.Bytes += c.bytes
+		cs.Packets += c.packets
+		jc := jsonConnResult{
+			ID:               uint64(c.ec.fd),
+			Direction:        dir,
+			BitsPerSecond:    c.bw * 8,
+			PacketsPerSecond: c.pps,
+		}
+		if c.tcpInfoOK {
+			jc.TCPInfo = newJSONTCPInfo(c.tcpInfo, c.retrans)
+		}
+		for _, sf := range c.subflows {
+			jc.Subflows = append(jc.Subflows, jsonSubflowResult{
+				ID:            sf.id,
+				LocalAddr:     sf.localAddr,
+				RemoteAddr:    sf.remoteAddr,
+				BitsPerSecond: sf.bytes * 8 / seconds,
+				TCPInfo:       *newJSONTCPInfo(sf.ti, sf.retrans),
+			})
+		}
+		r.Connections = append(r.Connections, jc)
+	}
+	r.BitsPerSecond = ir.bw * 8
+	r.TxBitsPerSecond = ir.txBw * 8
+	r.RxBitsPerSecond = ir.rxBw * 8
+	r.ConnectionsPerSecond = ir.cps
+	r.PacketsPerSecond = ir.pps
+	u.emit(r)
+	if !gConcurrentTests {
+		gInterval++
+	}
+}
+
+func newJSONTCPInfo(ti ethrTCPInfo, retrans uint64) *jsonTCPInfo {
+	return &jsonTCPInfo{
+		Retransmits:      retrans,
+		RTT:              ti.rtt,
+		RTTVar:           ti.rttVar,
+		CongestionWindow: ti.cwnd,
+		PacingRate:       ti.pacingRate * 8,
+	}
+}
+
+func (u *clientJSONUI) emitTestSummary(test *ethrTest, clientFin, serverFin *EthrMsgFin) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	conns := u.conns[test]
+	if conns == nil {
+		conns = []*jsonConnSummary{}
+	}
+	u.emit(&jsonTestSummary{
+		Time:        time.Now().UTC().Format(time.RFC3339),
+		Title:       u.title,
+		Type:        "TestSummary",
+		RemoteAddr:  test.session.remoteIP,
+		Protocol:    protoToString(test.testID.Protocol),
+		Test:        testToString(test.testID.Type),
+		Client:      newJSONEndpointSummary(clientFin),
+		Server:      newJSONEndpointSummary(serverFin),
+		Connections: conns,
+		Latency:     u.latency[test.session.remoteIP],
+	})
+}
+
+func (u *clientJSONUI) emitAggregateSummary(tests []*ethrTest, clientFins, serverFins []*EthrMsgFin) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	s := &jsonAggregateSummary{
+		Time:         time.Now().UTC().Format(time.RFC3339),
+		Title:        u.title,
+		Type:         "AggregateSummary",
+		Protocol:     protoToString(tests[0].testID.Protocol),
+		Test:         testToString(tests[0].testID.Type),
+		Destinations: []jsonDestinationSummary{},
+	}
+	// Results of different congestion control algorithms are compared, these
+	// don't add up.
+	if !gCompareCongestionControl {
+		s.Client = newJSONEndpointSummary(sumTestFins(clientFins))
+		s.Server = newJSONEndpointSummary(sumTestFins(serverFins))
+	}
+	for i, test := range tests {
+		s.Destinations = append(s.Destinations, jsonDestinationSummary{
+			RemoteAddr:        test.session.remoteIP,
+			CongestionControl: test.clientParam.CongestionControl,
+			Client:            newJSONEndpointSummary(clientFins[i]),
+			Server:            newJSONEndpointSummary(serverFins[i]),
+		})
+	}
+	u.emit(s)
+}
+
+func (u *clientJSONUI) emit(v interface{}) {
+	err := u.encoder.Encode(v)
+	if err != nil {
+		logError(fmt.Sprintf("Failed to write JSON output. Error: %v", err))
+	}
+}
+
+func newJSONEndpointSummary(fin *EthrMsgFin) *jsonEndpointSummary {
+	if fin == nil {
+		return nil
+	}
+	s := &jsonEndpointSummary{
+		Duration:          fin.Elapsed,
+		Bytes:             fin.Bytes,
+		ReverseBytes:      fin.ReverseBytes,
+		Packets:           fin.Packets,
+		Connections:       fin.Connections,
+		CongestionControl: fin.CongestionControl,
+		CPUTime:           fin.CPUTime,
+		CPUTimePerGbit:    cpuTimePerGbit(fin),
+		OtherTests:        fin.OtherTests,
+	}
+	if fin.Elapsed > 0 {
+		seconds := fin.Elapsed.Seconds()
+		s.BitsPerSecond = uint64(float64(fin.Bytes*8) / seconds)
+		s.ReverseBitsPerSecond = uint64(float64(fin.ReverseBytes*8) / seconds)
+		s.ConnectionsPerSecond = uint64(float64(fin.Connections) / seconds)
+		s.PacketsPerSecond = uint64(float64(fin.Packets) / seconds)
+	}
+	return s
+}
@@ -7,12 +7,27 @@ package main
 
 import (
 	"fmt"
+	"runtime"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 )
 
 type clientUI struct {
-	title string
+	title   string
+	lock    sync.Mutex
+	latency map[string]*ethrLatencySummary
+}
+
+//
+// ethrLatencySummary merges the latency rows shown for a destination, so that
+// a test that shows more than one row also shows the latency of all samples.
+//
+type ethrLatencySummary struct {
+	hist *ethrHistogram
+	lost uint64
+	rows int
 }
 
 func (u *clientUI) fini() {
@@ -46,6 +61,7 @@ func (u *clientUI) paint(seconds uint64) {
 }
 
 func (u *clientUI) emitTestResultBegin() {
+	beginIntervalResults()
 }
 
 func (u *clientUI) emitTestHdr() {
@@ -55,22 +71,60 @@ func (u *clientUI) emitTestHdr() {
 }
 
 func (u *clientUI) emitLatencyHdr() {
-	s := []string{"Avg", "Min", "50%", "90%", "95%", "99%", "99.9%", "99.99%", "Max"}
-	fmt.Println("-----------------------------------------------------------------------------------------")
-	fmt.Printf("%9s %9s %9s %9s %9s %9s %9s %9s %9s\n", s[0], s[1], s[2], s[3], s[4], s[5], s[6], s[7], s[8])
+	s := []string{"Avg", "Min", "50%", "90%", "95%", "99%", "99.9%", "99.99%", "Max", "Lost"}
+	fmt.Println("----------------------------------------------------------------------------------------------------")
+	fmt.Printf("%9s %9s %9s %9s %9s %9s %9s %9s %9s %9s\n", s[0], s[1], s[2], s[3], s[4], s[5], s[6], s[7], s[8], s[9])
+}
+
+func (u *clientUI) emitLatencyResults(remote, proto string, h *ethrHistogram, lost uint32) {
+	logLatency(remote, proto, h, lost)
+	printLatencyRow(h, uint64(lost))
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	l := u.latency[remote]
+	if l == nil {
+		l = &ethrLatencySummary{hist: newHistogram()}
+		u.latency[remote] = l
+	}
+	l.hist.merge(h)
+	l.lost += uint64(lost)
+	l.rows++
+}
+
+func printLatencyRow(h *ethrHistogram, lost uint64) {
+	// When all probes of the interval are lost, there is no latency to show.
+	d := func(v time.Duration) string {
+		return runValueToString(h.count > 0, durationToString(v))
+	}
+	fmt.Printf("%9s %9s %9s %9s %9s %9s %9s %9s %9s %9d\n",
+		d(h.avg()), d(h.min), d(h.percentile(50)), d(h.percentile(90)),
+		d(h.percentile(95)), d(h.percentile(99)), d(h.percentile(99.9)),
+		d(h.percentile(99.99)), d(h.max), lost)
 }
 
-func (u *clientUI) emitLatencyResults(remote, proto string, avg, min, max, p50, p90, p95, p99, p999, p9999 time.Duration) {
-	logLatency(remote, proto, avg, min, max, p50, p90, p95, p99, p999, p9999)
-	fmt.Printf("%9s %9s %9s %9s %9s %9s %9s %9s %9s\n",
-		durationToString(avg), durationToString(min),
-		durationToString(p50), durationToString(p90),
-		durationToString(p95), durationToString(p99),
-		durationToString(p999), durationToString(p9999),
-		durationToString(max))
+//
+// printLatencySummary shows the latency of all samples of the test against
+// the destination, if the test showed more than one row, and forgets them,
+// so that the next test against it starts anew.
+//
+func (u *clientUI) printLatencySummary(remote string) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	l := u.latency[remote]
+	delete(u.latency, remote)
+	if l == nil || l.rows < 2 {
+		return
+	}
+	fmt.Println("- - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - -")
+	fmt.Printf("Latency of all %d samples from %s:\n", l.hist.count, remote)
+	printLatencyRow(l.hist, l.lost)
 }
 
 func (u *clientUI) emitTestResultEnd() {
+	if agg := collectAggregateResult(); agg != nil {
+		printDestinationRow("SUM", agg.testID, agg.bw, agg.cps, agg.pps)
+		gInterval++
+	}
 }
 
 func (u *clientUI) emitStats(netStats ethrNetStat) {
@@ -79,25 +133,216 @@ func (u *clientUI) emitStats(netStats ethrNetStat) {
 func (u *clientUI) printTestResults(s []string) {
 }
 
+func (u *clientUI) emitTestSummary(test *ethrTest, clientFin, serverFin *EthrMsgFin) {
+	u.printLatencySummary(test.session.remoteIP)
+	if !gIsExternalClient && isResultExchangeSupported(test.testID) {
+		printTestSummary(test, clientFin, serverFin)
+	}
+}
+
+func (u *clientUI) emitAggregateSummary(tests []*ethrTest, clientFins, serverFins []*EthrMsgFin) {
+	// Tests that run at the same time have no summary of their own.
+	if gConcurrentTests {
+		for _, test := range tests {
+			u.printLatencySummary(test.session.remoteIP)
+		}
+	}
+	if !gIsExternalClient && isResultExchangeSupported(tests[0].testID) {
+		printAggregateSummary(tests, clientFins, serverFins)
+	}
+}
+
 func initClientUI(title string) {
-	cli := &clientUI{title}
+	if gJSONOutput {
+		ui = newClientJSONUI(title)
+		return
+	}
+	cli := &clientUI{title: title, latency: make(map[string]*ethrLatencySummary)}
 	ui = cli
 }
 
 var gInterval uint64
 var gNoConnectionStats bool
+var gJSONOutput bool
+
+//
+// ethrDestAggregate sums the results of all destinations for an interval.
+//
+type ethrDestAggregate struct {
+	ethrTestResultAggregate
+	txBw     uint64
+	rxBw     uint64
+	count    int
+	testID   EthrTestID
+	interval uint64
+}
+
+var gDestAggregate ethrDestAggregate
+
+//
+// ethrConnResult is the result of a connection of a test for an interval.
+// Bytes and packets are those of the interval, and bandwidth is in bytes/s.
+// The state of TCP connections is read where the OS reports it.
+//
+type ethrConnResult struct {
+	ec        *ethrConn
+	bytes     uint64
+	packets   uint64
+	bw        uint64
+	pps       uint64
+	tcpInfo   ethrTCPInfo
+	retrans   uint64
+	tcpInfoOK bool
+	subflows  []ethrSubflow
+}
+
+//
+// ethrIntervalResult is the result of a test for an interval, i.e. of each
+// of its connections and their sum, which both the text and the JSON UI show.
+//
+type ethrIntervalResult struct {
+	test  *ethrTest
+	conns []ethrConnResult
+	bw    uint64
+	txBw  uint64
+	rxBw  uint64
+	cps   uint64
+	pps   uint64
+}
+
+func beginIntervalResults() {
+	gDestAggregate = ethrDestAggregate{}
+}
+
+//
+// collectIntervalResult takes the results of a test for the interval, and
+// records them in the log and the CSV file. The results are also added to the
+// sum of the interval.
+//
+func collectIntervalResult(test *ethrTest, seconds uint64) *ethrIntervalResult {
+	r := &ethrIntervalResult{test: test}
+	remote, proto := test.session.remoteIP, protoToString(test.testID.Protocol)
+	switch test.testID.Type {
+	case Bandwidth, Pps:
+		test.connListDo(func(ec *ethrConn) {
+			c := ethrConnResult{ec: ec}
+			c.bytes = atomic.SwapUint64(&ec.bw, 0)
+			c.packets = atomic.SwapUint64(&ec.pps, 0)
+			c.bw, c.pps = c.bytes/seconds, c.packets/seconds
+			csvAddClientConnResult(test, ec, c.bw, c.pps)
+			if test.testID.Protocol == TCP {
+				c.tcpInfo, c.retrans, c.tcpInfoOK = ec.getTCPInfo()
+				if c.tcpInfoOK {
+					logConnResults(remote, proto, ec.fd, c.bw, c.tcpInfo, c.retrans)
+				}
+				if gMPTCP {
+					c.subflows, _ = ec.getSubflows()
+				}
+			}
+			r.conns = append(r.conns, c)
+			r.bw += c.bw
+			r.pps += c.pps
+			if ec.reverse {
+				r.rxBw += c.bw
+			} else {
+				r.txBw += c.bw
+			}
+		})
+		logResults([]string{remote, proto, bytesToRate(r.bw), "", ppsToString(r.pps), ""})
+	case Cps:
+		r.cps = atomic.SwapUint64(&test.testResult.cps, 0) / seconds
+		logResults([]string{remote, proto, "", cpsToString(r.cps), "", ""})
+	default:
+		return r
+	}
+	csvAddClientResult(newCSVResult(csvTestResult, test), test.testID, r.bw, r.cps, r.pps)
+	agg := &gDestAggregate
+	agg.count++
+	agg.testID = test.testID
+	agg.interval = gInterval
+	agg.bw += r.bw
+	agg.txBw += r.txBw
+	agg.rxBw += r.rxBw
+	agg.cps += r.cps
+	agg.pps += r.pps
+	return r
+}
+
+//
+// collectAggregateResult records the sum of the results of all destinations
+// for the interval in the log, and returns it, or nil if tests aren't run
+// against multiple destinations at the same time, and records it in the CSV
+// file.
+//
+func collectAggregateResult() *ethrDestAggregate {
+	agg := &gDestAggregate
+	if agg.count == 0 {
+		return nil
+	}
+	logRunResults(agg.testID, agg.interval, agg.bw, agg.cps, agg.pps)
+	if !gConcurrentTests {
+		return nil
+	}
+	csvAddClientResult(newCSVAggregateResult(agg.testID), agg.testID, agg.bw, agg.cps, agg.pps)
+	return agg
+}
+
+//
+// HTTP runs over TCP, and QUIC runs streams much like TCP connections, so
+// results of HTTP and QUIC tests are printed the same as TCP.
+//
+func isStreamProtocol(p EthrProtocol) bool {
+	return p == TCP || p == HTTP || p == HTTPS || p == QUIC
+}
+
+func isHTTPProtocol(p EthrProtocol) bool {
+	return p == HTTP || p == HTTPS
+}
 
 func printBwTestDivider(p EthrProtocol) {
-	if p == TCP {
+	if isStreamProtocol(p) {
 		ui.printMsg("- - - - - - - - - - - - - - - - - - - - - - -")
 	} else if p == UDP {
 		ui.printMsg("- - - - - - - - - - - - - - - - - - - - - - - - - - - -")
 	}
 }
 
-func printBwTestHeader(p EthrProtocol) {
-	if p == TCP {
-		ui.printMsg("[  ID ]   Protocol    Interval      Bits/s")
+//
+// State of each TCP connection is shown next to its bandwidth, where the OS
+// reports it.
+//
+func showTCPInfo(p EthrProtocol) bool {
+	return p == TCP && runtime.GOOS == "linux" && !gNoConnectionStats
+}
+
+func tcpInfoToString(ti ethrTCPInfo, retrans uint64) string {
+	return fmt.Sprintf("   %5d  %9s  %9s  %6d  %8s", retrans, durationToString(ti.rtt),
+		durationToString(ti.rttVar), ti.cwnd, bytesToRate(ti.pacingRate))
+}
+
+//
+// printSubflowResults shows each subflow of an MPTCP connection under the
+// connection, as <connection ID>.<subflow ID>, with its addresses after the
+// state of the subflow.
+//
+func printSubflowResults(c ethrConnResult, seconds uint64, dir string) {
+	ec := c.ec
+	for _, sf := range c.subflows {
+		fd := fmt.Sprintf("%d.%d", ec.fd, sf.id)
+		tcpInfo := fmt.Sprintf("%s   %s -> %s", tcpInfoToString(sf.ti, sf.retrans), sf.localAddr, sf.remoteAddr)
+		printBwTestResult(TCP, fd, gInterval, gInterval+1, sf.bytes/seconds, 0, dir, tcpInfo)
+	}
+}
+
+func printBwTestHeader(p EthrProtocol, bidir bool) {
+	tcpInfoHdr := ""
+	if showTCPInfo(p) {
+		tcpInfoHdr = "    Retr        RTT     RTTVar    Cwnd    Pacing"
+	}
+	if isStreamProtocol(p) && bidir {
+		ui.printMsg("[  ID ]   Protocol    Interval      Bits/s   Dir" + tcpInfoHdr)
+	} else if isStreamProtocol(p) {
+		ui.printMsg("[  ID ]   Protocol    Interval      Bits/s" + tcpInfoHdr)
 	} else if p == UDP {
 		// Printing packets only makes sense for UDP as it is a datagram protocol.
 		// For TCP, TCP itself decides how to chunk the stream to send as packets.
@@ -105,69 +350,87 @@ func printBwTestHeader(p EthrProtocol) {
 	}
 }
 
-func printBwTestResult(p EthrProtocol, fd string, t0, t1, bw, pps uint64) {
-	if p == TCP {
-		ui.printMsg("[%5s]     %-5s    %03d-%03d sec   %7s", fd,
-			protoToString(p), t0, t1, bytesToRate(bw))
+func printBwTestResult(p EthrProtocol, fd string, t0, t1, bw, pps uint64, dir, tcpInfo string) {
+	if isStreamProtocol(p) && dir != "" {
+		if tcpInfo != "" {
+			dir = fmt.Sprintf("%-3s", dir)
+		}
+		ui.printMsg("[%5s]     %-5s    %03d-%03d sec   %7s   %s%s", fd,
+			protoToString(p), t0, t1, bytesToRate(bw), dir, tcpInfo)
+	} else if isStreamProtocol(p) {
+		ui.printMsg("[%5s]     %-5s    %03d-%03d sec   %7s%s", fd,
+			protoToString(p), t0, t1, bytesToRate(bw), tcpInfo)
 	} else if p == UDP {
 		ui.printMsg("[%5s]     %-5s    %03d-%03d sec   %7s   %7s", fd,
 			protoToString(p), t0, t1, bytesToRate(bw), ppsToString(pps))
 	}
 }
 
+func connDirection(ec *ethrConn, bidir bool) string {
+	if !bidir {
+		return ""
+	}
+	if ec.reverse {
+		return "RX"
+	}
+	return "TX"
+}
+
 func printTestResult(test *ethrTest, seconds uint64) {
-	if test.testID.Type == Bandwidth &&
-		(test.testID.Protocol == TCP || test.testID.Protocol == UDP) {
+	if gConcurrentTests {
+		printDestinationResult(test, seconds)
+		return
+	}
+	// Packets/s tests show the packets/s of each thread the same as UDP
+	// Bandwidth tests.
+	if (test.testID.Type == Bandwidth || test.testID.Type == Pps) &&
+		(isStreamProtocol(test.testID.Protocol) || test.testID.Protocol == UDP) {
+		bidir := test.clientParam.Bidirectional
 		if gInterval == 0 {
 			printBwTestDivider(test.testID.Protocol)
-			printBwTestHeader(test.testID.Protocol)
+			printBwTestHeader(test.testID.Protocol, bidir)
 		}
-		cbw := uint64(0)
-		cpps := uint64(0)
-		ccount := 0
-		test.connListDo(func(ec *ethrConn) {
-			bw := atomic.SwapUint64(&ec.bw, 0)
-			pps := atomic.SwapUint64(&ec.pps, 0)
-			bw /= seconds
+		r := collectIntervalResult(test, seconds)
+		for _, c := range r.conns {
+			if gNoConnectionStats {
+				break
+			}
+			fd := fmt.Sprintf("%5d", c.ec.fd)
+			tcpInfo := ""
+			if showTCPInfo(test.testID.Protocol) && c.tcpInfoOK {
+				tcpInfo = tcpInfoToString(c.tcpInfo, c.retrans)
+			}
+			dir := connDirection(c.ec, bidir)
+			printBwTestResult(test.testID.Protocol, fd, gInterval, gInterval+1, c.bw, c.pps, dir, tcpInfo)
+			if showTCPInfo(test.testID.Protocol) {
+				printSubflowResults(c, seconds, dir)
+			}
+		}
+		if bidir {
+			printBwTestResult(test.testID.Protocol, "SUM", gInterval, gInterval+1, r.txBw, 0, "TX", "")
+			printBwTestResult(test.testID.Protocol, "SUM", gInterval, gInterval+1, r.rxBw, 0, "RX", "")
 			if !gNoConnectionStats {
-				fd := fmt.Sprintf("%5d", ec.fd)
-				printBwTestResult(test.testID.Protocol, fd, gInterval, gInterval+1, bw, pps)
+				printBwTestDivider(test.testID.Protocol)
 			}
-			cbw += bw
-			cpps += pps
-			ccount++
-		})
-		if ccount > 1 || gNoConnectionStats {
-			printBwTestResult(test.testID.Protocol, "SUM", gInterval, gInterval+1, cbw, cpps)
+		} else if len(r.conns) > 1 || gNoConnectionStats {
+			printBwTestResult(test.testID.Protocol, "SUM", gInterval, gInterval+1, r.bw, r.pps, "", "")
 			if !gNoConnectionStats {
 				printBwTestDivider(test.testID.Protocol)
 			}
 		}
-		logResults([]string{test.session.remoteIP, protoToString(test.testID.Protocol),
-			bytesToRate(cbw), "", ppsToString(cpps), ""})
 	} else if test.testID.Type == Cps {
 		if gInterval == 0 {
 			ui.printMsg("- - - - - - - - - - - - - - - - - - ")
-			ui.printMsg("Protocol    Interval      Conn/s")
+			if isHTTPProtocol(test.testID.Protocol) {
+				ui.printMsg("Protocol    Interval       Req/s")
+			} else {
+				ui.printMsg("Protocol    Interval      Conn/s")
+			}
 		}
-		cps := atomic.SwapUint64(&test.testResult.cps, 0)
+		r := collectIntervalResult(test, seconds)
 		ui.printMsg("  %-5s    %03d-%03d sec   %7s",
 			protoToString(test.testID.Protocol),
-			gInterval, gInterval+1, cpsToString(cps))
-		logResults([]string{test.session.remoteIP, protoToString(test.testID.Protocol),
-			"", cpsToString(cps), "", ""})
-	} else if test.testID.Type == Pps {
-		if gInterval == 0 {
-			ui.printMsg("- - - - - - - - - - - - - - - - - - - - - - -")
-			ui.printMsg("Protocol    Interval      Bits/s    Pkts/s")
-		}
-		bw := atomic.SwapUint64(&test.testResult.bw, 0)
-		pps := atomic.SwapUint64(&test.testResult.pps, 0)
-		ui.printMsg("  %-5s    %03d-%03d sec   %7s   %7s",
-			protoToString(test.testID.Protocol),
-			gInterval, gInterval+1, bytesToRate(bw), ppsToString(pps))
-		logResults([]string{test.session.remoteIP, protoToString(test.testID.Protocol),
-			bytesToRate(bw), "", ppsToString(pps), ""})
+			gInterval, gInterval+1, cpsToString(r.cps))
 	} else if test.testID.Type == MyTraceRoute {
 		if gCurHops > 0 {
 			ui.printMsg("- - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - ")
@@ -177,12 +440,12 @@ func printTestResult(test *ethrTest, seconds uint64) {
 			hopData := gHop[i]
 			if hopData.addr != "" {
 				if hopData.sent > 0 {
-					avg := time.Duration(0)
-					if hopData.rcvd > 0 {
-						avg = time.Duration(hopData.total.Nanoseconds() / int64(hopData.rcvd))
+					var avg, best, worst time.Duration
+					if hopData.hist != nil {
+						avg, best, worst = hopData.hist.avg(), hopData.hist.min, hopData.hist.max
 					}
 					ui.printMsg("%2d.|--%-40s   %5d   %5d   %9s   %9s   %9s   %9s", i+1, hopData.addr, hopData.sent, hopData.rcvd,
-						durationToString(hopData.last), durationToString(avg), durationToString(hopData.best), durationToString(hopData.worst))
+						durationToString(hopData.last), durationToString(avg), durationToString(best), durationToString(worst))
 				}
 			} else {
 				ui.printMsg("%2d.|--%-40s   %5s   %5s   %9s   %9s   %9s   %9s", i+1, "???", "-", "-", "-", "-", "-", "-")
@@ -192,6 +455,43 @@ func printTestResult(test *ethrTest, seconds uint64) {
 	gInterval++
 }
 
+func printDestinationHeader() {
+	ui.printMsg("- - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - -")
+	ui.printMsg("[ServerAddress]  Proto    Interval      Bits/s    Conn/s    Pkts/s")
+}
+
+func printDestinationRow(dest string, testID EthrTestID, bw, cps, pps uint64) {
+	bwStr, cpsStr, ppsStr := "--  ", "--  ", "--  "
+	if testID.Type == Cps {
+		cpsStr = cpsToString(cps)
+	} else {
+		bwStr = bytesToRate(bw)
+	}
+	if testID.Protocol == UDP {
+		ppsStr = ppsToString(pps)
+	}
+	ui.printMsg("[%13s]  %5s  %03d-%03d sec   %7s   %7s   %7s", truncateStringFromStart(dest, 13),
+		protoToString(testID.Protocol), gInterval, gInterval+1, bwStr, cpsStr, ppsStr)
+}
+
+//
+// printDestinationResult prints the results of a test for an interval as a
+// single row, when tests are run against multiple destinations at the same
+// time. The results are also added to the [SUM] row of the interval.
+//
+func printDestinationResult(test *ethrTest, seconds uint64) {
+	switch test.testID.Type {
+	case Bandwidth, Cps, Pps:
+	default:
+		return
+	}
+	if gInterval == 0 && gDestAggregate.count == 0 {
+		printDestinationHeader()
+	}
+	r := collectIntervalResult(test, seconds)
+	printDestinationRow(test.session.remoteIP, test.testID, r.bw, r.cps, r.pps)
+}
+
 func (u *clientUI) emitTestResult(s *ethrSession, proto EthrProtocol, seconds uint64) {
 	var testList = []EthrTestType{Bandwidth, Cps, Pps, TraceRoute, MyTraceRoute}
 
@@ -202,3 +502,180 @@ func (u *clientUI) emitTestResult(s *ethrSession, proto EthrProtocol, seconds ui
 		}
 	}
 }
+
+func printTestSummaryHeader(p EthrProtocol, prefix string) {
+	ui.printMsg("- - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - -")
+	if isHTTPProtocol(p) {
+		ui.printMsg(prefix + "Protocol    Interval       Transfer    Bits/s   Packets  Requests")
+	} else {
+		ui.printMsg(prefix + "Protocol    Interval       Transfer    Bits/s   Packets     Conns")
+	}
+}
+
+func printTestSummaryRows(prefix string, p EthrProtocol, clientParam EthrClientParam, clientFin, serverFin *EthrMsgFin) {
+	if clientParam.Bidirectional {
+		printTestSummaryResult(prefix, p, clientFin, false, "TX sender")
+		printTestSummaryResult(prefix, p, serverFin, false, "TX receiver")
+		printTestSummaryResult(prefix, p, serverFin, true, "RX sender")
+		printTestSummaryResult(prefix, p, clientFin, true, "RX receiver")
+	} else if clientParam.Reverse {
+		printTestSummaryResult(prefix, p, serverFin, true, "sender")
+		printTestSummaryResult(prefix, p, clientFin, true, "receiver")
+	} else {
+		printTestSummaryResult(prefix, p, clientFin, false, "sender")
+		printTestSummaryResult(prefix, p, serverFin, false, "receiver")
+	}
+}
+
+func printTestSummary(test *ethrTest, clientFin, serverFin *EthrMsgFin) {
+	p := test.testID.Protocol
+	printTestSummaryHeader(p, "")
+	printTestSummaryRows("", p, test.clientParam, clientFin, serverFin)
+	if serverFin != nil && p == UDP && clientFin.Packets > 0 {
+		lost := uint64(0)
+		if clientFin.Packets > serverFin.Packets {
+			lost = clientFin.Packets - serverFin.Packets
+		}
+		ui.printMsg("Lost packets: %d/%d (%.2f%%)", lost, clientFin.Packets,
+			float64(lost)*100/float64(clientFin.Packets))
+	}
+	if cc := congestionControlToString(clientFin, serverFin); cc != "" {
+		ui.printMsg("Congestion control: %s", cc)
+	}
+	if cpu := cpuTimeToString(clientFin, serverFin); cpu != "" {
+		ui.printMsg("CPU time: %s", cpu)
+	}
+	if serverFin == nil {
+		ui.printMsg("Results from the Ethr server are not available.")
+	}
+}
+
+//
+// congestionControlToString returns the congestion control algorithms that the
+// client and the server sent data with, e.g. "client cubic, server bbr".
+//
+func congestionControlToString(clientFin, serverFin *EthrMsgFin) string {
+	ccs := []string{}
+	if clientFin != nil && clientFin.CongestionControl != "" {
+		ccs = append(ccs, "client "+clientFin.CongestionControl)
+	}
+	if serverFin != nil && serverFin.CongestionControl != "" {
+		ccs = append(ccs, "server "+serverFin.CongestionControl)
+	}
+	return strings.Join(ccs, ", ")
+}
+
+//
+// cpuTimeToString returns the CPU time that the client and the server used,
+// and the CPU time per Gbit of data that each sent and received, e.g.
+// "client 1.20s (0.050s/Gbit), server 0.80s (0.033s/Gbit)". CPU time is only
+// measured for the whole process, so if other tests ran on a side during the
+// test, its CPU time is qualified instead, e.g. "server 0.80s (process-wide,
+// 3 concurrent tests)".
+//
+func cpuTimeToString(clientFin, serverFin *EthrMsgFin) string {
+	s := []string{}
+	for i, fin := range []*EthrMsgFin{clientFin, serverFin} {
+		if fin == nil || fin.CPUTime <= 0 {
+			continue
+		}
+		side := "client "
+		if i > 0 {
+			side = "server "
+		}
+		cpu := fmt.Sprintf("%.2fs", fin.CPUTime.Seconds())
+		if fin.OtherTests > 0 {
+			cpu += fmt.Sprintf(" (process-wide, %d concurrent tests)", fin.OtherTests+1)
+		} else if perGbit := cpuTimePerGbit(fin); perGbit > 0 {
+			cpu += fmt.Sprintf(" (%.3fs/Gbit)", perGbit)
+		}
+		s = append(s, side+cpu)
+	}
+	return strings.Join(s, ", ")
+}
+
+//
+// cpuTimePerGbit returns the CPU time in seconds that a side used for each
+// Gbit of data that it sent and received, or 0 if it didn't transfer data, or
+// if other tests ran on the side, as their CPU time is included.
+//
+func cpuTimePerGbit(fin *EthrMsgFin) float64 {
+	bytes := fin.Bytes + fin.ReverseBytes
+	if bytes == 0 || fin.OtherTests > 0 {
+		return 0
+	}
+	return fin.CPUTime.Seconds() / (float64(bytes*8) / GIGA)
+}
+
+//
+// printAggregateSummary prints the summary of tests against multiple
+// destinations, with rows for each destination followed by [SUM] rows.
+//
+func printAggregateSummary(tests []*ethrTest, clientFins, serverFins []*EthrMsgFin) {
+	p := tests[0].testID.Protocol
+	clientParam := tests[0].clientParam
+	if gCompareCongestionControl {
+		printTestSummaryHeader(p, "[   Algorithm]  ")
+		for i, test := range tests {
+			prefix := fmt.Sprintf("[%12s]  ", truncateStringFromEnd(test.clientParam.CongestionControl, 12))
+			printTestSummaryRows(prefix, p, clientParam, clientFins[i], serverFins[i])
+		}
+		return
+	}
+	printTestSummaryHeader(p, "[ServerAddress]  ")
+	for i, test := range tests {
+		prefix := fmt.Sprintf("[%13s]  ", truncateStringFromStart(test.session.remoteIP, 13))
+		printTestSummaryRows(prefix, p, clientParam, clientFins[i], serverFins[i])
+	}
+	printTestSummaryRows(fmt.Sprintf("[%13s]  ", "SUM"), p, clientParam,
+		sumTestFins(clientFins), sumTestFins(serverFins))
+}
+
+//
+// sumTestFins adds up the results of tests against multiple destinations.
+// Tests run at the same time share the elapsed time, whereas the elapsed
+// time of tests run one after another adds up.
+//
+func sumTestFins(fins []*EthrMsgFin) *EthrMsgFin {
+	var sum *EthrMsgFin
+	for _, fin := range fins {
+		if fin == nil {
+			continue
+		}
+		if sum == nil {
+			sum = &EthrMsgFin{TestID: fin.TestID}
+		}
+		sum.Bytes += fin.Bytes
+		sum.ReverseBytes += fin.ReverseBytes
+		sum.Packets += fin.Packets
+		sum.Connections += fin.Connections
+		if gSequentialTests {
+			sum.Elapsed += fin.Elapsed
+		} else if fin.Elapsed > sum.Elapsed {
+			sum.Elapsed = fin.Elapsed
+		}
+	}
+	return sum
+}
+
+func printTestSummaryResult(prefix string, p EthrProtocol, fin *EthrMsgFin, reverse bool, role string) {
+	if fin == nil {
+		return
+	}
+	bytes := fin.Bytes
+	if reverse {
+		bytes = fin.ReverseBytes
+	}
+	bw := uint64(0)
+	if fin.Elapsed > 0 {
+		bw = uint64(float64(bytes) / fin.Elapsed.Seconds())
+	}
+	pkts := "--"
+	if p == UDP {
+		pkts = numberToUnit(fin.Packets)
+	}
+	ui.printMsg("%s  %-5s    %03d-%03d sec   %8s   %7s   %7s   %7s   %s",
+		prefix, protoToString(p), 0, uint64(fin.Elapsed.Seconds()+0.5),
+		numberToUnit(bytes)+"B", bytesToRate(bw), pkts,
+		numberToUnit(fin.Connections), role)
+}
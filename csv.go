@@ -0,0 +1,291 @@
+//-----------------------------------------------------------------------------
+// Copyright (C) Microsoft. All rights reserved.
+// Licensed under the MIT license.
+// See LICENSE.txt file in the project root for full license information.
+//-----------------------------------------------------------------------------
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//
+// Results of every interval can be written to a CSV file as a time series,
+// to load them into spreadsheets and notebooks without parsing the log. All
+// rows have the same columns, and cells that don't apply to a row are left
+// empty. The Type column tells what a row is: Connection rows have the
+// results of a connection of a test, Test rows the results of a test, i.e.
+// the sum of its connections, Aggregate rows the sum of the tests of a
+// protocol, i.e. of all clients on the server, or of all destinations on the
+// client, and Interface rows the traffic of a network interface. Bandwidth
+// is in bits/s, rates are per second and latency is the average in
+// nanoseconds. All rows of an interval have the same time. Rows are appended
+// to the file, so that the results of several runs can be kept together, and
+// the header is only written to a new file.
+//
+const (
+	csvConnResult      = "Connection"
+	csvTestResult      = "Test"
+	csvAggregateResult = "Aggregate"
+	csvInterfaceResult = "Interface"
+)
+
+var csvHeader = []string{"Time", "Title", "Role", "Type", "RemoteAddr", "Protocol", "Test",
+	"ConnectionID", "Direction", "BitsPerSecond", "PacketsPerSecond", "ConnectionsPerSecond",
+	"Latency", "Interface", "RxBitsPerSecond", "TxBitsPerSecond", "RxPacketsPerSecond",
+	"TxPacketsPerSecond"}
+
+type ethrCSVResult struct {
+	resultType string
+	title      string
+	remoteIP   string
+	proto      string
+	test       string
+	connID     string
+	dir        string
+	bw         uint64
+	pps        uint64
+	cps        uint64
+	latency    uint64
+	bwOn       bool
+	ppsOn      bool
+	cpsOn      bool
+	latOn      bool
+}
+
+// gCSVEnabled is read without gCSVLock first, so that nothing is locked when
+// CSV isn't written, and again with the lock held, as csvFini may have
+// disabled it in between.
+var gCSVEnabled uint32
+var gCSVLock sync.Mutex
+var gCSVFile *os.File
+var gCSVWriter *csv.Writer
+var gCSVRole string
+var gCSVTime time.Time
+var gCSVNetStats ethrNetStat
+
+func csvInit(fileName string, isServer bool) {
+	if fileName == "" {
+		return
+	}
+	csvFile, err := os.OpenFile(fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		fmt.Printf("Unable to open the CSV file %s, Error: %v\n", fileName, err)
+		return
+	}
+	gCSVFile = csvFile
+	gCSVWriter = csv.NewWriter(csvFile)
+	if fi, err := csvFile.Stat(); err == nil && fi.Size() == 0 {
+		gCSVWriter.Write(csvHeader)
+		gCSVWriter.Flush()
+	}
+	gCSVRole = "Client"
+	if isServer {
+		gCSVRole = "Server"
+	}
+	atomic.StoreUint32(&gCSVEnabled, 1)
+}
+
+func csvEnabled() bool {
+	return atomic.LoadUint32(&gCSVEnabled) == 1
+}
+
+func csvFini() {
+	if !csvEnabled() {
+		return
+	}
+	gCSVLock.Lock()
+	defer gCSVLock.Unlock()
+	if !csvEnabled() {
+		return
+	}
+	atomic.StoreUint32(&gCSVEnabled, 0)
+	gCSVWriter.Flush()
+	gCSVFile.Close()
+}
+
+//
+// csvBegin starts the rows of an interval, which all get the time of its
+// start. Rows that are added outside of an interval, e.g. latency results,
+// get the time when they are added.
+//
+func csvBegin() {
+	if !csvEnabled() {
+		return
+	}
+	gCSVLock.Lock()
+	defer gCSVLock.Unlock()
+	if !csvEnabled() {
+		return
+	}
+	gCSVTime = time.Now()
+}
+
+func csvEnd() {
+	if !csvEnabled() {
+		return
+	}
+	gCSVLock.Lock()
+	defer gCSVLock.Unlock()
+	if !csvEnabled() {
+		return
+	}
+	gCSVTime = time.Time{}
+	gCSVWriter.Flush()
+}
+
+//
+// newCSVResult returns a result of the given type for a test. Tests of the
+// server have the title that the client sent, whereas tests of the client
+// have the title of the client, along with their type.
+//
+func newCSVResult(resultType string, test *ethrTest) ethrCSVResult {
+	r := ethrCSVResult{
+		resultType: resultType,
+		remoteIP:   test.session.remoteIP,
+		proto:      protoToString(test.testID.Protocol),
+	}
+	if test.testID.Type == All {
+		r.title = test.title
+	} else {
+		r.title = ui.getTitle()
+		r.test = testToString(test.testID.Type)
+	}
+	return r
+}
+
+func csvAddResult(r ethrCSVResult) {
+	if !csvEnabled() {
+		return
+	}
+	gCSVLock.Lock()
+	defer gCSVLock.Unlock()
+	if !csvEnabled() {
+		return
+	}
+	row := make([]string, len(csvHeader))
+	row[0] = csvTimeToString(gCSVTime)
+	row[1] = r.title
+	row[2] = gCSVRole
+	row[3] = r.resultType
+	row[4] = r.remoteIP
+	row[5] = r.proto
+	row[6] = r.test
+	row[7] = r.connID
+	row[8] = r.dir
+	if r.bwOn {
+		row[9] = strconv.FormatUint(r.bw, 10)
+	}
+	if r.ppsOn {
+		row[10] = strconv.FormatUint(r.pps, 10)
+	}
+	if r.cpsOn {
+		row[11] = strconv.FormatUint(r.cps, 10)
+	}
+	if r.latOn {
+		row[12] = strconv.FormatUint(r.latency, 10)
+	}
+	gCSVWriter.Write(row)
+	if gCSVTime.IsZero() {
+		gCSVWriter.Flush()
+	}
+}
+
+//
+// csvStartNetStats reads the counters of the network interfaces when the
+// stats timer starts, so that the first interval has their traffic as well.
+//
+func csvStartNetStats() {
+	if !csvEnabled() {
+		return
+	}
+	netStats := getNetworkStats()
+	gCSVLock.Lock()
+	gCSVNetStats = netStats
+	gCSVLock.Unlock()
+}
+
+//
+// csvAddNetStats adds the traffic of each network interface over the
+// interval, from the counters of the interface at the start and the end of
+// the interval.
+//
+func csvAddNetStats(netStats ethrNetStat, seconds uint64) {
+	if !csvEnabled() {
+		return
+	}
+	gCSVLock.Lock()
+	defer gCSVLock.Unlock()
+	if !csvEnabled() {
+		return
+	}
+	t := csvTimeToString(gCSVTime)
+	for _, ns := range netStats.netDevStats {
+		d := getNetDevStatDiff(ns, gCSVNetStats, seconds)
+		row := make([]string, len(csvHeader))
+		row[0] = t
+		row[1] = ui.getTitle()
+		row[2] = gCSVRole
+		row[3] = csvInterfaceResult
+		row[13] = d.interfaceName
+		row[14] = strconv.FormatUint(d.rxBytes*8, 10)
+		row[15] = strconv.FormatUint(d.txBytes*8, 10)
+		row[16] = strconv.FormatUint(d.rxPkts, 10)
+		row[17] = strconv.FormatUint(d.txPkts, 10)
+		gCSVWriter.Write(row)
+	}
+	gCSVNetStats = netStats
+}
+
+func csvTimeToString(t time.Time) string {
+	if t.IsZero() {
+		t = time.Now()
+	}
+	return t.UTC().Format("2006-01-02T15:04:05.000Z07:00")
+}
+
+//
+// csvAddClientResult adds a result of the client, with the values that apply
+// to the type of its test. Bandwidth is given in bytes/s.
+//
+func csvAddClientResult(r ethrCSVResult, testID EthrTestID, bw, cps, pps uint64) {
+	r.bw, r.cps, r.pps = bw*8, cps, pps
+	switch testID.Type {
+	case Bandwidth:
+		r.bwOn = true
+		r.ppsOn = testID.Protocol == UDP
+	case Pps:
+		r.bwOn, r.ppsOn = true, true
+	case Cps:
+		r.cpsOn = true
+	}
+	csvAddResult(r)
+}
+
+func csvAddClientConnResult(test *ethrTest, ec *ethrConn, bw, pps uint64) {
+	r := newCSVResult(csvConnResult, test)
+	r.connID = fmt.Sprintf("%d", ec.fd)
+	r.dir = connDirection(ec, true)
+	csvAddClientResult(r, test.testID, bw, 0, pps)
+}
+
+func csvAddLatencyResult(test *ethrTest, h *ethrHistogram) {
+	r := newCSVResult(csvTestResult, test)
+	r.latency, r.latOn = uint64(h.avg().Nanoseconds()), true
+	csvAddResult(r)
+}
+
+func newCSVAggregateResult(testID EthrTestID) ethrCSVResult {
+	return ethrCSVResult{
+		resultType: csvAggregateResult,
+		title:      ui.getTitle(),
+		proto:      protoToString(testID.Protocol),
+		test:       testToString(testID.Type),
+	}
+}
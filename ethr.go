@@ -8,9 +8,13 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
 	"net"
 	"os"
 	"runtime"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -18,6 +22,16 @@ import (
 const defaultLogFileName = "./ethrs.log for server, ./ethrc.log for client"
 const latencyDefaultBufferLenStr = "1B"
 const defaultBufferLenStr = "16KB"
+const defaultReportFileName = "ethrreport.json"
+
+//
+// Ethr exits with 1 on errors, and with the following codes when a run
+// completes but its results fail a check. The codes for violated thresholds,
+// failed connections and rejections by the server are in thresholds.go.
+//
+const (
+	exitCodeRegression = 2
+)
 
 var (
 	gVersion     string
@@ -32,10 +46,6 @@ func main() {
 		gVersion = "UNKNOWN"
 	}
 
-	fmt.Println("\nEthr: Comprehensive Network Performance Measurement Tool (Version: " + gVersion + ")")
-	fmt.Println("Maintainer: Pankaj Garg (ipankajg @ LinkedIn | GitHub | Gmail | Twitter)")
-	fmt.Println("")
-
 	//
 	// Set GOMAXPROCS to 1024 as running large number of goroutines that send
 	// data in a tight loop over network is resulting in unfair time allocation
@@ -45,37 +55,85 @@ func main() {
 	runtime.GOMAXPROCS(1024)
 
 	// Common
-	flag.Usage = func() { ethrUsage() }
+	flag.Usage = func() {
+		printBanner(os.Stdout)
+		ethrUsage()
+	}
 	noOutput := flag.Bool("no", false, "")
 	outputFile := flag.String("o", defaultLogFileName, "")
+	csvFile := flag.String("csv", "", "")
 	debug := flag.Bool("debug", false, "")
 	use4 := flag.Bool("4", false, "")
 	use6 := flag.Bool("6", false, "")
 	port := flag.Int("port", 8888, "")
 	ip := flag.String("ip", "", "")
+	mptcp := flag.Bool("mptcp", false, "")
 	// Server
 	isServer := flag.Bool("s", false, "")
 	showUI := flag.Bool("ui", false, "")
+	allowStr := flag.String("allow", "", "")
+	denyStr := flag.String("deny", "", "")
+	certFile := flag.String("cert", "", "")
+	keyFile := flag.String("key", "", "")
+	metricsAddr := flag.String("metrics", "", "")
+	maxBwStr := flag.String("maxbw", "", "")
+	maxDuration := flag.Duration("maxduration", 0, "")
+	maxSessions := flag.Int("maxsessions", 0, "")
+	maxStreams := flag.Int("maxstreams", 0, "")
 	// Client & External Client
 	clientDest := flag.String("c", "", "")
+	baselineFile := flag.String("baseline", "", "")
+	compareFile := flag.String("compare", "", "")
+	tolerance := flag.Float64("tolerance", 10, "")
 	bufLenStr := flag.String("l", "", "")
 	bwRateStr := flag.String("b", "", "")
+	batch := flag.Int("batch", 1, "")
+	bidir := flag.Bool("bidir", false, "")
+	ccStr := flag.String("cc", "", "")
 	cport := flag.Int("cport", 0, "")
 	duration := flag.Duration("d", 10*time.Second, "")
 	gap := flag.Duration("g", time.Second, "")
+	gso := flag.Bool("gso", false, "")
 	iterCount := flag.Int("i", 1000, "")
+	maxLossStr := flag.String("maxloss", "", "")
+	maxP99 := flag.Duration("maxp99", 0, "")
+	minBwStr := flag.String("minbw", "", "")
+	minCpsStr := flag.String("mincps", "", "")
+	mss := flag.Int("mss", 0, "")
+	nagle := flag.Bool("nagle", false, "")
+	ignoreCert := flag.Bool("ic", false, "")
+	jsonOutput := flag.Bool("json", false, "")
 	ncs := flag.Bool("ncs", false, "")
+	nka := flag.Bool("nka", false, "")
 	protocol := flag.String("p", "tcp", "")
+	pskStr := flag.String("psk", "", "")
 	reverse := flag.Bool("r", false, "")
+	rcvBufStr := flag.String("rcvbuf", "", "")
+	reportFile := flag.String("report", defaultReportFileName, "")
+	scenarioFile := flag.String("scenario", "", "")
+	sequential := flag.Bool("seq", false, "")
+	sndBufStr := flag.String("sndbuf", "", "")
 	testTypePtr := flag.String("t", "", "")
 	tos := flag.Int("tos", 0, "")
 	title := flag.String("T", "", "")
+	useTLS := flag.Bool("tls", false, "")
 	thCount := flag.Int("n", 1, "")
 	wc := flag.Int("w", 1, "")
 	xClientDest := flag.String("x", "", "")
+	zeroCopy := flag.String("zc", "", "")
 
 	flag.Parse()
 
+	//
+	// In JSON output mode, stdout is reserved for the JSON results, so the
+	// banner is printed to stderr instead.
+	//
+	if *jsonOutput {
+		printBanner(os.Stderr)
+	} else {
+		printBanner(os.Stdout)
+	}
+
 	if *isServer {
 		if *clientDest != "" {
 			printUsageError("Invalid arguments, \"-c\" cannot be used with \"-s\".")
@@ -89,6 +147,27 @@ func main() {
 		if *bwRateStr != "" {
 			printServerModeArgError("b")
 		}
+		if *batch != 1 {
+			printServerModeArgError("batch")
+		}
+		if *baselineFile != "" {
+			printServerModeArgError("baseline")
+		}
+		if *bidir {
+			printServerModeArgError("bidir")
+		}
+		if *ccStr != "" {
+			printServerModeArgError("cc")
+		}
+		if *compareFile != "" {
+			printServerModeArgError("compare")
+		}
+		if *scenarioFile != "" {
+			printServerModeArgError("scenario")
+		}
+		if *reportFile != defaultReportFileName {
+			printServerModeArgError("report")
+		}
 		if *cport != 0 {
 			printServerModeArgError("cport")
 		}
@@ -98,18 +177,48 @@ func main() {
 		if *gap != time.Second {
 			printServerModeArgError("g")
 		}
+		if *gso {
+			printServerModeArgError("gso")
+		}
 		if *iterCount != 1000 {
 			printServerModeArgError("i")
 		}
+		if *mss != 0 {
+			printServerModeArgError("mss")
+		}
+		if *nagle {
+			printServerModeArgError("nagle")
+		}
+		if *ignoreCert {
+			printServerModeArgError("ic")
+		}
+		if *jsonOutput {
+			printServerModeArgError("json")
+		}
 		if *ncs {
 			printServerModeArgError("ncs")
 		}
+		if *nka {
+			printServerModeArgError("nka")
+		}
+		if *zeroCopy != "" {
+			printServerModeArgError("zc")
+		}
 		if *protocol != "tcp" {
 			printServerModeArgError("p")
 		}
 		if *reverse {
 			printServerModeArgError("r")
 		}
+		if *rcvBufStr != "" {
+			printServerModeArgError("rcvbuf")
+		}
+		if *sequential {
+			printServerModeArgError("seq")
+		}
+		if *sndBufStr != "" {
+			printServerModeArgError("sndbuf")
+		}
 		if *testTypePtr != "" {
 			printServerModeArgError("t")
 		}
@@ -119,12 +228,27 @@ func main() {
 		if *thCount != 1 {
 			printServerModeArgError("n")
 		}
+		if *tolerance != 10 {
+			printServerModeArgError("tolerance")
+		}
+		if *minBwStr != "" || *minCpsStr != "" || *maxP99 != 0 || *maxLossStr != "" {
+			printUsageError("Invalid arguments, thresholds can only be used in client (\"-c\") mode.")
+		}
 		if *wc != 1 {
 			printServerModeArgError("wc")
 		}
 		if *title != "" {
 			printServerModeArgError("T")
 		}
+		if *useTLS {
+			printServerModeArgError("tls")
+		}
+		if (*certFile == "") != (*keyFile == "") {
+			printUsageError("Invalid arguments, both \"-cert\" and \"-key\" must be specified.")
+		}
+		if *maxDuration < 0 || *maxSessions < 0 || *maxStreams < 0 {
+			printUsageError("Invalid arguments, \"-maxduration\", \"-maxsessions\" and \"-maxstreams\" can't be negative.")
+		}
 	} else if *clientDest != "" || *xClientDest != "" {
 		if *clientDest != "" && *xClientDest != "" {
 			printUsageError("Invalid argument, both \"-c\" and \"-x\" cannot be specified at the same time.")
@@ -132,9 +256,60 @@ func main() {
 		if *showUI {
 			printUsageError(fmt.Sprintf("Invalid argument, \"-%s\" can only be used in server (\"-s\") mode.", "ui"))
 		}
+		if *metricsAddr != "" {
+			printUsageError(fmt.Sprintf("Invalid argument, \"-%s\" can only be used in server (\"-s\") mode.", "metrics"))
+		}
+		if *certFile != "" {
+			printUsageError(fmt.Sprintf("Invalid argument, \"-%s\" can only be used in server (\"-s\") mode.", "cert"))
+		}
+		if *keyFile != "" {
+			printUsageError(fmt.Sprintf("Invalid argument, \"-%s\" can only be used in server (\"-s\") mode.", "key"))
+		}
+		if *allowStr != "" {
+			printUsageError(fmt.Sprintf("Invalid argument, \"-%s\" can only be used in server (\"-s\") mode.", "allow"))
+		}
+		if *denyStr != "" {
+			printUsageError(fmt.Sprintf("Invalid argument, \"-%s\" can only be used in server (\"-s\") mode.", "deny"))
+		}
+		if *maxBwStr != "" {
+			printUsageError(fmt.Sprintf("Invalid argument, \"-%s\" can only be used in server (\"-s\") mode.", "maxbw"))
+		}
+		if *maxDuration != 0 {
+			printUsageError(fmt.Sprintf("Invalid argument, \"-%s\" can only be used in server (\"-s\") mode.", "maxduration"))
+		}
+		if *maxSessions != 0 {
+			printUsageError(fmt.Sprintf("Invalid argument, \"-%s\" can only be used in server (\"-s\") mode.", "maxsessions"))
+		}
+		if *maxStreams != 0 {
+			printUsageError(fmt.Sprintf("Invalid argument, \"-%s\" can only be used in server (\"-s\") mode.", "maxstreams"))
+		}
+		if *xClientDest != "" && *pskStr != "" {
+			printUsageError("Invalid arguments, \"-psk\" cannot be used with \"-x\".")
+		}
+		if *compareFile != "" {
+			printUsageError("Invalid arguments, \"-compare\" cannot be used with \"-c\" or \"-x\".")
+		}
+		if *scenarioFile != "" {
+			printUsageError("Invalid arguments, \"-scenario\" cannot be used with \"-c\" or \"-x\".")
+		}
+	} else if *scenarioFile != "" {
+		validateScenarioArgs()
+	} else if *compareFile != "" {
+		if *baselineFile == "" {
+			printUsageError("Invalid arguments, \"-compare\" requires \"-baseline\".")
+		}
 	} else {
 		printUsageError("Invalid arguments, use either \"-s\" or \"-c\".")
 	}
+	if *reportFile != defaultReportFileName && *scenarioFile == "" {
+		printUsageError("Invalid arguments, \"-report\" requires \"-scenario\".")
+	}
+	if *tolerance != 10 && *baselineFile == "" {
+		printUsageError("Invalid arguments, \"-tolerance\" requires \"-baseline\".")
+	}
+	if *tolerance < 0 {
+		printUsageError(fmt.Sprintf("Invalid tolerance specified: %g", *tolerance))
+	}
 
 	// Process common parameters.
 
@@ -161,6 +336,13 @@ func main() {
 	gEthrPort = uint16(*port)
 	gEthrPortStr = fmt.Sprintf("%d", gEthrPort)
 
+	if *mptcp {
+		if !isMPTCPSupported() {
+			printUsageError("Invalid argument, \"-mptcp\" is only supported on Linux, with MPTCP enabled (net.mptcp.enabled = 1).")
+		}
+		gMPTCP = true
+	}
+
 	logFileName := *outputFile
 	if !*noOutput {
 		if logFileName == defaultLogFileName {
@@ -172,14 +354,48 @@ func main() {
 		}
 		logInit(logFileName)
 	}
+	csvInit(*csvFile, *isServer)
+
+	var psk []byte
+	if *pskStr != "" {
+		psk = getPSK(*pskStr)
+	}
 
 	var testType EthrTestType
 	var destination string
 	if *isServer {
 		// Server side parameter processing.
 		testType = All
-		serverParam := ethrServerParam{*showUI}
+		serverParam := ethrServerParam{*showUI, *metricsAddr, *certFile, *keyFile, psk, nil, nil,
+			uint32(*maxSessions), uint32(*maxStreams), *maxDuration, 0}
+		if *allowStr != "" {
+			serverParam.allowList = getIPNets(*allowStr)
+		}
+		if *denyStr != "" {
+			serverParam.denyList = getIPNets(*denyStr)
+		}
+		if *maxBwStr != "" {
+			serverParam.maxBandwidth = unitToNumber(*maxBwStr) / 8
+			if serverParam.maxBandwidth == 0 {
+				printUsageError(fmt.Sprintf("Invalid bandwidth specified: %s", *maxBwStr))
+			}
+		}
 		runServer(serverParam)
+	} else if *scenarioFile != "" {
+		gNoConnectionStats = *ncs
+		gJSONOutput = *jsonOutput
+		gIgnoreCert = *ignoreCert
+		gNoKeepAlive = *nka
+		gSequentialTests = *sequential
+		gPSK = psk
+		gClientPort = uint16(*cport)
+		code := runScenario(*scenarioFile, *reportFile, *title)
+		csvFini()
+		if code != 0 {
+			os.Exit(code)
+		}
+	} else if *compareFile != "" {
+		runComparison(*baselineFile, *compareFile, *tolerance)
 	} else {
 		gIsExternalClient = false
 		destination = *clientDest
@@ -188,7 +404,15 @@ func main() {
 			destination = *xClientDest
 		}
 		gNoConnectionStats = *ncs
-		testType = getTestType(*testTypePtr)
+		gJSONOutput = *jsonOutput
+		gUseTLS = *useTLS
+		gIgnoreCert = *ignoreCert
+		gNoKeepAlive = *nka
+		gSequentialTests = *sequential
+		gPSK = psk
+		mode := ethrClientMode{external: gIsExternalClient, tls: gUseTLS}
+		destinations := getDestinations(destination)
+		testType = getTestType(*testTypePtr, mode)
 		proto := getProtocol(*protocol)
 
 		// Default latency test to 1B if length is not specified
@@ -208,15 +432,6 @@ func main() {
 			bwRate /= 8
 		}
 
-		//
-		// For Pkt/s, we always override the buffer size to be just 1 byte.
-		// TODO: Evaluate in future, if we need to support > 1 byte packets for
-		//       Pkt/s testing.
-		//
-		if testType == Pps {
-			bufLen = 1
-		}
-
 		if *iterCount <= 0 {
 			printUsageError(fmt.Sprintf("Invalid iteration count for latency test: %d", *iterCount))
 		}
@@ -227,6 +442,14 @@ func main() {
 
 		gClientPort = uint16(*cport)
 
+		if *mss < 0 {
+			printUsageError(fmt.Sprintf("Invalid MSS specified: %d", *mss))
+		}
+		gSendBufferSize = getSockBufferSize(*sndBufStr)
+		gRecvBufferSize = getSockBufferSize(*rcvBufStr)
+		gMSS = uint32(*mss)
+		gNagle = *nagle
+
 		testId := EthrTestID{EthrProtocol(proto), testType}
 		clientParam := EthrClientParam{
 			uint32(*thCount),
@@ -237,12 +460,254 @@ func main() {
 			*gap,
 			uint32(*wc),
 			uint64(bwRate),
-			uint8(*tos)}
-		validateClientParams(testId, clientParam)
+			uint8(*tos),
+			*bidir,
+			"",
+			gSendBufferSize,
+			gRecvBufferSize,
+			gMSS,
+			gNagle,
+			*zeroCopy,
+			uint32(*batch),
+			*gso}
+		validateClientParams(testId, clientParam, mode)
+		ccs := getCongestionControlList(testId, *ccStr, destinations, mode)
+		validateDestinations(testType, destinations)
+
+		thresholds := getThresholds(*minBwStr, *minCpsStr, *maxP99, *maxLossStr)
+		var baseline *ethrRunResults
+		if *baselineFile != "" {
+			baseline = mustLoadRunResults(*baselineFile)
+		}
+		if baseline != nil || thresholds.isSet() {
+			gRunResults = newRunResults()
+		}
+		runClient(testId, *title, clientParam, destinations, ccs)
+		csvFini()
+		regressed := baseline != nil && compareWithBaseline(baseline, gRunResults, *baselineFile, *tolerance)
+		code, _ := judgeRun(thresholds, gRunResults, protoToString(proto), regressed, baseline != nil || thresholds.isSet())
+		if code != 0 {
+			os.Exit(code)
+		}
+	}
+}
+
+//
+// Flags that set the test are given by each step of a scenario instead.
+//
+var scenarioStepFlags = []string{"b", "batch", "baseline", "bidir", "cc", "compare", "d", "g", "gso", "i", "l",
+	"maxloss", "maxp99", "minbw", "mincps", "mss", "n", "nagle", "p", "r", "rcvbuf", "sndbuf", "t", "tls",
+	"tolerance", "tos", "w", "zc"}
+
+func validateScenarioArgs() {
+	flag.Visit(func(f *flag.Flag) {
+		for _, name := range scenarioStepFlags {
+			if f.Name == name {
+				printUsageError(fmt.Sprintf("Invalid argument, \"-%s\" cannot be used with \"-scenario\", set it in the steps of the scenario instead.", name))
+			}
+		}
+	})
+}
+
+func validateDestinations(testType EthrTestType, destinations []string) {
+	if len(destinations) > 1 && !gSequentialTests &&
+		testType != Bandwidth && testType != Cps && testType != Pps {
+		printUsageError("Tests against multiple destinations can only run at the same time for\n" +
+			"Bandwidth, Connections/s and Packets/s tests. Use \"-seq\" to run them one after another.")
+	}
+}
+
+//
+// getThresholds returns the thresholds that the run is judged against.
+//
+func getThresholds(minBwStr, minCpsStr string, maxP99 time.Duration, maxLossStr string) (t ethrThresholds) {
+	if minBwStr != "" {
+		t.minBw, t.minBwOn = unitToNumber(minBwStr), true
+		if t.minBw == 0 {
+			printUsageError(fmt.Sprintf("Invalid bandwidth specified: %s", minBwStr))
+		}
+	}
+	if minCpsStr != "" {
+		t.minCps, t.minCpsOn = unitToNumber(minCpsStr), true
+		if t.minCps == 0 {
+			printUsageError(fmt.Sprintf("Invalid connections/s specified: %s", minCpsStr))
+		}
+	}
+	if maxP99 < 0 {
+		printUsageError(fmt.Sprintf("Invalid latency specified: %v", maxP99))
+	}
+	t.maxP99, t.maxP99On = maxP99, maxP99 > 0
+	if maxLossStr != "" {
+		loss, err := strconv.ParseFloat(strings.TrimSuffix(maxLossStr, "%"), 64)
+		if err != nil || loss < 0 || loss > 100 {
+			printUsageError(fmt.Sprintf("Invalid packet loss specified: %s", maxLossStr))
+		}
+		t.maxLoss, t.maxLossOn = loss, true
+	}
+	return
+}
+
+//
+// getDestinations returns the list of destinations given to -c or -x. These
+// are separated by commas, and "@<filename>" reads destinations from a file,
+// one per line, where empty lines and lines starting with '#' are skipped.
+//
+func getDestinations(s string) []string {
+	destinations := getList(s)
+	if len(destinations) == 0 {
+		printUsageError("Invalid argument, no destination specified.")
+	}
+	return destinations
+}
+
+//
+// getIPNets returns the list of networks given to -allow or -deny, in the same
+// format as destinations. An IP address without prefix length is a network
+// of that one address.
+//
+func getIPNets(s string) []*net.IPNet {
+	nets := []*net.IPNet{}
+	for _, n := range getList(s) {
+		if !strings.Contains(n, "/") {
+			ip := net.ParseIP(n)
+			if ip == nil {
+				printUsageError(fmt.Sprintf("Invalid IP address: <%s> specified.", n))
+			}
+			if ip.To4() != nil {
+				n += "/32"
+			} else {
+				n += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(n)
+		if err != nil {
+			printUsageError(fmt.Sprintf("Invalid network: <%s> specified.", n))
+		}
+		nets = append(nets, ipNet)
+	}
+	if len(nets) == 0 {
+		printUsageError("Invalid argument, no network specified.")
+	}
+	return nets
+}
+
+//
+// getCongestionControlList returns the congestion control algorithms given to
+// -cc, which must be available on this system.
+//
+func getCongestionControlList(testID EthrTestID, s string, destinations []string, mode ethrClientMode) []string {
+	if s == "" {
+		return nil
+	}
+	if mode.external || testID.Protocol != TCP || testID.Type != Bandwidth {
+		printUsageError("Invalid argument, \"-cc\" is only supported for TCP Bandwidth tests.")
+	}
+	available := getCongestionControls()
+	if len(available) == 0 {
+		printUsageError("Invalid argument, \"-cc\" is only supported on Linux.")
+	}
+	ccs := getList(s)
+	for _, cc := range ccs {
+		if !isStringInList(cc, available) {
+			printUsageError(fmt.Sprintf("Congestion control algorithm: <%s> is not available.\n"+
+				"Available algorithms are: %s", cc, strings.Join(available, ", ")))
+		}
+	}
+	if len(ccs) > 1 && len(destinations) > 1 {
+		printUsageError("Multiple congestion control algorithms can only be compared against a single destination.")
+	}
+	return ccs
+}
+
+func validateZeroCopyMode(testID EthrTestID, zcMode string, mode ethrClientMode) {
+	if mode.external || testID.Protocol != TCP || testID.Type != Bandwidth {
+		printUsageError("Invalid argument, \"-zc\" is only supported for TCP Bandwidth tests.")
+	}
+	if mode.tls {
+		printUsageError("Invalid argument, \"-zc\" cannot be used with \"-tls\".")
+	}
+	modes := getZeroCopyModes()
+	if len(modes) == 0 {
+		printUsageError("Invalid argument, \"-zc\" is only supported on Linux.")
+	}
+	if !isStringInList(zcMode, modes) {
+		printUsageError(fmt.Sprintf("Invalid zero copy mode: <%s> specified.\n"+
+			"Available modes are: %s", zcMode, strings.Join(modes, ", ")))
+	}
+}
+
+func validateUDPBatch(testID EthrTestID, clientParam EthrClientParam, mode ethrClientMode) {
+	if mode.external || testID.Protocol != UDP || (testID.Type != Bandwidth && testID.Type != Pps) {
+		printUsageError("Invalid argument, \"-batch\" and \"-gso\" are only supported for UDP Bandwidth and Packets/s tests.")
+	}
+	if !isUDPBatchSupported() {
+		printUsageError("Invalid argument, \"-batch\" and \"-gso\" are only supported on Linux.")
+	}
+	if clientParam.Batch < 1 || clientParam.Batch > udpMaxBatch {
+		printUsageError(fmt.Sprintf("Invalid batch size specified: %d, it must be from 1 to %d.",
+			clientParam.Batch, udpMaxBatch))
+	}
+}
+
+//
+// getSockBufferSize returns the socket buffer size given to -sndbuf or -rcvbuf,
+// or 0 to leave the default of the OS.
+//
+func getSockBufferSize(s string) uint32 {
+	if s == "" {
+		return 0
+	}
+	size := unitToNumber(s)
+	if size == 0 || size > math.MaxInt32 {
+		printUsageError(fmt.Sprintf("Invalid socket buffer size specified: %s", s))
+	}
+	return uint32(size)
+}
 
-		rServer := destination
-		runClient(testId, *title, clientParam, rServer)
+//
+// getPSK returns the pre-shared key given to -psk. "@<filename>" reads the
+// key from a file, so that it doesn't show up in the list of processes.
+//
+func getPSK(s string) []byte {
+	if strings.HasPrefix(s, "@") {
+		data, err := ioutil.ReadFile(s[1:])
+		if err != nil {
+			printUsageError(fmt.Sprintf("Failed to read pre-shared key from file: %s, error: %v", s[1:], err))
+		}
+		s = strings.TrimSpace(string(data))
+	}
+	if s == "" {
+		printUsageError("Invalid argument, pre-shared key is empty.")
+	}
+	return []byte(s)
+}
+
+func getList(s string) []string {
+	items := []string{}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if strings.HasPrefix(item, "@") {
+			items = append(items, readListFile(item[1:])...)
+		} else if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func readListFile(fileName string) []string {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		printUsageError(fmt.Sprintf("Failed to read list from file: %s, error: %v", fileName, err))
+	}
+	items := []string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			items = append(items, line)
+		}
 	}
+	return items
 }
 
 func getProtocol(protoStr string) (proto EthrProtocol) {
@@ -255,6 +720,12 @@ func getProtocol(protoStr string) (proto EthrProtocol) {
 		proto = UDP
 	case "ICMP":
 		proto = ICMP
+	case "HTTP":
+		proto = HTTP
+	case "HTTPS":
+		proto = HTTPS
+	case "QUIC":
+		proto = QUIC
 	default:
 		printUsageError(fmt.Sprintf("Invalid value \"%s\" specified for parameter \"-p\".\n"+
 			"Valid parameters and values are:\n", protoStr))
@@ -262,10 +733,10 @@ func getProtocol(protoStr string) (proto EthrProtocol) {
 	return
 }
 
-func getTestType(testTypeStr string) (testType EthrTestType) {
+func getTestType(testTypeStr string, mode ethrClientMode) (testType EthrTestType) {
 	switch testTypeStr {
 	case "":
-		if gIsExternalClient {
+		if mode.external {
 			testType = Ping
 		} else {
 			testType = Bandwidth
@@ -292,21 +763,54 @@ func getTestType(testTypeStr string) (testType EthrTestType) {
 }
 
 func getDefaultBufferLenStr(testTypePtr string) string {
-	if testTypePtr == "l" {
+	// Connections/s test only uses the buffer for HTTP requests, which are
+	// as small as latency probes by default, and Packets/s tests send the
+	// smallest packets by default.
+	if testTypePtr == "l" || testTypePtr == "c" || testTypePtr == "p" {
 		return latencyDefaultBufferLenStr
 	}
 	return defaultBufferLenStr
 }
 
-func validateClientParams(testID EthrTestID, clientParam EthrClientParam) {
-	if !gIsExternalClient {
-		validateClientTest(testID, clientParam)
+//
+// ethrClientMode is how the client runs a test, which decides the tests and
+// arguments that are valid for it. Validation takes it instead of reading the
+// globals, which are only set once the test runs, e.g. for each step of a
+// scenario.
+//
+type ethrClientMode struct {
+	external bool
+	tls      bool
+}
+
+func validateClientParams(testID EthrTestID, clientParam EthrClientParam, mode ethrClientMode) {
+	if gNoKeepAlive && testID.Protocol != HTTP && testID.Protocol != HTTPS {
+		printUsageError("Invalid argument, \"-nka\" is only supported for HTTP and HTTPS tests.")
+	}
+	if (clientParam.SendBufferSize > 0 || clientParam.RecvBufferSize > 0) &&
+		testID.Protocol != TCP && testID.Protocol != UDP {
+		printUsageError("Invalid argument, \"-sndbuf\" and \"-rcvbuf\" are only supported for TCP and UDP tests.")
+	}
+	if (clientParam.MSS > 0 || clientParam.Nagle) && testID.Protocol != TCP {
+		printUsageError("Invalid argument, \"-mss\" and \"-nagle\" are only supported for TCP tests.")
+	}
+	if gMPTCP && testID.Protocol != TCP && testID.Protocol != HTTP && testID.Protocol != HTTPS {
+		printUsageError("Invalid argument, \"-mptcp\" is only supported for TCP, HTTP and HTTPS tests.")
+	}
+	if clientParam.ZeroCopy != "" {
+		validateZeroCopyMode(testID, clientParam.ZeroCopy, mode)
+	}
+	if clientParam.Batch != 1 || clientParam.UDPOffload {
+		validateUDPBatch(testID, clientParam, mode)
+	}
+	if !mode.external {
+		validateClientTest(testID, clientParam, mode)
 	} else {
-		validateExtModeClientTest(testID)
+		validateExtModeClientTest(testID, clientParam, mode)
 	}
 }
 
-func validateClientTest(testID EthrTestID, clientParam EthrClientParam) {
+func validateClientTest(testID EthrTestID, clientParam EthrClientParam, mode ethrClientMode) {
 	testType := testID.Type
 	protocol := testID.Protocol
 	switch protocol {
@@ -317,11 +821,20 @@ func validateClientTest(testID EthrTestID, clientParam EthrClientParam) {
 		if clientParam.Reverse && testType != Bandwidth {
 			printReverseModeError()
 		}
+		if clientParam.Bidirectional && testType != Bandwidth {
+			printBidirModeError()
+		}
+		if mode.tls && testType != Bandwidth && testType != Cps && testType != Latency {
+			printUsageError("TLS (-tls) is only supported for TCP Bandwidth, Connections/s and Latency tests.")
+		}
+		if clientParam.Bidirectional && clientParam.Reverse {
+			printUsageError("Invalid argument, both \"-bidir\" and \"-r\" cannot be specified at the same time.")
+		}
 		if clientParam.BufferSize > 2*GIGA {
 			printUsageError("Maximum allowed value for \"-l\" for TCP is 2GB.")
 		}
 	case UDP:
-		if testType != Bandwidth && testType != Pps {
+		if testType != Bandwidth && testType != Pps && testType != Latency {
 			emitUnsupportedTest(testID)
 		}
 		if testType == Bandwidth {
@@ -332,15 +845,61 @@ func validateClientTest(testID EthrTestID, clientParam EthrClientParam) {
 		if clientParam.Reverse {
 			printReverseModeError()
 		}
+		if clientParam.Bidirectional {
+			printBidirModeError()
+		}
+		if mode.tls {
+			printUsageError("TLS (-tls) is only supported for TCP Bandwidth, Connections/s and Latency tests.")
+		}
 		if clientParam.BufferSize > 64*KILO {
 			printUsageError("Maximum allowed value for \"-l\" for TCP is 64KB.")
 		}
+	case HTTP, HTTPS:
+		validateHTTPTest(testID, clientParam, mode)
+	case QUIC:
+		if testType != Bandwidth && testType != Cps && testType != Latency {
+			emitUnsupportedTest(testID)
+		}
+		if clientParam.Reverse && testType != Bandwidth {
+			printReverseModeError()
+		}
+		if clientParam.Bidirectional && testType != Bandwidth {
+			printBidirModeError()
+		}
+		if clientParam.Bidirectional && clientParam.Reverse {
+			printUsageError("Invalid argument, both \"-bidir\" and \"-r\" cannot be specified at the same time.")
+		}
+		if mode.tls {
+			printUsageError("Invalid argument, QUIC always uses TLS, \"-tls\" is not needed for QUIC tests.")
+		}
+		if clientParam.BufferSize > 2*GIGA {
+			printUsageError("Maximum allowed value for \"-l\" for QUIC is 2GB.")
+		}
 	default:
 		emitUnsupportedTest(testID)
 	}
 }
 
-func validateExtModeClientTest(testID EthrTestID) {
+func validateHTTPTest(testID EthrTestID, clientParam EthrClientParam, mode ethrClientMode) {
+	testType := testID.Type
+	if testType != Bandwidth && testType != Cps && testType != Latency {
+		emitUnsupportedTest(testID)
+	}
+	if clientParam.Reverse && testType != Bandwidth {
+		printReverseModeError()
+	}
+	if clientParam.Bidirectional {
+		printBidirModeError()
+	}
+	if clientParam.BwRate != 0 {
+		printUsageError("Invalid argument, \"-b\" is not supported for HTTP and HTTPS tests.")
+	}
+	if mode.tls {
+		printUsageError("Invalid argument, use \"-p https\" instead of \"-tls\" for HTTP tests.")
+	}
+}
+
+func validateExtModeClientTest(testID EthrTestID, clientParam EthrClientParam, mode ethrClientMode) {
 	testType := testID.Type
 	protocol := testID.Protocol
 	switch protocol {
@@ -352,6 +911,8 @@ func validateExtModeClientTest(testID EthrTestID) {
 		if testType != Ping && testType != TraceRoute && testType != MyTraceRoute {
 			emitUnsupportedTest(testID)
 		}
+	case HTTP, HTTPS:
+		validateHTTPTest(testID, clientParam, mode)
 	default:
 		emitUnsupportedTest(testID)
 	}
@@ -367,7 +928,17 @@ func emitUnsupportedTest(testID EthrTestID) {
 }
 
 func printReverseModeError() {
-	printUsageError("Reverse mode (-r) is only supported for TCP Bandwidth tests.")
+	printUsageError("Reverse mode (-r) is only supported for TCP, HTTP and QUIC Bandwidth tests.")
+}
+
+func printBanner(w io.Writer) {
+	fmt.Fprintln(w, "\nEthr: Comprehensive Network Performance Measurement Tool (Version: "+gVersion+")")
+	fmt.Fprintln(w, "Maintainer: Pankaj Garg (ipankajg @ LinkedIn | GitHub | Gmail | Twitter)")
+	fmt.Fprintln(w, "")
+}
+
+func printBidirModeError() {
+	printUsageError("Bidirectional mode (-bidir) is only supported for TCP and QUIC Bandwidth tests.")
 }
 
 func printUsageError(s string) {
@@ -387,6 +958,10 @@ func ethrUsage() {
 	printFlagUsage("o", "<filename>", "Name of log file. By default, following file names are used:",
 		"Server mode: 'ethrs.log'",
 		"Client mode: 'ethrc.log'")
+	printFlagUsage("csv", "<filename>", "Write the results of every interval to a CSV file, one row for each",
+		"connection, test and network interface, with the same columns in all",
+		"rows. Rows are appended if the file exists.",
+		"Default: <empty> - Disabled")
 	printFlagUsage("debug", "", "Enable debug information in logging output.")
 	printFlagUsage("4", "", "Use only IP v4 version")
 	printFlagUsage("6", "", "Use only IP v6 version")
@@ -396,8 +971,19 @@ func ethrUsage() {
 	fmt.Println("In this mode, Ethr runs as a server, allowing multiple clients to run")
 	fmt.Println("performance tests against it.")
 	printServerUsage()
+	printAllowUsage()
+	printCertUsage()
+	printDenyUsage()
 	printIPUsage()
+	printKeyUsage()
+	printMaxBwUsage()
+	printMaxDurationUsage()
+	printMaxSessionsUsage()
+	printMaxStreamsUsage()
+	printMetricsUsage()
+	printMPTCPUsage()
 	printPortUsage()
+	printServerPSKUsage()
 	printFlagUsage("ui", "", "Show output in text UI.")
 
 	fmt.Println("\nMode: Client")
@@ -405,34 +991,76 @@ func ethrUsage() {
 	fmt.Println("In this mode, Ethr client can only talk to an Ethr server.")
 	printClientUsage()
 	printBwRateUsage()
+	printBatchUsage()
+	printBaselineUsage()
+	printBidirUsage()
+	printCongestionControlUsage()
+	printCompareUsage()
 	printCPortUsage()
 	printDurationUsage()
 	printGapUsage()
+	printGSOUsage()
 	printIterationUsage()
+	printIgnoreCertUsage()
 	printIPUsage()
+	printJSONUsage()
 	printBufLenUsage()
+	printMaxLossUsage()
+	printMaxP99Usage()
+	printMinBwUsage()
+	printMinCpsUsage()
+	printMPTCPUsage()
+	printMSSUsage()
 	printThreadUsage()
+	printNagleUsage()
+	printNoKeepAliveUsage()
 	printProtocolUsage()
 	printPortUsage()
-	printFlagUsage("r", "", "For Bandwidth tests, send data from server to client.")
+	printClientPSKUsage()
+	printReverseUsage()
+	printRecvBufferUsage()
+	printReportUsage()
+	printScenarioUsage()
+	printSequentialUsage()
+	printSendBufferUsage()
 	printTestType()
+	printTLSUsage()
 	printToSUsage()
+	printToleranceUsage()
 	printWarmupUsage()
 	printTitleUsage()
+	printZeroCopyUsage()
 
 	fmt.Println("\nMode: External")
 	fmt.Println("================================================================================")
 	fmt.Println("In this mode, Ethr talks to a non-Ethr server. This mode supports only a")
 	fmt.Println("few types of measurements, such as Ping, Connections/s and TraceRoute.")
+	fmt.Println("Bandwidth, Requests/s and time to first byte can be measured against")
+	fmt.Println("any HTTP server.")
 	printExtClientUsage()
+	printBaselineUsage()
+	printCompareUsage()
 	printCPortUsage()
 	printDurationUsage()
 	printGapUsage()
+	printIterationUsage()
+	printIgnoreCertUsage()
 	printIPUsage()
+	printJSONUsage()
+	printBufLenUsage()
+	printMaxLossUsage()
+	printMaxP99Usage()
+	printMinBwUsage()
+	printMinCpsUsage()
+	printMPTCPUsage()
 	printThreadUsage()
+	printNoKeepAliveUsage()
 	printExtProtocolUsage()
+	printReverseUsage()
+	printSequentialUsage()
 	printExtTestType()
 	printToSUsage()
+	printToleranceUsage()
 	printWarmupUsage()
 	printTitleUsage()
 }
@@ -450,7 +1078,10 @@ func printServerUsage() {
 
 func printClientUsage() {
 	printFlagUsage("c", "<server>", "Run in client mode and connect to <server>.",
-		"Server is specified using name, FQDN or IP address.")
+		"Server is specified using name, FQDN or IP address.",
+		"Multiple servers can be specified separated by commas, and",
+		"@<filename> reads servers from a file, one per line.",
+		"Example: 10.1.0.4,10.1.0.5 or @servers.txt")
 }
 
 func printExtClientUsage() {
@@ -458,20 +1089,66 @@ func printExtClientUsage() {
 		"<destination> is specified in URL or Host:Port format.",
 		"For URL, if port is not specified, it is assumed to be 80 for http and 443 for https.",
 		"Example: For TCP - www.microsoft.com:443 or 10.1.0.4:22 or https://www.github.com",
-		"         For ICMP - www.microsoft.com or 10.1.0.4")
+		"         For ICMP - www.microsoft.com or 10.1.0.4",
+		"Multiple destinations can be specified separated by commas, and",
+		"@<filename> reads destinations from a file, one per line.")
+}
+
+func printSendBufferUsage() {
+	printFlagUsage("sndbuf", "<size>",
+		"Send buffer size of the sockets of TCP & UDP tests (format: <num>[KB | MB]).",
+		"The server uses it as well. The sizes granted by the OS are shown.",
+		"Default: <empty> - Default of the OS")
+}
+
+func printRecvBufferUsage() {
+	printFlagUsage("rcvbuf", "<size>",
+		"Receive buffer size of the sockets of TCP & UDP tests (format: <num>[KB | MB]).",
+		"The server uses it as well, and for UDP tests, it only grows the",
+		"buffer of its UDP socket, which is shared by all clients.",
+		"The sizes granted by the OS are shown.",
+		"Default: <empty> - Default of the OS")
+}
+
+func printMSSUsage() {
+	printFlagUsage("mss", "<bytes>",
+		"Maximum segment size (TCP_MAXSEG) of the connections of TCP tests.",
+		"The server uses it as well. The MSS in effect is shown.",
+		"Default: 0 - Default of the OS")
+}
+
+func printNagleUsage() {
+	printFlagUsage("nagle", "",
+		"Enable Nagle's algorithm, i.e. clear TCP_NODELAY, on the connections",
+		"of TCP tests, on both client and server. Ethr sets TCP_NODELAY by default.")
+}
+
+func printMPTCPUsage() {
+	printFlagUsage("mptcp", "",
+		"Use Multipath TCP (MPTCP) for TCP, HTTP & HTTPS tests. The server and",
+		"the client must both use it, or connections fall back to TCP. The",
+		"client shows whether each connection uses MPTCP, and the subflows of",
+		"each connection in TCP Bandwidth tests. Only supported on Linux.")
+}
+
+func printSequentialUsage() {
+	printFlagUsage("seq", "",
+		"With multiple destinations, run the test against each destination",
+		"one after another, instead of all of them at the same time.")
 }
 
 func printPortUsage() {
 	printFlagUsage("port", "<number>", "Use specified port number for TCP & UDP tests.",
+		"QUIC tests use the UDP port after it.",
 		"Default: 8888")
 }
 
 func printTestType() {
 	printFlagUsage("t", "<test>", "Test to run (\"b\", \"c\", \"p\", \"l\", \"cl\" or \"tr\")",
 		"b: Bandwidth",
-		"c: Connections/s",
+		"c: Connections/s, Requests/s for HTTP",
 		"p: Packets/s",
-		"l: Latency, Loss & Jitter",
+		"l: Latency, Loss & Jitter, Time to first byte for HTTP",
 		"pi: Ping Loss & Latency",
 		"tr: TraceRoute",
 		"mtr: MyTraceRoute with Loss & Latency",
@@ -480,7 +1157,9 @@ func printTestType() {
 
 func printExtTestType() {
 	printFlagUsage("t", "<test>", "Test to run (\"c\", \"cl\", or \"tr\")",
-		"c: Connections/s",
+		"b: Bandwidth, only for HTTP",
+		"c: Connections/s, Requests/s for HTTP",
+		"l: Time to first byte, only for HTTP",
 		"pi: Ping Loss & Latency",
 		"tr: TraceRoute",
 		"mtr: MyTraceRoute with Loss & Latency",
@@ -512,18 +1191,22 @@ func printBufLenUsage() {
 	printFlagUsage("l", "<length>",
 		"Length of buffer (in Bytes) to use (format: <num>[KB | MB | GB])",
 		"Only valid for Bandwidth tests. Max 1GB.",
+		"For HTTP, size of the payload of each request.",
+		"For UDP Packets/s tests, size of each packet, 1B by default. Packets of",
+		"at least 20B carry a sequence number and send time, so that the server",
+		"measures loss, reordering, duplicates and jitter.",
 		"Default: 16KB")
 }
 
 func printProtocolUsage() {
 	printFlagUsage("p", "<protocol>",
-		"Protocol (\"tcp\", \"udp\", \"http\", \"https\", or \"icmp\")",
+		"Protocol (\"tcp\", \"udp\", \"http\", \"https\", \"quic\", or \"icmp\")",
 		"Default: tcp")
 }
 
 func printExtProtocolUsage() {
 	printFlagUsage("p", "<protocol>",
-		"Protocol (\"tcp\", or \"icmp\")",
+		"Protocol (\"tcp\", \"http\", \"https\", or \"icmp\")",
 		"Default: tcp")
 }
 
@@ -534,6 +1217,89 @@ func printIterationUsage() {
 		"Default: 1000")
 }
 
+func printNoKeepAliveUsage() {
+	printFlagUsage("nka", "",
+		"Disable HTTP keep-alive, so that each request uses a new connection.",
+		"Only valid for HTTP and HTTPS tests.")
+}
+
+func printReverseUsage() {
+	printFlagUsage("r", "",
+		"For Bandwidth tests, send data from server to client.",
+		"For HTTP, download payloads using GET, instead of uploading using POST.")
+}
+
+func printAllowUsage() {
+	printFlagUsage("allow", "<networks>",
+		"Accept tests only from clients in the given networks, separated by",
+		"commas, or read from a file, one per line, using @<filename>.",
+		"Example: 10.1.0.0/16,192.168.1.10 or @allow.txt",
+		"Default: <empty> - Accept tests from any client")
+}
+
+func printDenyUsage() {
+	printFlagUsage("deny", "<networks>",
+		"Reject tests from clients in the given networks, in the same format",
+		"as -allow. Clients in these networks are rejected even if allowed by -allow.",
+		"Default: <empty>")
+}
+
+func printServerPSKUsage() {
+	printFlagUsage("psk", "<key>",
+		"Require clients to authenticate using the given pre-shared key.",
+		"@<filename> reads the key from a file.",
+		"Default: <empty> - No authentication")
+}
+
+func printClientPSKUsage() {
+	printFlagUsage("psk", "<key>",
+		"Authenticate with the server using the given pre-shared key.",
+		"@<filename> reads the key from a file.",
+		"Default: <empty> - No authentication")
+}
+
+func printMaxBwUsage() {
+	printFlagUsage("maxbw", "<rate>",
+		"Limit bandwidth of all tests of each client to Bits per second",
+		"(format: <num>[K | M | G]). Traffic above the limit is throttled.",
+		"Default: <empty> - Unlimited")
+}
+
+func printMaxDurationUsage() {
+	printFlagUsage("maxduration", "<duration>",
+		"Reject tests longer than the given duration (format: <num>[ms | s | m | h]),",
+		"and stop tests that run for longer.",
+		"Default: 0 - Unlimited")
+}
+
+func printMaxSessionsUsage() {
+	printFlagUsage("maxsessions", "<number>",
+		"Maximum number of clients that can run tests at the same time.",
+		"Default: 0 - Unlimited")
+}
+
+func printMaxStreamsUsage() {
+	printFlagUsage("maxstreams", "<number>",
+		"Maximum number of streams, i.e. connections or UDP flows, per client.",
+		"Default: 0 - Unlimited")
+}
+
+func printMetricsUsage() {
+	printFlagUsage("metrics", "<address>",
+		"Serve test results and network statistics in Prometheus format",
+		"over HTTP at http://<address>/metrics.",
+		"Example: :9100 or 10.1.0.4:9100",
+		"Default: <empty> - Disabled")
+}
+
+func printJSONUsage() {
+	printFlagUsage("json", "",
+		"Print results as JSON objects, one per line, to stdout.",
+		"One object is printed for each interval and one for the test summary.",
+		"Rates are per second and latencies are in nanoseconds.",
+		"All other messages are printed to stderr.")
+}
+
 func printNoConnStatUsage() {
 	printFlagUsage("ncs", "",
 		"No per Connection Stats would be printed if this flag is specified.",
@@ -543,8 +1309,28 @@ func printNoConnStatUsage() {
 
 func printIgnoreCertUsage() {
 	printFlagUsage("ic", "",
-		"Ignore Certificate is useful for HTTPS tests, for cases where a",
-		"middle box like a proxy is not able to supply a valid Ethr cert.")
+		"Ignore Certificate is useful for TLS and HTTPS tests, for cases where a",
+		"middle box like a proxy is not able to supply a valid Ethr cert, or",
+		"when the Ethr server uses a self-signed certificate.")
+}
+
+func printTLSUsage() {
+	printFlagUsage("tls", "",
+		"Use TLS for TCP Bandwidth, Connections/s and Latency tests.",
+		"For Connections/s, each connection does a full TLS handshake.",
+		"Server certificate is verified, unless -ic is specified.")
+}
+
+func printCertUsage() {
+	printFlagUsage("cert", "<filename>",
+		"PEM encoded certificate to use for TLS tests, used along with -key.",
+		"Default: <empty> - Use a self-signed certificate")
+}
+
+func printKeyUsage() {
+	printFlagUsage("key", "<filename>",
+		"PEM encoded private key of the certificate specified by -cert.",
+		"Default: <empty>")
 }
 
 func printWarmupUsage() {
@@ -564,6 +1350,126 @@ func printBwRateUsage() {
 		"Examples: 100 (100bits/s), 1M (1Mbits/s).")
 }
 
+func printBatchUsage() {
+	printFlagUsage("batch", "<number>",
+		"Number of datagrams to send in each system call for UDP Bandwidth",
+		"and Packets/s tests, using sendmmsg. Max 1024. The server always",
+		"receives datagrams in batches. Only supported on Linux.",
+		"Default: 1")
+}
+
+func printGSOUsage() {
+	printFlagUsage("gso", "",
+		"Send datagrams of UDP Bandwidth and Packets/s tests as buffers of up",
+		"to 64 datagrams, which the kernel or NIC splits (UDP GSO), and ask",
+		"the server to receive them coalesced (UDP GRO). Each system call",
+		"sends one buffer, use with -batch to send multiple buffers in each.",
+		"Only supported on Linux.")
+}
+
+func printBaselineUsage() {
+	printFlagUsage("baseline", "<filename>",
+		"Compare the results of the test with those in the given log file of an",
+		"earlier run, e.g. written with \"-o\", showing the change in bandwidth,",
+		"connections/s, packets/s and latency percentiles. Ethr exits with 2",
+		"if a result is worse than in the baseline by more than the tolerance,",
+		"or missing. Results of all destinations are summed, and averaged over",
+		"each run, leaving out the first interval of each test, so the baseline",
+		"should be a log file of its own, of a run with the same parameters.",
+		"Default: <empty> - No comparison")
+}
+
+func printCompareUsage() {
+	printFlagUsage("compare", "<filename>",
+		"Compare the results in the given log file with those of \"-baseline\",",
+		"without running a test. Used in place of \"-c\" or \"-x\".",
+		"Example: ethr -baseline before.log -compare after.log")
+}
+
+func printToleranceUsage() {
+	printFlagUsage("tolerance", "<percent>",
+		"Percentage by which results may be worse than in \"-baseline\", before",
+		"they are reported as a regression.",
+		"Default: 10")
+}
+
+func printMinBwUsage() {
+	printFlagUsage("minbw", "<rate>",
+		"Fail the run if its bandwidth, averaged over all intervals, is less",
+		"than the given rate in bits/s, e.g. 900M. This and the other",
+		"thresholds are checked at the end of the run, which shows a verdict.",
+		"Ethr then exits with 3 if a threshold is violated, with 4 if it",
+		"couldn't connect to the server, and with 5 if the server rejected it.",
+		"Default: <empty> - No threshold")
+}
+
+func printMinCpsUsage() {
+	printFlagUsage("mincps", "<number>",
+		"Fail the run if its connections/s, averaged over all intervals, is",
+		"less than the given number, e.g. 10K.",
+		"Default: <empty> - No threshold")
+}
+
+func printMaxP99Usage() {
+	printFlagUsage("maxp99", "<duration>",
+		"Fail the run if its p99 latency, averaged over all intervals, is more",
+		"than the given duration, e.g. 500us.",
+		"Default: 0 - No threshold")
+}
+
+func printMaxLossUsage() {
+	printFlagUsage("maxloss", "<percent>",
+		"Fail the run if it lost more than the given percentage of UDP packets",
+		"or of ping and UDP latency probes, e.g. 0.1.",
+		"Default: <empty> - No threshold")
+}
+
+func printScenarioUsage() {
+	printFlagUsage("scenario", "<filename>",
+		"Run the sequence of tests in the given JSON file, one after another,",
+		"and write the results of all of them to a single report. Used in place",
+		"of \"-c\" or \"-x\". Each step sets its destination, protocol, test,",
+		"fields of the client parameters, thresholds, duration and the pause",
+		"after it. Ethr exits with the exit code of the worst step.",
+		"Example: {\"Title\": \"qualification\",",
+		"          \"Defaults\": {\"Destination\": \"10.1.0.11\", \"Pause\": \"2s\"},",
+		"          \"Steps\": [{\"Name\": \"bw\", \"Test\": \"b\", \"NumThreads\": 4},",
+		"                    {\"Name\": \"pps\", \"Protocol\": \"udp\", \"Test\": \"p\"},",
+		"                    {\"Name\": \"latency\", \"Test\": \"l\", \"MaxP99\": \"1ms\"}]}")
+}
+
+func printReportUsage() {
+	printFlagUsage("report", "<filename>",
+		"Name of the JSON file that the report of \"-scenario\" is written to.",
+		"Default: "+defaultReportFileName)
+}
+
+func printBidirUsage() {
+	printFlagUsage("bidir", "",
+		"For Bandwidth tests, send data in both directions at the same time.",
+		"Uses the number of sessions specified by -n in each direction.")
+}
+
+func printCongestionControlUsage() {
+	printFlagUsage("cc", "<algorithm>", "Congestion control algorithm to use for TCP Bandwidth tests, e.g.",
+		"cubic, bbr or reno. The server uses it as well in reverse and",
+		"bidirectional modes. Multiple algorithms can be specified separated",
+		"by commas, to run the test with each of them one after another and",
+		"compare their results. Only supported on Linux.",
+		"Default: <empty> - Default algorithm of the OS")
+}
+
+func printZeroCopyUsage() {
+	printFlagUsage("zc", "<mode>", "Send and receive data of TCP Bandwidth tests without copying it",
+		"between user space and the kernel, on both client and server.",
+		"The receiver uses splice, and the sender uses the given mode:",
+		"sendfile: sendfile from a memory backed file.",
+		"msg: send with MSG_ZEROCOPY, which copies data on loopback.",
+		"CPU time of both client and server is shown with the results.",
+		"Only supported on Linux.",
+		"Default: <empty> - Copy data")
+}
+
 func printCPortUsage() {
 	printFlagUsage("cport", "<number>", "Use specified local port number in client for TCP & UDP tests.",
 		"Default: 0 - Ephemeral Port")
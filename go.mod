@@ -3,7 +3,17 @@ module github.com/microsoft/ethr
 require (
 	github.com/mattn/go-runewidth v0.0.9
 	github.com/nsf/termbox-go v0.0.0-20200418040025-38ba6e5628f1
-	golang.org/x/sys v0.0.0-20200918174421-af09f7315aff
+	github.com/quic-go/quic-go v0.54.0
+	golang.org/x/net v0.28.0
+	golang.org/x/sys v0.23.0
 )
 
-go 1.13
+require (
+	go.uber.org/mock v0.5.0 // indirect
+	golang.org/x/crypto v0.26.0 // indirect
+	golang.org/x/mod v0.18.0 // indirect
+	golang.org/x/sync v0.8.0 // indirect
+	golang.org/x/tools v0.22.0 // indirect
+)
+
+go 1.23
@@ -0,0 +1,165 @@
+//-----------------------------------------------------------------------------
+// Copyright (C) Microsoft. All rights reserved.
+// Licensed under the MIT license.
+// See LICENSE.txt file in the project root for full license information.
+//-----------------------------------------------------------------------------
+package main
+
+import (
+	"math"
+	"math/bits"
+	"time"
+)
+
+//
+// Latencies are recorded in a histogram of buckets on a log scale, similar to
+// HdrHistogram, so that memory doesn't grow with the number of samples and
+// histograms of different threads and intervals can be merged. Latencies
+// below 2^histSubBits ns have a bucket each, and above that, each power of
+// two is split into 2^histSubBits buckets, so the error of percentiles is
+// less than 1/2^histSubBits, i.e. about 1.5%. Latencies of 2^histMaxBits ns,
+// i.e. about 73 minutes, or more are recorded in the last bucket.
+//
+const (
+	histSubBits    = 6
+	histMaxBits    = 42
+	histNumBuckets = (histMaxBits - histSubBits + 1) << histSubBits
+)
+
+type ethrHistogram struct {
+	counts []uint64
+	count  uint64
+	sum    time.Duration
+	min    time.Duration
+	max    time.Duration
+}
+
+//
+// ethrHistogramBucket is a bucket with latencies from Low to High, inclusive.
+//
+type ethrHistogramBucket struct {
+	Low   time.Duration
+	High  time.Duration
+	Count uint64
+}
+
+func newHistogram() *ethrHistogram {
+	return &ethrHistogram{counts: make([]uint64, histNumBuckets)}
+}
+
+func histBucketIndex(d time.Duration) int {
+	if d < 0 {
+		d = 0
+	}
+	v := uint64(d)
+	if v >= 1<<histMaxBits {
+		return histNumBuckets - 1
+	}
+	if v < 1<<histSubBits {
+		return int(v)
+	}
+	shift := uint(bits.Len64(v)) - histSubBits - 1
+	return int((uint64(shift+1) << histSubBits) + (v >> shift) - (1 << histSubBits))
+}
+
+func histBucketRange(i int) (low, high time.Duration) {
+	if i < 1<<histSubBits {
+		return time.Duration(i), time.Duration(i)
+	}
+	shift := uint(i>>histSubBits) - 1
+	sub := uint64(i&(1<<histSubBits-1)) + 1<<histSubBits
+	low = time.Duration(sub << shift)
+	high = time.Duration(((sub + 1) << shift) - 1)
+	return
+}
+
+func (h *ethrHistogram) record(d time.Duration) {
+	if h.count == 0 || d < h.min {
+		h.min = d
+	}
+	if h.count == 0 || d > h.max {
+		h.max = d
+	}
+	h.counts[histBucketIndex(d)]++
+	h.count++
+	h.sum += d
+}
+
+func (h *ethrHistogram) merge(o *ethrHistogram) {
+	if o.count == 0 {
+		return
+	}
+	if h.count == 0 || o.min < h.min {
+		h.min = o.min
+	}
+	if h.count == 0 || o.max > h.max {
+		h.max = o.max
+	}
+	for i, c := range o.counts {
+		h.counts[i] += c
+	}
+	h.count += o.count
+	h.sum += o.sum
+}
+
+func (h *ethrHistogram) reset() {
+	for i := range h.counts {
+		h.counts[i] = 0
+	}
+	h.count, h.sum, h.min, h.max = 0, 0, 0, 0
+}
+
+func (h *ethrHistogram) avg() time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	return h.sum / time.Duration(h.count)
+}
+
+//
+// percentile returns the latency that p percent of the samples are less than
+// or equal to. It is the middle of the bucket that has the sample, which is
+// within the smallest and largest sample.
+//
+func (h *ethrHistogram) percentile(p float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(p / 100 * float64(h.count)))
+	if rank <= 1 {
+		return h.min
+	}
+	if rank >= h.count {
+		return h.max
+	}
+	seen := uint64(0)
+	for i, c := range h.counts {
+		seen += c
+		if seen >= rank {
+			low, high := histBucketRange(i)
+			d := low + (high-low)/2
+			if d < h.min {
+				d = h.min
+			}
+			if d > h.max {
+				d = h.max
+			}
+			return d
+		}
+	}
+	return h.max
+}
+
+//
+// buckets returns the buckets that have any samples, in order of latency.
+//
+func (h *ethrHistogram) buckets() []ethrHistogramBucket {
+	b := []ethrHistogramBucket{}
+	for i, c := range h.counts {
+		if c > 0 {
+			low, high := histBucketRange(i)
+			b = append(b, ethrHistogramBucket{Low: low, High: high, Count: c})
+		}
+	}
+	return b
+}
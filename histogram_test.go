@@ -0,0 +1,153 @@
+//-----------------------------------------------------------------------------
+// Copyright (C) Microsoft. All rights reserved.
+// Licensed under the MIT license.
+// See LICENSE.txt file in the project root for full license information.
+//-----------------------------------------------------------------------------
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHistBucketIndex(t *testing.T) {
+	const sub = 1 << histSubBits
+	const max = 1 << histMaxBits
+	tests := []struct {
+		name  string
+		d     time.Duration
+		index int
+	}{
+		{"negative", -1, 0},
+		{"zero", 0, 0},
+		{"one", 1, 1},
+		{"last exact", sub - 1, sub - 1},
+		{"first sub-bucket", sub, sub},
+		{"first sub-bucket edge", sub + 1, sub + 1},
+		{"end of first power", 2*sub - 1, 2*sub - 1},
+		{"second power", 2 * sub, 2 * sub},
+		{"second power, same bucket", 2*sub + 1, 2 * sub},
+		{"second power, next bucket", 2*sub + 2, 2*sub + 1},
+		{"largest trackable", max - 1, histNumBuckets - 1},
+		{"max", max, histNumBuckets - 1},
+		{"beyond max", 10 * max, histNumBuckets - 1},
+	}
+	for _, tt := range tests {
+		if i := histBucketIndex(tt.d); i != tt.index {
+			t.Errorf("%s: index of %d is %d, want %d", tt.name, tt.d, i, tt.index)
+		}
+	}
+}
+
+func TestHistBucketRange(t *testing.T) {
+	// Buckets are contiguous, and each latency falls in its own bucket.
+	prevHigh := time.Duration(-1)
+	for i := 0; i < histNumBuckets; i++ {
+		low, high := histBucketRange(i)
+		if low != prevHigh+1 || high < low {
+			t.Fatalf("bucket %d is [%d, %d], after a bucket that ends at %d", i, low, high, prevHigh)
+		}
+		if histBucketIndex(low) != i || histBucketIndex(high) != i {
+			t.Fatalf("bucket %d is [%d, %d], but these are in buckets %d and %d",
+				i, low, high, histBucketIndex(low), histBucketIndex(high))
+		}
+		// The width of a bucket is the error of the percentiles in it.
+		if float64(high-low) > float64(low)/(1<<histSubBits) {
+			t.Fatalf("bucket %d is [%d, %d], wider than the error bound", i, low, high)
+		}
+		prevHigh = high
+	}
+	if prevHigh != 1<<histMaxBits-1 {
+		t.Errorf("last bucket ends at %d, want %d", prevHigh, 1<<histMaxBits-1)
+	}
+}
+
+func TestHistogramPercentile(t *testing.T) {
+	// Latencies beyond the max are in the last bucket, so their percentiles
+	// are the middle of it.
+	low, high := histBucketRange(histNumBuckets - 1)
+	tests := []struct {
+		name    string
+		samples []time.Duration
+		p       float64
+		want    time.Duration
+	}{
+		{"empty", nil, 50, 0},
+		{"single", []time.Duration{5}, 50, 5},
+		{"exact buckets", []time.Duration{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, 50, 5},
+		{"exact buckets p90", []time.Duration{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, 90, 9},
+		{"p0 is min", []time.Duration{10, 20, 30}, 0, 10},
+		{"p100 is max", []time.Duration{10, 20, 30}, 100, 30},
+		{"zero", []time.Duration{0, 0, 0}, 50, 0},
+		{"middle of bucket", []time.Duration{1000, 1000, 1000, 2000, 5000}, 50, 1003},
+		{"beyond max", []time.Duration{100, 1 << histMaxBits, 1 << histMaxBits}, 50, low + (high-low)/2},
+	}
+	for _, tt := range tests {
+		h := newHistogram()
+		for _, d := range tt.samples {
+			h.record(d)
+		}
+		if got := h.percentile(tt.p); got != tt.want {
+			t.Errorf("%s: p%v is %d, want %d", tt.name, tt.p, got, tt.want)
+		}
+	}
+}
+
+func TestHistogramError(t *testing.T) {
+	// Percentiles are within the relative error of the bucket of the sample.
+	for _, d := range []time.Duration{63, 64, 65, 127, 128, 1000, 12345, 999999, time.Second, time.Hour} {
+		h := newHistogram()
+		h.record(0)
+		h.record(d)
+		h.record(2 * time.Duration(1<<histMaxBits))
+		got := h.percentile(50)
+		diff := got - d
+		if diff < 0 {
+			diff = -diff
+		}
+		if float64(diff) > float64(d)/(1<<histSubBits) {
+			t.Errorf("p50 of %d is %d, error is larger than 1/%d", d, got, 1<<histSubBits)
+		}
+	}
+}
+
+func TestHistogramMerge(t *testing.T) {
+	a, b, all := newHistogram(), newHistogram(), newHistogram()
+	for _, d := range []time.Duration{3, 100, 1000} {
+		a.record(d)
+		all.record(d)
+	}
+	for _, d := range []time.Duration{1, 70, 100000} {
+		b.record(d)
+		all.record(d)
+	}
+	m := newHistogram()
+	m.merge(newHistogram())
+	if m.count != 0 || m.min != 0 || m.max != 0 {
+		t.Errorf("merge of empty histograms has count %d, min %d, max %d", m.count, m.min, m.max)
+	}
+	m.merge(a)
+	m.merge(b)
+	if m.count != all.count || m.sum != all.sum || m.min != all.min || m.max != all.max {
+		t.Errorf("merged count %d, sum %d, min %d, max %d, want %d, %d, %d, %d",
+			m.count, m.sum, m.min, m.max, all.count, all.sum, all.min, all.max)
+	}
+	for _, p := range []float64{0, 50, 90, 99, 100} {
+		if m.percentile(p) != all.percentile(p) {
+			t.Errorf("merged p%v is %d, want %d", p, m.percentile(p), all.percentile(p))
+		}
+	}
+	mb, ab := m.buckets(), all.buckets()
+	if len(mb) != len(ab) {
+		t.Fatalf("merged histogram has %d buckets, want %d", len(mb), len(ab))
+	}
+	for i := range mb {
+		if mb[i] != ab[i] {
+			t.Errorf("merged bucket %d is %+v, want %+v", i, mb[i], ab[i])
+		}
+	}
+	m.reset()
+	if m.count != 0 || len(m.buckets()) != 0 || m.avg() != 0 {
+		t.Errorf("reset histogram has count %d and %d buckets", m.count, len(m.buckets()))
+	}
+}
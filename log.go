@@ -44,6 +44,7 @@ type logLatencyData struct {
 	P999       string
 	P9999      string
 	Max        string
+	Lost       string
 }
 
 type logTestResults struct {
@@ -56,6 +57,62 @@ type logTestResults struct {
 	ConnectionsPerSecond string
 	PacketsPerSecond     string
 	AverageLatency       string
+	PacketLoss           string
+	OutOfOrderPackets    string
+	DuplicatePackets     string
+	Jitter               string
+}
+
+//
+// logRunResult has the results of all destinations of the run for an
+// interval, summed, as numbers instead of the formatted strings of
+// TestResult, so that runs can be compared with a baseline. Bandwidth is in
+// bits/s.
+//
+type logRunResult struct {
+	Time                 string
+	Title                string
+	Type                 string
+	Protocol             string
+	Test                 string
+	Interval             uint64
+	BitsPerSecond        uint64
+	ConnectionsPerSecond uint64
+	PacketsPerSecond     uint64
+}
+
+//
+// logRunLatencyResult has the latency of a LatencyResult in nanoseconds.
+//
+type logRunLatencyResult struct {
+	Time       string
+	Title      string
+	Type       string
+	RemoteAddr string
+	Protocol   string
+	Count      uint64
+	Avg        time.Duration
+	P50        time.Duration
+	P90        time.Duration
+	P95        time.Duration
+	P99        time.Duration
+	P999       time.Duration
+	P9999      time.Duration
+}
+
+type logConnData struct {
+	Time             string
+	Title            string
+	Type             string
+	RemoteAddr       string
+	Protocol         string
+	ConnectionID     string
+	BitsPerSecond    string
+	Retransmits      string
+	RTT              string
+	RTTVar           string
+	CongestionWindow string
+	PacingRate       string
 }
 
 var loggingActive = false
@@ -124,12 +181,62 @@ func logResults(s []string) {
 		logData.ConnectionsPerSecond = s[3]
 		logData.PacketsPerSecond = s[4]
 		logData.AverageLatency = s[5]
+		// Loss, reordering, duplicates and jitter are only measured by the server for UDP.
+		if len(s) >= 10 {
+			logData.PacketLoss = s[6]
+			logData.OutOfOrderPackets = s[7]
+			logData.DuplicatePackets = s[8]
+			logData.Jitter = s[9]
+		}
 		logJSON, _ := json.Marshal(logData)
 		logChan <- string(logJSON)
 	}
 }
 
-func logLatency(remoteIP, proto string, avg, min, p50, p90, p95, p99, p999, p9999, max time.Duration) {
+func logRunResults(testID EthrTestID, interval, bw, cps, pps uint64) {
+	if loggingActive || gRunResults != nil {
+		logData := logRunResult{}
+		logData.Time = time.Now().UTC().Format(time.RFC3339)
+		logData.Title = ui.getTitle()
+		logData.Type = "RunResult"
+		logData.Protocol = protoToString(testID.Protocol)
+		logData.Test = testToString(testID.Type)
+		logData.Interval = interval
+		logData.BitsPerSecond = bw * 8
+		logData.ConnectionsPerSecond = cps
+		logData.PacketsPerSecond = pps
+		if gRunResults != nil {
+			gRunResults.addRunResult(&logData)
+		}
+		if !loggingActive {
+			return
+		}
+		logJSON, _ := json.Marshal(logData)
+		logChan <- string(logJSON)
+	}
+}
+
+func logConnResults(remoteIP, proto string, id uintptr, bw uint64, ti ethrTCPInfo, retrans uint64) {
+	if loggingActive {
+		logData := logConnData{}
+		logData.Time = time.Now().UTC().Format(time.RFC3339)
+		logData.Title = ui.getTitle()
+		logData.Type = "ConnectionResult"
+		logData.RemoteAddr = remoteIP
+		logData.Protocol = proto
+		logData.ConnectionID = fmt.Sprintf("%d", id)
+		logData.BitsPerSecond = bytesToRate(bw)
+		logData.Retransmits = fmt.Sprintf("%d", retrans)
+		logData.RTT = durationToString(ti.rtt)
+		logData.RTTVar = durationToString(ti.rttVar)
+		logData.CongestionWindow = fmt.Sprintf("%d", ti.cwnd)
+		logData.PacingRate = bytesToRate(ti.pacingRate)
+		logJSON, _ := json.Marshal(logData)
+		logChan <- string(logJSON)
+	}
+}
+
+func logLatency(remoteIP, proto string, h *ethrHistogram, lost uint32) {
 	if loggingActive {
 		logData := logLatencyData{}
 		logData.Time = time.Now().UTC().Format(time.RFC3339)
@@ -137,15 +244,43 @@ func logLatency(remoteIP, proto string, avg, min, p50, p90, p95, p99, p999, p999
 		logData.Type = "LatencyResult"
 		logData.RemoteAddr = remoteIP
 		logData.Protocol = proto
-		logData.Avg = durationToString(avg)
-		logData.Min = durationToString(min)
-		logData.P50 = durationToString(p50)
-		logData.P90 = durationToString(p90)
-		logData.P95 = durationToString(p95)
-		logData.P99 = durationToString(p99)
-		logData.P999 = durationToString(p999)
-		logData.P9999 = durationToString(p9999)
-		logData.Max = durationToString(max)
+		logData.Avg = durationToString(h.avg())
+		logData.Min = durationToString(h.min)
+		logData.P50 = durationToString(h.percentile(50))
+		logData.P90 = durationToString(h.percentile(90))
+		logData.P95 = durationToString(h.percentile(95))
+		logData.P99 = durationToString(h.percentile(99))
+		logData.P999 = durationToString(h.percentile(99.9))
+		logData.P9999 = durationToString(h.percentile(99.99))
+		logData.Max = durationToString(h.max)
+		logData.Lost = fmt.Sprintf("%d", lost)
+		logJSON, _ := json.Marshal(logData)
+		logChan <- string(logJSON)
+	}
+}
+
+func logRunLatency(remoteIP, proto string, h *ethrHistogram) {
+	if (loggingActive || gRunResults != nil) && h.count > 0 {
+		logData := logRunLatencyResult{}
+		logData.Time = time.Now().UTC().Format(time.RFC3339)
+		logData.Title = ui.getTitle()
+		logData.Type = "RunLatencyResult"
+		logData.RemoteAddr = remoteIP
+		logData.Protocol = proto
+		logData.Count = h.count
+		logData.Avg = h.avg()
+		logData.P50 = h.percentile(50)
+		logData.P90 = h.percentile(90)
+		logData.P95 = h.percentile(95)
+		logData.P99 = h.percentile(99)
+		logData.P999 = h.percentile(99.9)
+		logData.P9999 = h.percentile(99.99)
+		if gRunResults != nil {
+			gRunResults.addRunLatency(&logData)
+		}
+		if !loggingActive {
+			return
+		}
 		logJSON, _ := json.Marshal(logData)
 		logChan <- string(logJSON)
 	}
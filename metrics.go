@@ -0,0 +1,163 @@
+//-----------------------------------------------------------------------------
+// Copyright (C) Microsoft. All rights reserved.
+// Licensed under the MIT license.
+// See LICENSE.txt file in the project root for full license information.
+//-----------------------------------------------------------------------------
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// The server can export the results of running tests in Prometheus text
+// exposition format over HTTP. Test results are per second values that are
+// refreshed by the stats timer, so each scrape returns the results of the
+// last interval. Interface and TCP counters are read at the time of scrape.
+//
+type ethrMetricsResult struct {
+	remoteIP string
+	proto    string
+	title    string
+	bw       uint64
+	cps      uint64
+	pps      uint64
+	latency  uint64
+	bwOn     bool
+	cpsOn    bool
+	ppsOn    bool
+	latOn    bool
+}
+
+var gMetricsEnabled bool
+var gMetricsLock sync.Mutex
+var gMetricsResults []ethrMetricsResult
+var gMetricsNext []ethrMetricsResult
+
+var metricsLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func runMetricsServer(addr string) {
+	l, err := net.Listen(Tcp(), addr)
+	if err != nil {
+		ui.printErr("Failed to listen on %s for metrics. Error: %v", addr, err)
+		return
+	}
+	gMetricsEnabled = true
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", serveMetrics)
+	go http.Serve(l, mux)
+	ui.printMsg("Serving metrics on http://%s/metrics", l.Addr())
+}
+
+func metricsBegin() {
+	if !gMetricsEnabled {
+		return
+	}
+	gMetricsLock.Lock()
+	gMetricsNext = nil
+	gMetricsLock.Unlock()
+}
+
+func metricsAddResult(r ethrMetricsResult) {
+	if !gMetricsEnabled {
+		return
+	}
+	gMetricsLock.Lock()
+	gMetricsNext = append(gMetricsNext, r)
+	gMetricsLock.Unlock()
+}
+
+func metricsEnd() {
+	if !gMetricsEnabled {
+		return
+	}
+	gMetricsLock.Lock()
+	gMetricsResults = gMetricsNext
+	gMetricsNext = nil
+	gMetricsLock.Unlock()
+}
+
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	gMetricsLock.Lock()
+	results := make([]ethrMetricsResult, len(gMetricsResults))
+	copy(results, gMetricsResults)
+	gMetricsLock.Unlock()
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].remoteIP != results[j].remoteIP {
+			return results[i].remoteIP < results[j].remoteIP
+		}
+		return results[i].proto < results[j].proto
+	})
+
+	var b bytes.Buffer
+	writeMetricHdr(&b, "ethr_bandwidth_bits_per_second", "gauge", "Bandwidth measured over the last interval.")
+	for _, r := range results {
+		if r.bwOn {
+			fmt.Fprintf(&b, "ethr_bandwidth_bits_per_second{%s} %d\n", metricsTestLabels(r), r.bw*8)
+		}
+	}
+	writeMetricHdr(&b, "ethr_connections_per_second", "gauge", "Connections accepted per second over the last interval.")
+	for _, r := range results {
+		if r.cpsOn {
+			fmt.Fprintf(&b, "ethr_connections_per_second{%s} %d\n", metricsTestLabels(r), r.cps)
+		}
+	}
+	writeMetricHdr(&b, "ethr_packets_per_second", "gauge", "Packets received per second over the last interval.")
+	for _, r := range results {
+		if r.ppsOn {
+			fmt.Fprintf(&b, "ethr_packets_per_second{%s} %d\n", metricsTestLabels(r), r.pps)
+		}
+	}
+	writeMetricHdr(&b, "ethr_latency_seconds", "gauge", "Average latency of the last latency measurement.")
+	for _, r := range results {
+		if r.latOn {
+			fmt.Fprintf(&b, "ethr_latency_seconds{%s} %g\n", metricsTestLabels(r), time.Duration(r.latency).Seconds())
+		}
+	}
+
+	netStats := getNetworkStats()
+	writeMetricHdr(&b, "ethr_interface_receive_bytes_total", "counter", "Bytes received by the network interface.")
+	for _, ns := range netStats.netDevStats {
+		fmt.Fprintf(&b, "ethr_interface_receive_bytes_total{%s} %d\n", metricsInterfaceLabels(ns), ns.rxBytes)
+	}
+	writeMetricHdr(&b, "ethr_interface_transmit_bytes_total", "counter", "Bytes transmitted by the network interface.")
+	for _, ns := range netStats.netDevStats {
+		fmt.Fprintf(&b, "ethr_interface_transmit_bytes_total{%s} %d\n", metricsInterfaceLabels(ns), ns.txBytes)
+	}
+	writeMetricHdr(&b, "ethr_interface_receive_packets_total", "counter", "Packets received by the network interface.")
+	for _, ns := range netStats.netDevStats {
+		fmt.Fprintf(&b, "ethr_interface_receive_packets_total{%s} %d\n", metricsInterfaceLabels(ns), ns.rxPkts)
+	}
+	writeMetricHdr(&b, "ethr_interface_transmit_packets_total", "counter", "Packets transmitted by the network interface.")
+	for _, ns := range netStats.netDevStats {
+		fmt.Fprintf(&b, "ethr_interface_transmit_packets_total{%s} %d\n", metricsInterfaceLabels(ns), ns.txPkts)
+	}
+	writeMetricHdr(&b, "ethr_tcp_retransmitted_segments_total", "counter", "TCP segments retransmitted by the host.")
+	fmt.Fprintf(&b, "ethr_tcp_retransmitted_segments_total %d\n", netStats.tcpStats.segRetrans)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(b.Bytes())
+}
+
+func writeMetricHdr(b *bytes.Buffer, name, metricType, help string) {
+	fmt.Fprintf(b, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(b, "# TYPE %s %s\n", name, metricType)
+}
+
+func metricsTestLabels(r ethrMetricsResult) string {
+	return fmt.Sprintf("remote_ip=\"%s\",protocol=\"%s\",title=\"%s\"",
+		metricsLabelEscaper.Replace(r.remoteIP),
+		metricsLabelEscaper.Replace(r.proto),
+		metricsLabelEscaper.Replace(r.title))
+}
+
+func metricsInterfaceLabels(ns ethrNetDevStat) string {
+	return fmt.Sprintf("interface=\"%s\"", metricsLabelEscaper.Replace(ns.interfaceName))
+}
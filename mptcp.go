@@ -0,0 +1,107 @@
+//-----------------------------------------------------------------------------
+// Copyright (C) Microsoft. All rights reserved.
+// Licensed under the MIT license.
+// See LICENSE.txt file in the project root for full license information.
+//-----------------------------------------------------------------------------
+package main
+
+import (
+	"net"
+)
+
+//
+// Multipath TCP (MPTCP) spreads a TCP connection over several subflows, e.g.
+// one over each interface of a multi-homed host, which the path manager of
+// the kernel sets up once the connection is established. With "-mptcp", the
+// server listens, and the client connects, with MPTCP sockets. A connection
+// falls back to plain TCP if the other end, or a middlebox in between, does
+// not support MPTCP, so the client shows whether each connection uses it.
+// In Bandwidth tests, the client also shows each subflow of a connection
+// under the connection, with the bytes that the subflow carried, so that it
+// can be seen whether the subflows share the load. Only supported on Linux.
+//
+var gMPTCP = false
+
+//
+// ethrSubflow is the state of a subflow of an MPTCP connection. The bytes
+// sent, or received in reverse mode, and the segments retransmitted are
+// counted since the subflows were last read.
+//
+type ethrSubflow struct {
+	id         int
+	localAddr  string
+	remoteAddr string
+	bytes      uint64
+	retrans    uint64
+	ti         ethrTCPInfo
+}
+
+//
+// getSubflows reads the subflows of the MPTCP connection of a client. Each
+// subflow keeps its ID from the first time it is seen, even if subflows
+// before it go away.
+//
+func (ec *ethrConn) getSubflows() (subflows []ethrSubflow, ok bool) {
+	subflows, ok = getMPTCPSubflows(ec.conn)
+	if !ok {
+		return
+	}
+	if ec.subflows == nil {
+		ec.subflows = make(map[string]*ethrSubflow)
+	}
+	for i := range subflows {
+		sf := &subflows[i]
+		bytes := sf.ti.bytesAcked
+		if ec.reverse {
+			bytes = sf.ti.bytesReceived
+		}
+		key := sf.localAddr + "-" + sf.remoteAddr
+		last, found := ec.subflows[key]
+		if !found {
+			last = &ethrSubflow{id: len(ec.subflows) + 1}
+			ec.subflows[key] = last
+		}
+		sf.id = last.id
+		sf.bytes = bytes - last.bytes
+		sf.retrans = uint64(sf.ti.retrans) - last.retrans
+		last.bytes = bytes
+		last.retrans = uint64(sf.ti.retrans)
+	}
+	return
+}
+
+func getTCPConn(conn net.Conn) *net.TCPConn {
+	switch ct := conn.(type) {
+	case *net.TCPConn:
+		return ct
+	case *ethrTLSConn:
+		return getTCPConn(ct.rawConn)
+	case *ethrPeekConn:
+		return getTCPConn(ct.Conn)
+	}
+	return nil
+}
+
+//
+// clientPrintMPTCP shows whether a connection of a test uses MPTCP, or fell
+// back to TCP.
+//
+func clientPrintMPTCP(fd uintptr, conn net.Conn) {
+	if !gMPTCP {
+		return
+	}
+	tcpConn := getTCPConn(conn)
+	if tcpConn == nil {
+		return
+	}
+	mptcp, err := tcpConn.MultipathTCP()
+	if err != nil {
+		ui.printDbg("Failed to read MPTCP state of connection: %v", err)
+		return
+	}
+	if mptcp {
+		ui.printMsg("[%3d] using MPTCP", fd)
+	} else {
+		ui.printMsg("[%3d] not using MPTCP, fell back to TCP", fd)
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"encoding/binary"
 	"net"
 	"syscall"
+	"time"
 
 	tm "github.com/nsf/termbox-go"
 	"golang.org/x/sys/unix"
@@ -368,6 +369,12 @@ func setSockOptInt(fd uintptr, level, opt, val int) (err error) {
 	return
 }
 
+const tcpMaxSeg = syscall.TCP_MAXSEG
+
+func getSockOptInt(fd uintptr, level, opt int) (int, error) {
+	return syscall.GetsockoptInt(int(fd), level, opt)
+}
+
 func IcmpNewConn(address string) (net.PacketConn, error) {
 	dialedConn, err := net.Dial(Icmp(), address)
 	if err != nil {
@@ -400,3 +407,62 @@ func IsAdmin() bool {
 func SetTClass(fd uintptr, tos int) {
 	setSockOptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, tos)
 }
+
+// TCP connection state is only read on Linux.
+func getTCPInfo(conn net.Conn) (ti ethrTCPInfo, ok bool) {
+	return
+}
+
+// Congestion control algorithms can only be selected on Linux.
+func getCongestionControls() []string {
+	return nil
+}
+
+func setCongestionControl(conn net.Conn, cc string) error {
+	return errCongestionControlUnsupported
+}
+
+func getCongestionControl(conn net.Conn) string {
+	return ""
+}
+
+func getCPUTime() time.Duration {
+	var ru syscall.Rusage
+	err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru)
+	if err != nil {
+		return 0
+	}
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
+
+func getZeroCopyModes() []string {
+	return nil
+}
+
+func newZeroCopyDataPath(conn net.Conn, mode string, buff []byte, sender bool) (ethrDataPath, error) {
+	return nil, errZeroCopyUnsupported
+}
+
+func isUDPBatchSupported() bool {
+	return false
+}
+
+func setUDPGRO(conn *net.UDPConn) error {
+	return errUDPOffloadUnsupported
+}
+
+func udpSegmentOOB(size int) []byte {
+	return nil
+}
+
+func getUDPGROSize(oob []byte) int {
+	return 0
+}
+
+func isMPTCPSupported() bool {
+	return false
+}
+
+func getMPTCPSubflows(conn net.Conn) (subflows []ethrSubflow, ok bool) {
+	return
+}
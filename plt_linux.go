@@ -9,13 +9,18 @@ package main
 
 import (
 	"bufio"
+	"io"
+	"io/ioutil"
 	"net"
 	"os"
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
+	"unsafe"
 
 	tm "github.com/nsf/termbox-go"
+	"golang.org/x/sys/unix"
 )
 
 type ethrNetDevInfo struct {
@@ -161,6 +166,12 @@ func setSockOptInt(fd uintptr, level, opt, val int) (err error) {
 	return
 }
 
+const tcpMaxSeg = syscall.TCP_MAXSEG
+
+func getSockOptInt(fd uintptr, level, opt int) (int, error) {
+	return syscall.GetsockoptInt(int(fd), level, opt)
+}
+
 func IcmpNewConn(address string) (net.PacketConn, error) {
 	dialedConn, err := net.Dial(Icmp(), address)
 	if err != nil {
@@ -193,3 +204,481 @@ func IsAdmin() bool {
 func SetTClass(fd uintptr, tos int) {
 	setSockOptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, tos)
 }
+
+//
+// linuxTCPInfo adds the fields that newer kernels report after the fields of
+// TCPInfo in the syscall package, up to the bytes received. Older kernels report
+// fewer bytes, and the fields that are not reported remain zero.
+//
+type linuxTCPInfo struct {
+	syscall.TCPInfo
+	Pacing_rate     uint64
+	Max_pacing_rate uint64
+	Bytes_acked     uint64
+	Bytes_received  uint64
+}
+
+func getTCPInfo(conn net.Conn) (ti ethrTCPInfo, ok bool) {
+	rc := getRawConn(conn)
+	if rc == nil {
+		return
+	}
+	var info linuxTCPInfo
+	size := uint32(unsafe.Sizeof(info))
+	var errno syscall.Errno
+	err := rc.Control(func(fd uintptr) {
+		_, _, errno = unix.Syscall6(unix.SYS_GETSOCKOPT, fd, syscall.IPPROTO_TCP, syscall.TCP_INFO,
+			uintptr(unsafe.Pointer(&info)), uintptr(unsafe.Pointer(&size)), 0)
+	})
+	if err != nil || errno != 0 {
+		return
+	}
+	ti = info.toTCPInfo()
+	ok = true
+	return
+}
+
+func (info *linuxTCPInfo) toTCPInfo() (ti ethrTCPInfo) {
+	ti.rtt = time.Duration(info.Rtt) * time.Microsecond
+	ti.rttVar = time.Duration(info.Rttvar) * time.Microsecond
+	ti.cwnd = info.Snd_cwnd
+	ti.retrans = info.Total_retrans
+	ti.pacingRate = info.Pacing_rate
+	ti.bytesAcked = info.Bytes_acked
+	ti.bytesReceived = info.Bytes_received
+	return
+}
+
+//
+// getCongestionControls returns the congestion control algorithms that are
+// available in the kernel, i.e. built in or loaded as modules.
+//
+func getCongestionControls() []string {
+	data, err := ioutil.ReadFile("/proc/sys/net/ipv4/tcp_available_congestion_control")
+	if err != nil {
+		return nil
+	}
+	return strings.Fields(string(data))
+}
+
+func setCongestionControl(conn net.Conn, cc string) error {
+	rc := getRawConn(conn)
+	if rc == nil {
+		return os.ErrInvalid
+	}
+	var err error
+	cerr := rc.Control(func(fd uintptr) {
+		err = unix.SetsockoptString(int(fd), unix.IPPROTO_TCP, unix.TCP_CONGESTION, cc)
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+func getCongestionControl(conn net.Conn) (cc string) {
+	rc := getRawConn(conn)
+	if rc == nil {
+		return
+	}
+	rc.Control(func(fd uintptr) {
+		cc, _ = unix.GetsockoptString(int(fd), unix.IPPROTO_TCP, unix.TCP_CONGESTION)
+	})
+	// The name is padded with NUL bytes up to the size of the buffer.
+	return strings.TrimRight(cc, "\x00")
+}
+
+//
+// getCPUTime returns the CPU time, user and system, that Ethr used so far.
+//
+func getCPUTime() time.Duration {
+	var ru syscall.Rusage
+	err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru)
+	if err != nil {
+		return 0
+	}
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
+
+func getZeroCopyModes() []string {
+	return []string{zeroCopySendfile, zeroCopyMsg}
+}
+
+//
+// ethrZeroCopyDataPath sends data either with sendfile(2) from a memfd that
+// holds the buffer, or with MSG_ZEROCOPY, and receives data with splice(2)
+// into a pipe, which is then spliced into /dev/null.
+//
+type ethrZeroCopyDataPath struct {
+	rc       syscall.RawConn
+	fd       uintptr
+	mode     string
+	buff     []byte
+	file     *os.File
+	fileFd   int
+	pipe     [2]int
+	devNull  int
+	oob      []byte
+	sent     uint64
+	done     uint64
+	copied   uint64
+	isSender bool
+}
+
+// How long closing a MSG_ZEROCOPY data path waits for the kernel to be done
+// with the buffer of the sends that are still outstanding.
+const zeroCopyCloseTimeout = time.Second
+
+func newZeroCopyDataPath(conn net.Conn, mode string, buff []byte, sender bool) (ethrDataPath, error) {
+	rc := getRawConn(conn)
+	if rc == nil {
+		return nil, os.ErrInvalid
+	}
+	p := &ethrZeroCopyDataPath{rc: rc, fd: getFd(conn), mode: mode, buff: buff, isSender: sender}
+	p.pipe = [2]int{-1, -1}
+	p.devNull = -1
+	var err error
+	if !sender {
+		err = p.openPipe()
+	} else if mode == zeroCopySendfile {
+		err = p.openFile()
+	} else if mode == zeroCopyMsg {
+		cerr := rc.Control(func(fd uintptr) {
+			err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_ZEROCOPY, 1)
+		})
+		if cerr != nil {
+			err = cerr
+		}
+		p.oob = make([]byte, 256)
+	} else {
+		err = os.ErrInvalid
+	}
+	if err != nil {
+		p.close()
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *ethrZeroCopyDataPath) openFile() error {
+	fd, err := unix.MemfdCreate("ethr", unix.MFD_CLOEXEC)
+	if err != nil {
+		return err
+	}
+	p.file = os.NewFile(uintptr(fd), "ethr")
+	p.fileFd = fd
+	_, err = p.file.Write(p.buff)
+	return err
+}
+
+func (p *ethrZeroCopyDataPath) openPipe() error {
+	pipe := make([]int, 2)
+	err := unix.Pipe2(pipe, unix.O_CLOEXEC|unix.O_NONBLOCK)
+	if err != nil {
+		return err
+	}
+	p.pipe = [2]int{pipe[0], pipe[1]}
+	// Larger pipes move more data per splice, the default is 64KB.
+	unix.FcntlInt(uintptr(p.pipe[1]), unix.F_SETPIPE_SZ, len(p.buff))
+	p.devNull, err = unix.Open("/dev/null", unix.O_WRONLY|unix.O_CLOEXEC, 0)
+	return err
+}
+
+func (p *ethrZeroCopyDataPath) send(b []byte) (n int, err error) {
+	if p.mode == zeroCopySendfile {
+		off := int64(0)
+		werr := p.rc.Write(func(fd uintptr) bool {
+			n, err = unix.Sendfile(int(fd), p.fileFd, &off, len(b))
+			return err != unix.EAGAIN
+		})
+		if werr != nil {
+			err = werr
+		}
+		if n < 0 {
+			n = 0
+		}
+		return
+	}
+	for {
+		werr := p.rc.Write(func(fd uintptr) bool {
+			n, err = unix.SendmsgN(int(fd), b, nil, nil, unix.MSG_ZEROCOPY)
+			if err == nil {
+				p.sent++
+			}
+			// The kernel tells that it is done with the buffer of each send on
+			// the error queue, which must be drained so that sends don't fail.
+			p.reap(fd)
+			return err != unix.EAGAIN
+		})
+		if werr != nil {
+			return 0, werr
+		}
+		if err != unix.ENOBUFS {
+			break
+		}
+		// Too many sends wait for the kernel to be done with their buffers.
+		time.Sleep(time.Millisecond)
+	}
+	return
+}
+
+//
+// reap drains the notifications of MSG_ZEROCOPY sends that the kernel is done
+// with. Each notification covers a range of sends, and tells if the kernel
+// copied the data instead, e.g. on loopback or if the device can't send from
+// user memory.
+//
+func (p *ethrZeroCopyDataPath) reap(fd uintptr) {
+	var dummy [1]byte
+	for {
+		_, oobn, _, _, err := unix.Recvmsg(int(fd), dummy[:], p.oob, unix.MSG_ERRQUEUE)
+		if err != nil {
+			return
+		}
+		msgs, err := unix.ParseSocketControlMessage(p.oob[:oobn])
+		if err != nil {
+			return
+		}
+		for _, m := range msgs {
+			if !(m.Header.Level == unix.SOL_IP && m.Header.Type == unix.IP_RECVERR) &&
+				!(m.Header.Level == unix.SOL_IPV6 && m.Header.Type == unix.IPV6_RECVERR) {
+				continue
+			}
+			if len(m.Data) < int(unsafe.Sizeof(unix.SockExtendedErr{})) {
+				continue
+			}
+			ee := (*unix.SockExtendedErr)(unsafe.Pointer(&m.Data[0]))
+			if ee.Origin != unix.SO_EE_ORIGIN_ZEROCOPY {
+				continue
+			}
+			count := uint64(ee.Data-ee.Info) + 1
+			p.done += count
+			if ee.Code&unix.SO_EE_CODE_ZEROCOPY_COPIED != 0 {
+				p.copied += count
+			}
+		}
+	}
+}
+
+func (p *ethrZeroCopyDataPath) recv(b []byte) (int, error) {
+	var n int64
+	var err error
+	rerr := p.rc.Read(func(fd uintptr) bool {
+		n, err = unix.Splice(int(fd), nil, p.pipe[1], nil, len(b), unix.SPLICE_F_MOVE|unix.SPLICE_F_NONBLOCK)
+		return err != unix.EAGAIN
+	})
+	if rerr != nil {
+		return 0, rerr
+	}
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		return 0, io.EOF
+	}
+	for left := n; left > 0; {
+		m, err := unix.Splice(p.pipe[0], nil, p.devNull, nil, int(left), unix.SPLICE_F_MOVE)
+		if err != nil {
+			return int(n), err
+		}
+		left -= m
+	}
+	return int(n), nil
+}
+
+func (p *ethrZeroCopyDataPath) close() {
+	if p.mode == zeroCopyMsg && p.isSender {
+		// The kernel may still send from the buffer, so wait until it is done
+		// with all sends, which also counts all copied sends.
+		deadline := time.Now().Add(zeroCopyCloseTimeout)
+		for p.done < p.sent && time.Now().Before(deadline) {
+			cerr := p.rc.Control(func(fd uintptr) {
+				// The error queue having notifications shows as POLLERR.
+				unix.Poll([]unix.PollFd{{Fd: int32(fd)}}, 10)
+				p.reap(fd)
+			})
+			if cerr != nil {
+				break
+			}
+		}
+		if p.done < p.sent {
+			ui.printDbg("[%3d] the kernel isn't done with %d of %d MSG_ZEROCOPY sends", p.fd, p.sent-p.done, p.sent)
+		}
+		if p.copied > 0 {
+			ui.printMsg("[%3d] the kernel copied the data of %d of %d MSG_ZEROCOPY sends, which it does e.g. on loopback",
+				p.fd, p.copied, p.done)
+		}
+	}
+	if p.file != nil {
+		p.file.Close()
+	}
+	for _, fd := range []int{p.pipe[0], p.pipe[1], p.devNull} {
+		if fd >= 0 {
+			unix.Close(fd)
+		}
+	}
+}
+
+//
+// Socket options and control messages of UDP GSO and GRO, which the syscall
+// and unix packages don't define.
+//
+const (
+	solUDP     = 17
+	udpSegment = 103
+	udpGRO     = 104
+)
+
+func isUDPBatchSupported() bool {
+	return true
+}
+
+func setUDPGRO(conn *net.UDPConn) error {
+	rc := getRawConn(conn)
+	if rc == nil {
+		return os.ErrInvalid
+	}
+	var err error
+	cerr := rc.Control(func(fd uintptr) {
+		err = unix.SetsockoptInt(int(fd), solUDP, udpGRO, 1)
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+//
+// udpSegmentOOB returns the control message that sends a buffer as datagrams
+// of the given size with UDP GSO.
+//
+func udpSegmentOOB(size int) []byte {
+	b := make([]byte, unix.CmsgSpace(2))
+	h := (*unix.Cmsghdr)(unsafe.Pointer(&b[0]))
+	h.Level = solUDP
+	h.Type = udpSegment
+	h.SetLen(unix.CmsgLen(2))
+	*(*uint16)(unsafe.Pointer(&b[unix.CmsgLen(0)])) = uint16(size)
+	return b
+}
+
+//
+// getUDPGROSize returns the size of the datagrams that the kernel coalesced
+// into a buffer with UDP GRO, as told by its control message, or 0.
+//
+func getUDPGROSize(oob []byte) int {
+	if len(oob) == 0 {
+		return 0
+	}
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0
+	}
+	for _, m := range msgs {
+		if m.Header.Level == solUDP && m.Header.Type == udpGRO && len(m.Data) >= 4 {
+			return int(*(*int32)(unsafe.Pointer(&m.Data[0])))
+		}
+	}
+	return 0
+}
+
+//
+// Options of SOL_MPTCP, and the header of the data of each subflow that
+// MPTCP_TCPINFO and MPTCP_SUBFLOW_ADDRS return, which the unix package
+// doesn't define. The kernel copies as many subflows as fit in the buffer,
+// and caps the size of each to what both the kernel and the caller know.
+//
+const (
+	mptcpTCPInfo          = 2
+	mptcpSubflowAddrs     = 3
+	mptcpMaxSubflows      = 8
+	sizeofSockaddrStorage = 128
+)
+
+type mptcpSubflowData struct {
+	Size_subflow_data uint32
+	Num_subflows      uint32
+	Size_kernel       uint32
+	Size_user         uint32
+}
+
+func isMPTCPSupported() bool {
+	data, err := ioutil.ReadFile("/proc/sys/net/mptcp/enabled")
+	return err == nil && strings.TrimSpace(string(data)) == "1"
+}
+
+//
+// getMPTCPSubflows reads the state and the addresses of each subflow of an
+// MPTCP connection. It fails if the connection fell back to TCP.
+//
+func getMPTCPSubflows(conn net.Conn) (subflows []ethrSubflow, ok bool) {
+	rc := getRawConn(conn)
+	if rc == nil {
+		return
+	}
+	var infos, addrs [][]byte
+	var infosOK, addrsOK bool
+	err := rc.Control(func(fd uintptr) {
+		infos, infosOK = getMPTCPSubflowData(fd, mptcpTCPInfo, int(unsafe.Sizeof(linuxTCPInfo{})))
+		addrs, addrsOK = getMPTCPSubflowData(fd, mptcpSubflowAddrs, 2*sizeofSockaddrStorage)
+	})
+	// Subflows may come and go between the two reads, in which case the
+	// subflows are left out until the next time.
+	if err != nil || !infosOK || !addrsOK || len(infos) != len(addrs) {
+		return
+	}
+	for i := range infos {
+		var info linuxTCPInfo
+		copy((*[unsafe.Sizeof(info)]byte)(unsafe.Pointer(&info))[:], infos[i])
+		if len(addrs[i]) < 2*sizeofSockaddrStorage {
+			return nil, false
+		}
+		subflows = append(subflows, ethrSubflow{
+			localAddr:  sockaddrToString(addrs[i][:sizeofSockaddrStorage]),
+			remoteAddr: sockaddrToString(addrs[i][sizeofSockaddrStorage:]),
+			ti:         info.toTCPInfo(),
+		})
+	}
+	ok = true
+	return
+}
+
+func getMPTCPSubflowData(fd uintptr, opt, size int) (elems [][]byte, ok bool) {
+	hdrSize := int(unsafe.Sizeof(mptcpSubflowData{}))
+	b := make([]byte, hdrSize+mptcpMaxSubflows*size)
+	hdr := (*mptcpSubflowData)(unsafe.Pointer(&b[0]))
+	hdr.Size_subflow_data = uint32(hdrSize)
+	hdr.Size_user = uint32(size)
+	optLen := uint32(len(b))
+	_, _, errno := unix.Syscall6(unix.SYS_GETSOCKOPT, fd, unix.SOL_MPTCP, uintptr(opt),
+		uintptr(unsafe.Pointer(&b[0])), uintptr(unsafe.Pointer(&optLen)), 0)
+	if errno != 0 {
+		return
+	}
+	n := int(hdr.Num_subflows)
+	if n > mptcpMaxSubflows {
+		n = mptcpMaxSubflows
+	}
+	stride := int(hdr.Size_user)
+	for i := 0; i < n; i++ {
+		off := hdrSize + i*stride
+		if off+stride > int(optLen) {
+			break
+		}
+		elems = append(elems, b[off:off+stride])
+	}
+	ok = true
+	return
+}
+
+func sockaddrToString(b []byte) string {
+	sa := (*unix.RawSockaddr)(unsafe.Pointer(&b[0]))
+	port := strconv.Itoa(int(b[2])<<8 | int(b[3]))
+	switch sa.Family {
+	case unix.AF_INET:
+		return net.JoinHostPort(net.IP(b[4:8]).String(), port)
+	case unix.AF_INET6:
+		return net.JoinHostPort(net.IP(b[8:24]).String(), port)
+	}
+	return ""
+}
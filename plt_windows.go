@@ -13,6 +13,7 @@ import (
 	"os"
 	"strings"
 	"syscall"
+	"time"
 	"unsafe"
 
 	tm "github.com/nsf/termbox-go"
@@ -217,6 +218,16 @@ func setSockOptInt(fd uintptr, level, opt, val int) (err error) {
 	return
 }
 
+// TCP_MAXSEG of ws2ipdef.h, which is not in the syscall package.
+const tcpMaxSeg = 4
+
+func getSockOptInt(fd uintptr, level, opt int) (int, error) {
+	var val int32
+	size := int32(unsafe.Sizeof(val))
+	err := syscall.Getsockopt(syscall.Handle(fd), int32(level), int32(opt), (*byte)(unsafe.Pointer(&val)), &size)
+	return int(val), err
+}
+
 const (
 	SIO_RCVALL             = syscall.IOC_IN | syscall.IOC_VENDOR | 1
 	RCVALL_OFF             = 0
@@ -291,3 +302,71 @@ func IsAdmin() bool {
 func SetTClass(fd uintptr, tos int) {
 	return
 }
+
+// TCP connection state is only read on Linux.
+func getTCPInfo(conn net.Conn) (ti ethrTCPInfo, ok bool) {
+	return
+}
+
+// Congestion control algorithms can only be selected on Linux.
+func getCongestionControls() []string {
+	return nil
+}
+
+func setCongestionControl(conn net.Conn, cc string) error {
+	return errCongestionControlUnsupported
+}
+
+func getCongestionControl(conn net.Conn) string {
+	return ""
+}
+
+func getCPUTime() time.Duration {
+	var creation, exit, kernel, user syscall.Filetime
+	h, err := syscall.GetCurrentProcess()
+	if err != nil {
+		return 0
+	}
+	err = syscall.GetProcessTimes(h, &creation, &exit, &kernel, &user)
+	if err != nil {
+		return 0
+	}
+	return filetimeToDuration(kernel) + filetimeToDuration(user)
+}
+
+func filetimeToDuration(ft syscall.Filetime) time.Duration {
+	// Process times are in units of 100ns.
+	return time.Duration((uint64(ft.HighDateTime)<<32 | uint64(ft.LowDateTime)) * 100)
+}
+
+func getZeroCopyModes() []string {
+	return nil
+}
+
+func newZeroCopyDataPath(conn net.Conn, mode string, buff []byte, sender bool) (ethrDataPath, error) {
+	return nil, errZeroCopyUnsupported
+}
+
+func isUDPBatchSupported() bool {
+	return false
+}
+
+func setUDPGRO(conn *net.UDPConn) error {
+	return errUDPOffloadUnsupported
+}
+
+func udpSegmentOOB(size int) []byte {
+	return nil
+}
+
+func getUDPGROSize(oob []byte) int {
+	return 0
+}
+
+func isMPTCPSupported() bool {
+	return false
+}
+
+func getMPTCPSubflows(conn net.Conn) (subflows []ethrSubflow, ok bool) {
+	return
+}
@@ -0,0 +1,241 @@
+//-----------------------------------------------------------------------------
+// Copyright (C) Microsoft. All rights reserved.
+// Licensed under the MIT license.
+// See LICENSE.txt file in the project root for full license information.
+//-----------------------------------------------------------------------------
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+//
+// The server can limit the clients that run tests at the same time, and the
+// streams, duration and bandwidth of tests of each client, so that a shared
+// server isn't monopolized by a single client.
+//
+// Limits that apply to a single test are advertised in the ACK message, and
+// the SYN message of a test that exceeds them is rejected with the reason.
+// The server also enforces the limits on the traffic of tests, as clients
+// that don't do a handshake, e.g. older versions of Ethr, don't check them.
+// A client is counted as running tests while it has a session, a stream or a
+// UDP test open. Each TCP connection of a client is counted as a stream, and
+// UDP flows of a client are limited to the same number on their own, as UDP
+// tests have no connections. Bandwidth above the limit is throttled, by
+// slowing down TCP and HTTP streams and by dropping UDP packets.
+//
+
+// Streams are opened, and closed, a little after the test starts and ends on
+// the client, so these can run this much longer than the maximum duration.
+const policyDurationGrace = 2 * time.Second
+
+// Bandwidth can be above the limit for this long, e.g. after streams were idle,
+// or slept for longer than needed. UDP packets beyond it are dropped.
+const policyBwBurst = 100 * time.Millisecond
+
+var gMaxSessions uint32
+
+type ethrClientUsage struct {
+	refs    uint32
+	streams uint32
+}
+
+var gClientUsageLock sync.Mutex
+var gClientUsage = make(map[string]*ethrClientUsage)
+
+func initServerPolicy(serverParam ethrServerParam) {
+	gMaxSessions = serverParam.maxSessions
+	gServerLimits.MaxStreams = serverParam.maxStreams
+	gServerLimits.MaxDuration = serverParam.maxDuration
+	gServerLimits.MaxBandwidth = serverParam.maxBandwidth
+}
+
+func getNumStreams(clientParam EthrClientParam) uint32 {
+	if clientParam.Bidirectional {
+		return clientParam.NumThreads * 2
+	}
+	return clientParam.NumThreads
+}
+
+//
+// srvrCheckPolicy checks the parameters of a test in the SYN message of the
+// client against the limits of the server.
+//
+func srvrCheckPolicy(clientParam EthrClientParam) error {
+	maxDuration := gServerLimits.MaxDuration
+	if maxDuration > 0 && clientParam.Duration == 0 {
+		return fmt.Errorf("tests that run forever are not allowed by the server, the longest allowed is %v", maxDuration)
+	}
+	if maxDuration > 0 && clientParam.Duration > maxDuration {
+		return fmt.Errorf("test duration of %v is longer than %v, the longest allowed by the server",
+			clientParam.Duration, maxDuration)
+	}
+	streams := getNumStreams(clientParam)
+	if gServerLimits.MaxStreams > 0 && streams > gServerLimits.MaxStreams {
+		return fmt.Errorf("%d streams are more than %d, the most allowed per client by the server",
+			streams, gServerLimits.MaxStreams)
+	}
+	return nil
+}
+
+//
+// srvrCheckDuration checks that the test hasn't run for longer than allowed,
+// for new connections and packets of a test that has started.
+//
+func srvrCheckDuration(test *ethrTest) error {
+	maxDuration := gServerLimits.MaxDuration
+	if maxDuration > 0 && time.Since(test.startTime) > maxDuration+policyDurationGrace {
+		return fmt.Errorf("test ran for longer than %v, the longest allowed by the server", maxDuration)
+	}
+	return nil
+}
+
+//
+// srvrRejectConn tells the client why the connection is rejected, if it did a
+// handshake, otherwise the connection is just closed.
+//
+func srvrRejectConn(server string, conn net.Conn, ethrMsg *EthrMsg, err error) {
+	if ethrMsg.Type == EthrSyn {
+		srvrRejectClient(server, conn, ethrMsg.Version, err)
+	} else {
+		srvrLogRejected(server, err)
+	}
+}
+
+//
+// srvrSetStreamDeadline closes the stream once it runs for longer than the
+// maximum duration of a test.
+//
+func srvrSetStreamDeadline(conn net.Conn) {
+	if gServerLimits.MaxDuration > 0 {
+		conn.SetDeadline(time.Now().Add(gServerLimits.MaxDuration + policyDurationGrace))
+	}
+}
+
+//
+// srvrAdmitClient counts the client as running tests, unless the server is
+// already running tests of as many clients as allowed. srvrAdmitStream also
+// counts a new stream of the client. Each of these is undone by the release
+// function of the same name, once the session or stream is closed.
+//
+func srvrAdmitClient(ip net.IP) error {
+	return srvrAdmit(ip.String(), false)
+}
+
+func srvrAdmitStream(ip net.IP) error {
+	return srvrAdmit(ip.String(), true)
+}
+
+func srvrReleaseClient(ip net.IP) {
+	srvrRelease(ip.String(), false)
+}
+
+func srvrReleaseStream(ip net.IP) {
+	srvrRelease(ip.String(), true)
+}
+
+func srvrAdmit(key string, isStream bool) error {
+	gClientUsageLock.Lock()
+	defer gClientUsageLock.Unlock()
+	usage, found := gClientUsage[key]
+	if !found {
+		if gMaxSessions > 0 && uint32(len(gClientUsage)) >= gMaxSessions {
+			return fmt.Errorf("server is running tests of %d clients, the most allowed, try again later", gMaxSessions)
+		}
+		usage = &ethrClientUsage{}
+	}
+	if isStream {
+		if gServerLimits.MaxStreams > 0 && usage.streams >= gServerLimits.MaxStreams {
+			return fmt.Errorf("client has %d streams open, the most allowed per client by the server", usage.streams)
+		}
+		usage.streams++
+	}
+	usage.refs++
+	gClientUsage[key] = usage
+	return nil
+}
+
+func srvrRelease(key string, isStream bool) {
+	gClientUsageLock.Lock()
+	defer gClientUsageLock.Unlock()
+	usage, found := gClientUsage[key]
+	if !found {
+		return
+	}
+	if isStream {
+		usage.streams--
+	}
+	usage.refs--
+	if usage.refs == 0 {
+		delete(gClientUsage, key)
+	}
+}
+
+//
+// ethrBwLimiter limits the bandwidth of all tests of a client. It is shared by
+// the tests in the session of the client, and a nil limiter doesn't limit.
+//
+type ethrBwLimiter struct {
+	lock sync.Mutex
+	rate uint64
+	next time.Time
+}
+
+func srvrNewBwLimiter() *ethrBwLimiter {
+	if gServerLimits.MaxBandwidth == 0 {
+		return nil
+	}
+	return &ethrBwLimiter{rate: gServerLimits.MaxBandwidth}
+}
+
+//
+// reserve accounts for n bytes, and returns how long to wait until the bytes
+// sent so far are within the rate. If that is longer than maxWait, the bytes
+// are not accounted for.
+//
+func (l *ethrBwLimiter) reserve(n int, maxWait time.Duration) (wait time.Duration, ok bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := time.Now()
+	if l.next.Before(now.Add(-policyBwBurst)) {
+		l.next = now.Add(-policyBwBurst)
+	}
+	next := l.next.Add(time.Duration(uint64(n) * uint64(time.Second) / l.rate))
+	wait = next.Sub(now)
+	if wait > maxWait {
+		return wait, false
+	}
+	l.next = next
+	return wait, true
+}
+
+//
+// wait blocks until n bytes, that were just sent or received, are within the
+// rate. Blocking the sender or receiver of a TCP stream slows down the peer
+// as well, due to flow control.
+//
+func (l *ethrBwLimiter) wait(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+	wait, _ := l.reserve(n, math.MaxInt64)
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+//
+// allow returns whether a packet of n bytes is within the rate, for UDP tests
+// where packets beyond the rate can only be dropped.
+//
+func (l *ethrBwLimiter) allow(n int) bool {
+	if l == nil {
+		return true
+	}
+	_, ok := l.reserve(n, 0)
+	return ok
+}
@@ -0,0 +1,419 @@
+//-----------------------------------------------------------------------------
+// Copyright (C) Microsoft. All rights reserved.
+// Licensed under the MIT license.
+// See LICENSE.txt file in the project root for full license information.
+//-----------------------------------------------------------------------------
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+//
+// QUIC tests run over QUIC connections to the server, which listens on the
+// UDP port after the port of TCP & UDP tests, as UDP tests already use that
+// port. Each stream of a test starts with the same SYN and ACK messages as a
+// TCP connection, after which Bandwidth and Latency tests run on the stream
+// the same as on a TCP connection. Bandwidth tests use a single connection
+// with a stream for each session given by -n, and Connections/s tests open a
+// new connection for each handshake. The client doesn't keep session tickets,
+// so every handshake is a full QUIC and TLS handshake. The session of the
+// client and the results exchange run over TCP, same as for UDP tests.
+//
+const (
+	quicALPN               = "ethr"
+	quicMaxIncomingStreams = 4096
+)
+
+// Application error codes that QUIC connections are closed with.
+const (
+	quicErrNone     quic.ApplicationErrorCode = 0
+	quicErrRejected quic.ApplicationErrorCode = 1
+)
+
+func getQUICPortStr() string {
+	return strconv.Itoa(int(gEthrPort) + 1)
+}
+
+func newQUICConfig() *quic.Config {
+	return &quic.Config{
+		HandshakeIdleTimeout: handshakeTimeout,
+		MaxIncomingStreams:   quicMaxIncomingStreams,
+	}
+}
+
+//
+// ethrQUICConn is a QUIC connection of the client, along with the UDP socket
+// that it uses, which is not shared with other connections.
+//
+type ethrQUICConn struct {
+	*quic.Conn
+	pc net.PacketConn
+}
+
+func (qc *ethrQUICConn) close() {
+	qc.CloseWithError(quicErrNone, "")
+	qc.pc.Close()
+}
+
+//
+// ethrQUICStream lets a QUIC stream be used as a net.Conn, so that it can run
+// the same as a TCP connection. Closing the stream also closes its
+// connection, if the connection only carries this stream.
+//
+type ethrQUICStream struct {
+	*quic.Stream
+	conn    *quic.Conn
+	ownConn *ethrQUICConn
+}
+
+func (s *ethrQUICStream) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+func (s *ethrQUICStream) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+func (s *ethrQUICStream) Close() error {
+	s.CancelRead(0)
+	err := s.Stream.Close()
+	if s.ownConn != nil {
+		s.ownConn.close()
+	}
+	return err
+}
+
+//
+// quicDial connects a new QUIC connection to the server, from a new UDP socket
+// that is bound to the local IP address, if given.
+//
+func quicDial(test *ethrTest) (*ethrQUICConn, error) {
+	la, err := net.ResolveUDPAddr(Udp(), net.JoinHostPort(gLocalIP, "0"))
+	if err != nil {
+		return nil, err
+	}
+	ra, err := net.ResolveUDPAddr(Udp(), test.quicAddr)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := net.ListenUDP(Udp(), la)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := pc.SyscallConn()
+	if err == nil {
+		rc.Control(func(fd uintptr) {
+			ethrSetTOS(fd, int(gTOS))
+		})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), handshakeTimeout)
+	defer cancel()
+	conn, err := quic.Dial(ctx, pc, ra, test.tlsConfig, newQUICConfig())
+	recordDial(test.quicAddr, err)
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	return &ethrQUICConn{conn, pc}, nil
+}
+
+func quicOpenStream(qc *ethrQUICConn) (*ethrQUICStream, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), handshakeTimeout)
+	defer cancel()
+	stream, err := qc.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &ethrQUICStream{Stream: stream, conn: qc.Conn}, nil
+}
+
+//
+// quicDialStream connects a new QUIC connection to the server, with a single
+// stream, which closes the connection when it is closed.
+//
+func quicDialStream(test *ethrTest) (net.Conn, error) {
+	qc, err := quicDial(test)
+	if err != nil {
+		return nil, err
+	}
+	s, err := quicOpenStream(qc)
+	if err != nil {
+		qc.close()
+		return nil, err
+	}
+	s.ownConn = qc
+	return s, nil
+}
+
+func quicRunBandwidthTest(test *ethrTest, toStop chan int) {
+	qc, err := quicDial(test)
+	if err != nil {
+		ui.printErr("Error dialing QUIC connection: %v", err)
+		toStop <- disconnect
+		return
+	}
+	atomic.AddUint64(&test.testResult.totalCps, 1)
+	//
+	// In bidirectional mode, the first half of streams send data to the server
+	// and the second half receive data from it, same as TCP connections.
+	//
+	numStreams := test.clientParam.NumThreads
+	if test.clientParam.Bidirectional {
+		numStreams *= 2
+	}
+	var wg sync.WaitGroup
+	for th := uint32(0); th < numStreams; th++ {
+		clientParam := test.clientParam
+		if clientParam.Bidirectional {
+			clientParam.Reverse = th >= test.clientParam.NumThreads
+		}
+		s, err := quicOpenStream(qc)
+		if err != nil {
+			ui.printErr("Error opening QUIC stream: %v", err)
+			break
+		}
+		ack, err := handshakeWithServer(test, s, test.testID, clientParam)
+		if err != nil {
+			ui.printErr("Failed in handshake with the server. Error: %v", err)
+			s.Close()
+			continue
+		}
+		wg.Add(1)
+		go runTCPBandwidthTestHandler(test, s, clientParam.Reverse, ack, &wg)
+	}
+	// The connection is closed before the test is done, so that the server
+	// stops counting data of the test before the results are exchanged.
+	test.wg.Add(1)
+	go func() {
+		defer test.wg.Done()
+		wg.Wait()
+		qc.close()
+		toStop <- disconnect
+	}()
+}
+
+func quicRunCpsTest(test *ethrTest) {
+	for th := uint32(0); th < test.clientParam.NumThreads; th++ {
+		test.wg.Add(1)
+		go func() {
+			defer test.wg.Done()
+		ExitForLoop:
+			for {
+				select {
+				case <-test.done:
+					break ExitForLoop
+				default:
+					qc, err := quicDial(test)
+					if err != nil {
+						ui.printDbg("Unable to dial QUIC connection to %s, error: %v", test.quicAddr, err)
+						continue
+					}
+					atomic.AddUint64(&test.testResult.cps, 1)
+					atomic.AddUint64(&test.testResult.totalCps, 1)
+					qc.close()
+				}
+			}
+		}()
+	}
+}
+
+//
+// srvrGetQUICTLSConfig returns the TLS config of QUIC connections, which is
+// only created once the first client connects, same as for TLS tests.
+//
+func srvrGetQUICTLSConfig() *tls.Config {
+	return &tls.Config{
+		NextProtos: []string{quicALPN},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			tlsConfig := srvrGetTLSConfig()
+			if tlsConfig == nil {
+				return nil, errQUICNoCertificate
+			}
+			tlsConfig = tlsConfig.Clone()
+			tlsConfig.NextProtos = []string{quicALPN}
+			return tlsConfig, nil
+		},
+	}
+}
+
+//
+// srvrRunQUICServer listens for QUIC connections. If it can't, QUIC tests are
+// not advertised to clients.
+//
+func srvrRunQUICServer() error {
+	l, err := srvrListenQUIC()
+	if err != nil {
+		ui.printErr("Error listening on %s for QUIC tests: %v", getQUICPortStr(), err)
+		tests := []EthrTestID{}
+		for _, t := range gServerTests {
+			if t.Protocol != QUIC {
+				tests = append(tests, t)
+			}
+		}
+		gServerTests = tests
+		return err
+	}
+	go srvrAcceptQUICConns(l)
+	return nil
+}
+
+func srvrListenQUIC() (*quic.Listener, error) {
+	udpAddr, err := net.ResolveUDPAddr(Udp(), net.JoinHostPort(gLocalIP, getQUICPortStr()))
+	if err != nil {
+		return nil, err
+	}
+	pc, err := net.ListenUDP(Udp(), udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	l, err := quic.Listen(pc, srvrGetQUICTLSConfig(), newQUICConfig())
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func srvrAcceptQUICConns(l *quic.Listener) {
+	for {
+		conn, err := l.Accept(context.Background())
+		if err != nil {
+			ui.printErr("Error accepting new QUIC connection: %v", err)
+			return
+		}
+		go srvrHandleQUICConn(conn)
+	}
+}
+
+//
+// srvrHandleQUICConn runs the streams of a QUIC connection. Each connection is
+// counted, the same as TCP connections, so Connections/s tests count the
+// handshakes that completed.
+//
+func srvrHandleQUICConn(conn *quic.Conn) {
+	server, port, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		ui.printDbg("RemoteAddr: Split host port failed: %v", err)
+		conn.CloseWithError(quicErrNone, "")
+		return
+	}
+	ui.printDbg("New QUIC connection from %v, port %v", server, port)
+	err = srvrCheckClient(parseClientIP(server))
+	if err != nil {
+		srvrLogRejected(server, err)
+		conn.CloseWithError(quicErrRejected, err.Error())
+		return
+	}
+	test, isNew := createOrGetTest(server, QUIC, All)
+	if test == nil {
+		conn.CloseWithError(quicErrNone, "")
+		return
+	}
+	if isNew {
+		ui.emitTestHdr()
+	}
+	// Same deferred deletion as TCP connections, see srvrHandleNewTcpConn. The
+	// latency stream has a connection of its own, which doesn't exchange results.
+	noResults := uint32(0)
+	defer func() {
+		srvrDeleteTest(test, atomic.LoadUint32(&noResults) == 0)
+	}()
+	atomic.AddUint64(&test.testResult.cps, 1)
+	if atomic.AddUint64(&test.testResult.totalCps, 1) == 1 {
+		test.startTime = time.Now()
+		test.startCPUTime()
+	}
+	test.lastAccess = time.Now()
+	err = srvrCheckDuration(test)
+	if err != nil {
+		srvrLogRejected(server, err)
+		conn.CloseWithError(quicErrRejected, err.Error())
+		return
+	}
+	var wg sync.WaitGroup
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			testID := srvrHandleQUICStream(server, test, &ethrQUICStream{Stream: stream, conn: conn})
+			if testID.Type == Latency {
+				atomic.StoreUint32(&noResults, 1)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func srvrHandleQUICStream(server string, test *ethrTest, conn *ethrQUICStream) (testID EthrTestID) {
+	defer conn.Close()
+	ethrMsg := recvSessionMsg(conn)
+	if ethrMsg.Type != EthrSyn || ethrMsg.Syn == nil {
+		ui.printDbg("Failed to receive SYN message from client.")
+		return
+	}
+	ethrMsg, err := srvrAuthorizeClient(server, conn, ethrMsg)
+	if err != nil {
+		ui.printDbg("Failed in handshake with the client. Error: %v", err)
+		return
+	}
+	err = srvrCheckSyn(server, conn, ethrMsg)
+	if err != nil {
+		return
+	}
+	ip := parseClientIP(server)
+	err = srvrAdmitStream(ip)
+	if err != nil {
+		srvrRejectConn(server, conn, ethrMsg, err)
+		return
+	}
+	defer srvrReleaseStream(ip)
+	srvrSetStreamDeadline(conn)
+	testID, clientParam, err := handshakeWithClient(test, conn, ethrMsg)
+	if err != nil {
+		ui.printDbg("Failed in handshake with the client. Error: %v", err)
+		return
+	}
+	if testID.Protocol != QUIC {
+		return
+	}
+	if testID.Type == Bandwidth {
+		srvrRunTCPBandwidthTest(test, clientParam, conn)
+	} else if testID.Type == Latency {
+		ui.emitLatencyHdr()
+		srvrRunTCPLatencyTest(test, clientParam, conn)
+	}
+	return
+}
+
+//
+// srvrWaitQUICStreams waits for the streams of a QUIC test to end, as the
+// client closes its connection right before it asks for the results, and the
+// streams may still count data that was received before. It waits for a
+// second at most, in case the close of the connection got lost.
+//
+func srvrWaitQUICStreams(test *ethrTest) {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		n := 0
+		test.connListDo(func(*ethrConn) {
+			n++
+		})
+		if n == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,481 @@
+//-----------------------------------------------------------------------------
+// Copyright (C) Microsoft. All rights reserved.
+// Licensed under the MIT license.
+// See LICENSE.txt file in the project root for full license information.
+//-----------------------------------------------------------------------------
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"runtime"
+	"sync"
+	"syscall"
+	"time"
+)
+
+//
+// A scenario is a sequence of tests that the client runs one after another,
+// e.g. the standard qualification of a network, given in a JSON file with a
+// title, the defaults of all steps and the steps themselves. Each step sets
+// its own destination, protocol, test, parameters, thresholds, and the pause
+// after it. Fields of a step are named after those of EthrClientParam, sizes
+// and rates take units, e.g. "16KB" or "1G", and durations are strings, e.g.
+// "10s". Fields that a step doesn't set are taken from the defaults of the
+// scenario, or else have the default values of the flags. Options that aren't
+// tied to a test, e.g. -4, -port, -psk or -json, apply to all steps. The
+// results of all steps are written to a single report, along with the verdict
+// of each step, and Ethr exits with the exit code of the worst verdict.
+//
+type ethrScenarioStep struct {
+	Name              string
+	Destination       string
+	External          bool
+	Protocol          string
+	Test              string
+	Duration          string
+	Pause             string
+	NumThreads        int
+	BufferSize        string
+	RttCount          int
+	Reverse           bool
+	Gap               string
+	WarmupCount       int
+	BwRate            string
+	ToS               uint8
+	Bidirectional     bool
+	CongestionControl string
+	SendBufferSize    string
+	RecvBufferSize    string
+	MSS               int
+	Nagle             bool
+	ZeroCopy          string
+	Batch             int
+	UDPOffload        bool
+	TLS               bool
+	MinBw             string
+	MinCps            string
+	MaxP99            string
+	MaxLoss           string
+}
+
+type ethrScenario struct {
+	Title    string
+	Defaults json.RawMessage
+	Steps    []json.RawMessage
+}
+
+var defaultScenarioStep = ethrScenarioStep{
+	Protocol:    "tcp",
+	Duration:    "10s",
+	Gap:         "1s",
+	NumThreads:  1,
+	RttCount:    1000,
+	WarmupCount: 1,
+	Batch:       1,
+}
+
+//
+// ethrScenarioTest is a step of a scenario, with its parameters checked and
+// converted the same way as those given by flags.
+//
+type ethrScenarioTest struct {
+	step         ethrScenarioStep
+	testID       EthrTestID
+	clientParam  EthrClientParam
+	destinations []string
+	ccs          []string
+	thresholds   ethrThresholds
+	pause        time.Duration
+}
+
+type jsonScenarioReport struct {
+	Title     string
+	Scenario  string
+	StartTime string
+	EndTime   string
+	Verdict   string
+	ExitCode  int
+	Steps     []*jsonScenarioStep
+}
+
+type jsonScenarioStep struct {
+	Name         string
+	Destinations []string
+	Protocol     string
+	Test         string
+	StartTime    string
+	Params       EthrClientParam
+	Results      jsonScenarioResults
+	Summaries    []jsonDestinationSummary
+	Verdict      string
+	ExitCode     int
+}
+
+//
+// jsonScenarioResults has the results of a step, averaged over its intervals,
+// and the share of its packets or probes that were lost, in percent.
+//
+type jsonScenarioResults struct {
+	BitsPerSecond        uint64               `json:",omitempty"`
+	ConnectionsPerSecond uint64               `json:",omitempty"`
+	PacketsPerSecond     uint64               `json:",omitempty"`
+	Latency              *jsonScenarioLatency `json:",omitempty"`
+	PacketLoss           *float64             `json:",omitempty"`
+}
+
+type jsonScenarioLatency struct {
+	Avg   time.Duration
+	P50   time.Duration
+	P90   time.Duration
+	P95   time.Duration
+	P99   time.Duration
+	P999  time.Duration
+	P9999 time.Duration
+}
+
+// Step of the scenario that is running, which gets the summaries of its tests.
+var gScenarioStep *jsonScenarioStep
+var gScenarioLock sync.Mutex
+
+func scenarioAddSummary(test *ethrTest, clientFin, serverFin *EthrMsgFin) {
+	gScenarioLock.Lock()
+	defer gScenarioLock.Unlock()
+	if gScenarioStep == nil {
+		return
+	}
+	gScenarioStep.Summaries = append(gScenarioStep.Summaries, jsonDestinationSummary{
+		RemoteAddr:        test.session.remoteIP,
+		CongestionControl: test.clientParam.CongestionControl,
+		Client:            newJSONEndpointSummary(clientFin),
+		Server:            newJSONEndpointSummary(serverFin),
+	})
+}
+
+func setScenarioStep(s *jsonScenarioStep) {
+	gScenarioLock.Lock()
+	gScenarioStep = s
+	gScenarioLock.Unlock()
+}
+
+func scenarioError(format string, a ...interface{}) {
+	fmt.Printf("Error: "+format+"\n", a...)
+	os.Exit(1)
+}
+
+//
+// loadScenario reads a scenario from its file and checks all of its steps, so
+// that errors are found before any test runs.
+//
+func loadScenario(fileName string) (title string, tests []*ethrScenarioTest) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		scenarioError("unable to read scenario %s: %v", fileName, err)
+	}
+	var scenario ethrScenario
+	err = decodeScenarioJSON(data, &scenario)
+	if err != nil {
+		scenarioError("invalid scenario %s: %v", fileName, err)
+	}
+	if len(scenario.Steps) == 0 {
+		scenarioError("invalid scenario %s: no steps", fileName)
+	}
+	defaults := defaultScenarioStep
+	if len(scenario.Defaults) > 0 {
+		err = decodeScenarioJSON(scenario.Defaults, &defaults)
+		if err != nil {
+			scenarioError("invalid defaults in scenario %s: %v", fileName, err)
+		}
+	}
+	for i, raw := range scenario.Steps {
+		step := defaults
+		step.Name = ""
+		err = decodeScenarioJSON(raw, &step)
+		if err != nil {
+			scenarioError("invalid step %d in scenario %s: %v", i+1, fileName, err)
+		}
+		if step.Name == "" {
+			step.Name = fmt.Sprintf("Step %d", i+1)
+		}
+		tests = append(tests, newScenarioTest(step))
+	}
+	return scenario.Title, tests
+}
+
+//
+// Unknown fields are rejected, so that typos in a scenario are not silently
+// ignored.
+//
+func decodeScenarioJSON(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
+
+func parseScenarioDuration(step ethrScenarioStep, field, s string) time.Duration {
+	if s == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		scenarioError("invalid %s in step \"%s\": %s", field, step.Name, s)
+	}
+	return d
+}
+
+func newScenarioTest(step ethrScenarioStep) *ethrScenarioTest {
+	t := &ethrScenarioTest{step: step}
+	mode := ethrClientMode{external: step.External, tls: step.TLS}
+	if step.Destination == "" {
+		scenarioError("no destination in step \"%s\"", step.Name)
+	}
+	t.destinations = getDestinations(step.Destination)
+	testType := getTestType(step.Test, mode)
+	t.testID = EthrTestID{getProtocol(step.Protocol), testType}
+
+	bufLenStr := step.BufferSize
+	if bufLenStr == "" {
+		bufLenStr = getDefaultBufferLenStr(step.Test)
+	}
+	bufLen := unitToNumber(bufLenStr)
+	if bufLen == 0 {
+		scenarioError("invalid BufferSize in step \"%s\": %s", step.Name, bufLenStr)
+	}
+	bwRate := uint64(0)
+	if step.BwRate != "" {
+		bwRate = unitToNumber(step.BwRate) / 8
+	}
+	if step.RttCount <= 0 {
+		scenarioError("invalid RttCount in step \"%s\": %d", step.Name, step.RttCount)
+	}
+	if step.WarmupCount < 0 || step.MSS < 0 || step.Batch < 0 {
+		scenarioError("WarmupCount, MSS and Batch can't be negative in step \"%s\"", step.Name)
+	}
+	numThreads := step.NumThreads
+	if numThreads <= 0 {
+		numThreads = runtime.NumCPU()
+	}
+	t.pause = parseScenarioDuration(step, "Pause", step.Pause)
+	t.clientParam = EthrClientParam{
+		uint32(numThreads),
+		uint32(bufLen),
+		uint32(step.RttCount),
+		step.Reverse,
+		parseScenarioDuration(step, "Duration", step.Duration),
+		parseScenarioDuration(step, "Gap", step.Gap),
+		uint32(step.WarmupCount),
+		bwRate,
+		step.ToS,
+		step.Bidirectional,
+		"",
+		getSockBufferSize(step.SendBufferSize),
+		getSockBufferSize(step.RecvBufferSize),
+		uint32(step.MSS),
+		step.Nagle,
+		step.ZeroCopy,
+		uint32(step.Batch),
+		step.UDPOffload}
+	validateClientParams(t.testID, t.clientParam, mode)
+	t.ccs = getCongestionControlList(t.testID, step.CongestionControl, t.destinations, mode)
+	validateDestinations(testType, t.destinations)
+	t.thresholds = getThresholds(step.MinBw, step.MinCps,
+		parseScenarioDuration(step, "MaxP99", step.MaxP99), step.MaxLoss)
+	return t
+}
+
+//
+// runScenario runs the steps of a scenario one after another and writes the
+// report of all of them. It returns the exit code of the worst verdict, and
+// stops at a step that is interrupted.
+//
+func runScenario(fileName, reportFile, title string) int {
+	scenarioTitle, tests := loadScenario(fileName)
+	if title == "" {
+		title = scenarioTitle
+	}
+	initClientUI(title)
+	report := &jsonScenarioReport{
+		Title:     title,
+		Scenario:  fileName,
+		StartTime: time.Now().UTC().Format(time.RFC3339),
+		Steps:     []*jsonScenarioStep{},
+	}
+	ipVersion := gIPVersion
+	code, failed := 0, 0
+	interrupted := false
+	for i, t := range tests {
+		ui.printMsg("=========================================================================================")
+		ui.printMsg("Running scenario step %d/%d: %s", i+1, len(tests), t.step.Name)
+		ui.printMsg("=========================================================================================")
+		gIsExternalClient = t.step.External
+		gUseTLS = t.step.TLS
+		gSendBufferSize = t.clientParam.SendBufferSize
+		gRecvBufferSize = t.clientParam.RecvBufferSize
+		gMSS = t.clientParam.MSS
+		gNagle = t.clientParam.Nagle
+		gIPVersion = ipVersion
+		gConcurrentTests = false
+		gCompareCongestionControl = false
+		gRunResults = newRunResults()
+		resetRunStatus()
+
+		s := &jsonScenarioStep{
+			Name:         t.step.Name,
+			Destinations: t.destinations,
+			Protocol:     protoToString(t.testID.Protocol),
+			Test:         testToString(t.testID.Type),
+			StartTime:    time.Now().UTC().Format(time.RFC3339),
+			Params:       t.clientParam,
+			Summaries:    []jsonDestinationSummary{},
+		}
+		setScenarioStep(s)
+		runClient(t.testID, t.step.Name, t.clientParam, t.destinations, t.ccs)
+		setScenarioStep(nil)
+		s.ExitCode, s.Verdict = judgeRun(t.thresholds, gRunResults, s.Protocol, false, true)
+		s.Results = getScenarioResults(gRunResults, s.Protocol)
+		report.Steps = append(report.Steps, s)
+		code = worseExitCode(code, s.ExitCode)
+		if s.ExitCode != 0 {
+			failed++
+		}
+
+		if isRunInterrupted() || (i < len(tests)-1 && !scenarioPause(t.pause)) {
+			interrupted = true
+			break
+		}
+	}
+	gRunResults = nil
+	initClientUI(title)
+	printScenarioSummary(report.Steps, tests)
+	report.EndTime = time.Now().UTC().Format(time.RFC3339)
+	report.ExitCode, report.Verdict = code, "PASS"
+	if code != 0 {
+		report.Verdict = fmt.Sprintf("FAIL, %d of %d steps failed", failed, len(tests))
+	}
+	if interrupted {
+		ui.printMsg("Scenario interrupted, %d of %d steps were run.", len(report.Steps), len(tests))
+		if code == 0 {
+			code, report.ExitCode, report.Verdict = 1, 1, "FAIL, interrupted"
+		}
+	}
+	ui.printMsg("Verdict: %s", report.Verdict)
+	writeScenarioReport(report, reportFile)
+	return code
+}
+
+//
+// scenarioPause waits between steps, and returns false if it is interrupted.
+//
+func scenarioPause(d time.Duration) bool {
+	if d == 0 {
+		return true
+	}
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigChan)
+	select {
+	case <-sigChan:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+//
+// worseExitCode returns the exit code of the worse of two verdicts, in the
+// same order as judgeRun.
+//
+func worseExitCode(a, b int) int {
+	rank := func(code int) int {
+		switch code {
+		case exitCodeServerRejected:
+			return 4
+		case exitCodeConnectFailed:
+			return 3
+		case exitCodeThreshold:
+			return 2
+		case exitCodeRegression:
+			return 1
+		}
+		return 0
+	}
+	if rank(b) > rank(a) {
+		return b
+	}
+	return a
+}
+
+func getScenarioResults(results *ethrRunResults, proto string) (r jsonScenarioResults) {
+	getNumber := func(metric string) uint64 {
+		v, _ := results.get(proto, metric)
+		return uint64(v)
+	}
+	getDuration := func(metric string) time.Duration {
+		v, _ := results.get(proto, metric)
+		return time.Duration(v)
+	}
+	r.BitsPerSecond = getNumber("Bits/s")
+	r.ConnectionsPerSecond = getNumber("Conn/s")
+	r.PacketsPerSecond = getNumber("Pkts/s")
+	if _, ok := results.get(proto, "Latency Avg"); ok {
+		r.Latency = &jsonScenarioLatency{
+			Avg:   getDuration("Latency Avg"),
+			P50:   getDuration("Latency P50"),
+			P90:   getDuration("Latency P90"),
+			P95:   getDuration("Latency P95"),
+			P99:   getDuration("Latency P99"),
+			P999:  getDuration("Latency P99.9"),
+			P9999: getDuration("Latency P99.99"),
+		}
+	}
+	if loss, ok := getRunLoss(); ok {
+		r.PacketLoss = &loss
+	}
+	return
+}
+
+func printScenarioSummary(steps []*jsonScenarioStep, tests []*ethrScenarioTest) {
+	ui.printMsg("=========================================================================================")
+	ui.printMsg("Scenario summary:")
+	ui.printMsg("Step  Name                  Protocol  Test             Bits/s   Conn/s   Pkts/s  Latency P99    Loss  Verdict")
+	for i, s := range steps {
+		r := s.Results
+		bw, cps, pps, p99, loss := "--", "--", "--", "--", "--"
+		if r.BitsPerSecond > 0 {
+			bw = numberToUnit(r.BitsPerSecond)
+		}
+		if r.ConnectionsPerSecond > 0 {
+			cps = numberToUnit(r.ConnectionsPerSecond)
+		}
+		if r.PacketsPerSecond > 0 {
+			pps = numberToUnit(r.PacketsPerSecond)
+		}
+		if r.Latency != nil {
+			p99 = durationToString(r.Latency.P99)
+		}
+		if r.PacketLoss != nil {
+			loss = fmt.Sprintf("%.2f%%", *r.PacketLoss)
+		}
+		ui.printMsg("%4d  %-20.20s  %-8s  %-13s  %8s %8s %8s  %11s  %6s  %s",
+			i+1, s.Name, s.Protocol, s.Test, bw, cps, pps, p99, loss, s.Verdict)
+	}
+	for i := len(steps); i < len(tests); i++ {
+		ui.printMsg("%4d  %-20.20s  not run", i+1, tests[i].step.Name)
+	}
+}
+
+func writeScenarioReport(report *jsonScenarioReport, fileName string) {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(fileName, append(data, '\n'), 0666)
+	}
+	if err != nil {
+		ui.printErr("Unable to write the scenario report to %s, Error: %v", fileName, err)
+		return
+	}
+	ui.printMsg("Scenario report written to %s", fileName)
+}
@@ -6,17 +6,50 @@
 package main
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
 	"net"
+	"net/http"
 	"os"
 	"runtime"
-	"sort"
+	"strconv"
+	"sync"
 	"sync/atomic"
 	"time"
 )
 
-var gCert []byte
+// First byte of a TLS record that carries a handshake message, e.g. ClientHello.
+const tlsRecordTypeHandshake = 0x16
+
+var gTLSConfig *tls.Config
+var gTLSConfigOnce sync.Once
+var gHTTPListener *ethrHTTPListener
+
+//
+// Tests that the server supports, advertised to clients in the ACK message.
+//
+var gServerTests = []EthrTestID{
+	{TCP, Bandwidth}, {TCP, Cps}, {TCP, Latency}, {TCP, Ping}, {TCP, TraceRoute}, {TCP, MyTraceRoute},
+	{UDP, Bandwidth}, {UDP, Pps}, {UDP, Latency},
+	{HTTP, Bandwidth}, {HTTP, Cps}, {HTTP, Latency},
+	{HTTPS, Bandwidth}, {HTTPS, Cps}, {HTTPS, Latency},
+	{QUIC, Bandwidth}, {QUIC, Cps}, {QUIC, Latency},
+}
+
+var gServerLimits = EthrLimits{
+	MaxBufferSize: 2 * GIGA,
+}
 
 func initServer(showUI bool) {
 	initServerUI(showUI)
@@ -25,6 +58,7 @@ func initServer(showUI bool) {
 func finiServer() {
 	ui.fini()
 	logFini()
+	csvFini()
 }
 
 func showAcceptedIPVersion() {
@@ -37,14 +71,61 @@ func showAcceptedIPVersion() {
 	ui.printMsg("Accepting IP version: %s", ipVerString)
 }
 
+func showAcceptedClients() {
+	if gAllowList != nil {
+		ui.printMsg("Accepting clients from: %s", ipNetsToString(gAllowList))
+	}
+	if gDenyList != nil {
+		ui.printMsg("Rejecting clients from: %s", ipNetsToString(gDenyList))
+	}
+	if gPSK != nil {
+		ui.printMsg("Clients must authenticate using the pre-shared key")
+	}
+}
+
+func showServerLimits() {
+	if gMaxSessions > 0 {
+		ui.printMsg("Maximum clients running tests at the same time: %d", gMaxSessions)
+	}
+	if gServerLimits.MaxStreams > 0 {
+		ui.printMsg("Maximum streams per client: %d", gServerLimits.MaxStreams)
+	}
+	if gServerLimits.MaxDuration > 0 {
+		ui.printMsg("Maximum test duration: %v", gServerLimits.MaxDuration)
+	}
+	if gServerLimits.MaxBandwidth > 0 {
+		ui.printMsg("Maximum bandwidth per client: %sbits/s", bytesToRate(gServerLimits.MaxBandwidth))
+	}
+}
+
 func runServer(serverParam ethrServerParam) {
 	defer stopStatsTimer()
 	initServer(serverParam.showUI)
 	startStatsTimer()
+	initServerAuth(serverParam)
+	initServerPolicy(serverParam)
 	fmt.Println("-----------------------------------------------------------")
 	showAcceptedIPVersion()
-	ui.printMsg("Listening on port %d for TCP & UDP", gEthrPort)
+	showAcceptedClients()
+	showServerLimits()
+	if serverParam.certFile != "" {
+		cert, err := tls.LoadX509KeyPair(serverParam.certFile, serverParam.keyFile)
+		if err != nil {
+			finiServer()
+			fmt.Printf("Fatal error loading TLS certificate: %v\n", err)
+			os.Exit(1)
+		}
+		gTLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+	ui.printMsg("Listening on port %d for TCP & UDP, and port %s for QUIC", gEthrPort, getQUICPortStr())
+	if gMPTCP {
+		ui.printMsg("Multipath TCP (MPTCP) is enabled for TCP tests")
+	}
+	if serverParam.metricsAddr != "" {
+		runMetricsServer(serverParam.metricsAddr)
+	}
 	srvrRunUDPServer()
+	srvrRunQUICServer()
 	err := srvrRunTCPServer()
 	if err != nil {
 		finiServer()
@@ -53,8 +134,7 @@ func runServer(serverParam ethrServerParam) {
 	}
 }
 
-func handshakeWithClient(test *ethrTest, conn net.Conn) (testID EthrTestID, clientParam EthrClientParam, err error) {
-	ethrMsg := recvSessionMsg(conn)
+func handshakeWithClient(test *ethrTest, conn net.Conn, ethrMsg *EthrMsg) (testID EthrTestID, clientParam EthrClientParam, err error) {
 	if ethrMsg.Type != EthrSyn {
 		ui.printDbg("Failed to receive SYN message from client.")
 		err = os.ErrInvalid
@@ -62,17 +142,83 @@ func handshakeWithClient(test *ethrTest, conn net.Conn) (testID EthrTestID, clie
 	}
 	testID = ethrMsg.Syn.TestID
 	clientParam = ethrMsg.Syn.ClientParam
-	ethrMsg = createAckMsg()
-	err = sendSessionMsg(conn, ethrMsg)
+	test.title = ethrMsg.Syn.Title
+	ackMsg := srvrCreateAckMsg(ethrMsg.Version)
+	if sockOptsRequested(clientParam) {
+		opts := srvrSetSockOpts(conn, clientParam)
+		if ackMsg.Version > 0 {
+			ackMsg.Ack.SockOpts = opts
+		}
+	}
+	err = sendSessionMsg(conn, ackMsg)
+	return
+}
+
+//
+// srvrCreateAckMsg creates the ACK message that accepts the client, using the
+// version of messages that the client supports. Clients that predate versions
+// don't know about the capabilities of the server, so these are left out.
+//
+func srvrCreateAckMsg(clientVersion EthrMsgVer) (ethrMsg *EthrMsg) {
+	ethrMsg = createAckMsg(clientVersion)
+	if ethrMsg.Version == 0 {
+		return
+	}
+	ethrMsg.Ack.ServerVersion = gVersion
+	ethrMsg.Ack.Tests = gServerTests
+	ethrMsg.Ack.TLS = true
+	ethrMsg.Ack.Limits = gServerLimits
+	ethrMsg.Ack.CongestionControls = getCongestionControls()
+	ethrMsg.Ack.ZeroCopyModes = getZeroCopyModes()
 	return
 }
 
+//
+// srvrCheckSyn checks that the server can run the test that the client asks
+// for in its SYN message, and tells the client why not, if so.
+//
+func srvrCheckSyn(server string, conn net.Conn, ethrMsg *EthrMsg) (err error) {
+	if !srvrSupportsTest(ethrMsg.Syn.TestID) {
+		err = fmt.Errorf("%s %s tests are not supported by the server",
+			protoToString(ethrMsg.Syn.TestID.Protocol), testToString(ethrMsg.Syn.TestID.Type))
+	}
+	if err == nil && ethrMsg.Syn.ClientParam.BufferSize > gServerLimits.MaxBufferSize {
+		err = fmt.Errorf("buffer size of %d bytes is larger than %d bytes, the largest allowed by the server",
+			ethrMsg.Syn.ClientParam.BufferSize, gServerLimits.MaxBufferSize)
+	}
+	if err == nil {
+		err = srvrCheckPolicy(ethrMsg.Syn.ClientParam)
+	}
+	if err != nil {
+		srvrRejectClient(server, conn, ethrMsg.Version, err)
+	}
+	return
+}
+
+func srvrSupportsTest(testID EthrTestID) bool {
+	if testID.Type == All {
+		return true
+	}
+	for _, t := range gServerTests {
+		if t == testID {
+			return true
+		}
+	}
+	return false
+}
+
 func srvrRunTCPServer() error {
-	l, err := net.Listen(Tcp(), gLocalIP+":"+gEthrPortStr)
+	lc := net.ListenConfig{}
+	if gMPTCP {
+		lc.SetMultipathTCP(true)
+	}
+	l, err := lc.Listen(context.Background(), Tcp(), gLocalIP+":"+gEthrPortStr)
 	if err != nil {
 		return err
 	}
 	defer l.Close()
+	gHTTPListener = &ethrHTTPListener{make(chan net.Conn), l.Addr()}
+	go srvrRunHTTPServer(gHTTPListener)
 	for {
 		conn, err := l.Accept()
 		if err != nil {
@@ -100,39 +246,107 @@ func srvrHandleNewTcpConn(conn net.Conn) {
 	ethrUnused(lserver, lport)
 	ui.printDbg("New connection from %v, port %v to %v, port %v", server, port, lserver, lport)
 
+	conn = srvrUpgradeTLS(conn)
+	proto := HTTP
+	if _, ok := conn.(*ethrTLSConn); ok {
+		proto = HTTPS
+	}
+	conn, isHTTP := srvrDetectHTTP(conn)
+	ip := parseClientIP(server)
+	if isHTTP {
+		err = srvrCheckClient(ip)
+		if err == nil {
+			err = srvrAdmitStream(ip)
+		}
+		if err != nil {
+			srvrLogRejected(server, err)
+		}
+		srvrHandleHTTPConn(server, proto, conn, err)
+		return
+	}
+	ethrMsg := recvSessionMsg(conn)
+	if ethrMsg.Type == EthrSyn && ethrMsg.Syn != nil {
+		ethrMsg, err = srvrAuthorizeClient(server, conn, ethrMsg)
+		if err != nil {
+			ui.printDbg("Failed in handshake with the client. Error: %v", err)
+			return
+		}
+		err = srvrCheckSyn(server, conn, ethrMsg)
+		if err != nil {
+			return
+		}
+		if ethrMsg.Syn.TestID.Type == All {
+			srvrRunAuthSession(server, conn, ethrMsg)
+			return
+		}
+	} else {
+		// Connections/s tests and the results exchange don't do a handshake, so
+		// these are allowed only if the client has a session open.
+		err = srvrCheckClient(ip)
+		if err != nil {
+			srvrLogRejected(server, err)
+			return
+		}
+	}
+	if ethrMsg.Type == EthrFin {
+		// This connection only carries the results exchange, it is not part of the test.
+		srvrSendTestResults(server, conn, ethrMsg.Version, ethrMsg.Fin)
+		return
+	}
+
+	err = srvrAdmitStream(ip)
+	if err != nil {
+		srvrRejectConn(server, conn, ethrMsg, err)
+		return
+	}
+	srvrSetStreamDeadline(conn)
 	test, isNew := createOrGetTest(server, TCP, All)
 	if test == nil {
+		srvrReleaseStream(ip)
 		return
 	}
 	if isNew {
 		ui.emitTestHdr()
 	}
 
-	isCPSorPing := true
 	// For CPS and Ping tests, there is no deterministic way to know when the test starts
 	// from the client side and when it ends. This defer function ensures that test is not
 	// created/deleted repeatedly by doing a deferred deletion. If another connection
 	// comes with-in 2s, then another reference would be taken on existing test object
 	// and it won't be deleted by safeDeleteTest call. This also ensures, test header is
 	// not printed repeatedly via emitTestHdr.
+	// The same deferred deletion keeps the totals of a Bandwidth test that just ended
+	// around, so that the client can ask for them using EthrFin message. Other tests,
+	// e.g. Latency, don't exchange results, so their test is deleted right away.
 	// Note: Similar mechanism is used in UDP tests to handle test lifetime as well.
+	// The stream is released right away, as it is closed.
+	keepTest := true
 	defer func() {
-		if isCPSorPing {
-			time.Sleep(2 * time.Second)
-		}
-		safeDeleteTest(test)
+		srvrReleaseStream(ip)
+		srvrDeleteTest(test, keepTest)
 	}()
 
 	// Always increment CPS count and then check if the test is Bandwidth etc. and handle
 	// those cases as well.
 	atomic.AddUint64(&test.testResult.cps, 1)
+	if atomic.AddUint64(&test.testResult.totalCps, 1) == 1 {
+		// First connection since the totals were last reported starts the test.
+		test.startTime = time.Now()
+		test.startCPUTime()
+	}
+	test.lastAccess = time.Now()
+	err = srvrCheckDuration(test)
+	if err != nil {
+		srvrRejectConn(server, conn, ethrMsg, err)
+		return
+	}
 
-	testID, clientParam, err := handshakeWithClient(test, conn)
+	testID, clientParam, err := handshakeWithClient(test, conn, ethrMsg)
 	if err != nil {
 		ui.printDbg("Failed in handshake with the client. Error: %v", err)
 		return
 	}
-	isCPSorPing = false
+	keepTest = isResultExchangeSupported(testID)
 	if testID.Protocol == TCP {
 		if testID.Type == Bandwidth {
 			srvrRunTCPBandwidthTest(test, clientParam, conn)
@@ -143,29 +357,348 @@ func srvrHandleNewTcpConn(conn net.Conn) {
 	}
 }
 
+//
+// srvrDeleteTest releases the reference of a connection on its test. If the
+// client may still ask for the results of the test, the test is kept for 2s
+// more, see srvrHandleNewTcpConn.
+//
+func srvrDeleteTest(test *ethrTest, keep bool) {
+	if keep {
+		time.Sleep(2 * time.Second)
+	}
+	safeDeleteTest(test)
+}
+
+//
+// TLS and plain connections are accepted on the same port, and are told apart
+// by their first byte. Gob messages start with a 4 byte length that is at
+// most 16KB, so their first byte is always 0, and JSON messages start with
+// the magic marker, whose first byte is 'e' (0x65), whereas a TLS connection
+// starts with the record type of ClientHello (0x16).
+//
+func srvrUpgradeTLS(conn net.Conn) net.Conn {
+	b := make([]byte, 1)
+	_, err := io.ReadFull(conn, b)
+	if err != nil {
+		return conn
+	}
+	pc := &ethrPeekConn{conn, b}
+	if b[0] != tlsRecordTypeHandshake {
+		return pc
+	}
+	tlsConfig := srvrGetTLSConfig()
+	if tlsConfig == nil {
+		return pc
+	}
+	tc := tls.Server(pc, tlsConfig)
+	err = tc.Handshake()
+	if err != nil {
+		ui.printDbg("TLS handshake with %v failed. Error: %v", conn.RemoteAddr(), err)
+	}
+	return &ethrTLSConn{tc, conn}
+}
+
+func srvrGetTLSConfig() *tls.Config {
+	gTLSConfigOnce.Do(func() {
+		if gTLSConfig != nil {
+			return
+		}
+		cert, err := generateSelfSignedCert()
+		if err != nil {
+			ui.printErr("Failed to generate a self-signed TLS certificate. Error: %v", err)
+			return
+		}
+		ui.printMsg("Using a self-signed certificate for TLS tests.")
+		gTLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	})
+	return gTLSConfig
+}
+
+func generateSelfSignedCert() (cert tls.Certificate, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return
+	}
+	hostName, _ := os.Hostname()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "Ethr"},
+		DNSNames:              []string{hostName, "localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return
+	}
+	cert = tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	return
+}
+
+//
+// HTTP requests are detected by the first byte of the request line, which is
+// the first letter of the method in upper case, e.g. GET or POST. Requests
+// over TLS are detected the same way, once the TLS handshake is done.
+//
+func srvrDetectHTTP(conn net.Conn) (net.Conn, bool) {
+	b := make([]byte, 1)
+	_, err := io.ReadFull(conn, b)
+	if err != nil {
+		return conn, false
+	}
+	return &ethrPeekConn{conn, b}, b[0] >= 'A' && b[0] <= 'Z'
+}
+
+//
+// ethrHTTPListener hands over connections that carry HTTP requests to the
+// HTTP server, as these are accepted on the same port as other TCP tests.
+//
+type ethrHTTPListener struct {
+	conns chan net.Conn
+	addr  net.Addr
+}
+
+func (l *ethrHTTPListener) Accept() (net.Conn, error) {
+	return <-l.conns, nil
+}
+
+func (l *ethrHTTPListener) Close() error {
+	return nil
+}
+
+func (l *ethrHTTPListener) Addr() net.Addr {
+	return l.addr
+}
+
+//
+// ethrHTTPConn keeps the test that requests on the connection are accounted
+// to, and signals when the HTTP server is done with the connection. Requests
+// of rejected clients are not part of any test, and are answered with the
+// reason of rejection.
+//
+type ethrHTTPConn struct {
+	net.Conn
+	test     *ethrTest
+	rejected error
+	closed   chan struct{}
+	once     sync.Once
+	requests uint64
+}
+
+func (c *ethrHTTPConn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+	})
+	return c.Conn.Close()
+}
+
+type ethrHTTPConnKey struct{}
+
+//
+// HTTP connections that are idle, or that are slow to send the headers of a
+// request, are closed, so that these don't keep their test around. Latency
+// tests wait for the gap between their rounds of requests on an idle
+// connection, which is well below the idle timeout by default.
+//
+const (
+	httpReadHeaderTimeout = handshakeTimeout
+	httpIdleTimeout       = 10 * time.Second
+)
+
+func srvrRunHTTPServer(l net.Listener) {
+	s := &http.Server{
+		Handler: http.HandlerFunc(srvrServeHTTP),
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, ethrHTTPConnKey{}, c)
+		},
+		ReadHeaderTimeout: httpReadHeaderTimeout,
+		IdleTimeout:       httpIdleTimeout,
+		// Errors of the HTTP server are not interesting, e.g. a client that
+		// disconnects when the test ends, so these are not logged.
+		ErrorLog: log.New(ioutil.Discard, "", 0),
+	}
+	err := s.Serve(l)
+	if err != nil {
+		ui.printErr("Error running HTTP server: %v", err)
+	}
+}
+
+func srvrHandleHTTPConn(server string, proto EthrProtocol, conn net.Conn, rejected error) {
+	if rejected != nil {
+		hc := &ethrHTTPConn{Conn: conn, rejected: rejected, closed: make(chan struct{})}
+		gHTTPListener.conns <- hc
+		<-hc.closed
+		return
+	}
+	ip := parseClientIP(server)
+	srvrSetStreamDeadline(conn)
+	test, isNew := createOrGetTest(server, proto, All)
+	if test == nil {
+		srvrReleaseStream(ip)
+		return
+	}
+	if isNew {
+		ui.emitTestHdr()
+	}
+	// Same deferred deletion as other TCP connections, see srvrHandleNewTcpConn.
+	// Connections that didn't serve any request don't add to the results.
+	hc := &ethrHTTPConn{Conn: conn, test: test, closed: make(chan struct{})}
+	defer func() {
+		srvrReleaseStream(ip)
+		srvrDeleteTest(test, atomic.LoadUint64(&hc.requests) > 0)
+	}()
+	gHTTPListener.conns <- hc
+	<-hc.closed
+}
+
+//
+// srvrServeHTTP serves HTTP tests. GET returns a payload of the size given by
+// the "size" query parameter, and POST or PUT discards the payload that is
+// sent. Bytes sent by the server are counted in the reverse direction, same
+// as the Bandwidth test with -r. Each request is counted in place of a
+// connection.
+//
+func srvrServeHTTP(w http.ResponseWriter, r *http.Request) {
+	hc, ok := r.Context().Value(ethrHTTPConnKey{}).(*ethrHTTPConn)
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if hc.rejected != nil {
+		http.Error(w, hc.rejected.Error(), http.StatusForbidden)
+		return
+	}
+	test := hc.test
+	atomic.AddUint64(&hc.requests, 1)
+	atomic.AddUint64(&test.testResult.cps, 1)
+	if atomic.AddUint64(&test.testResult.totalCps, 1) == 1 {
+		test.startTime = time.Now()
+		test.startCPUTime()
+	}
+	test.lastAccess = time.Now()
+	err := srvrCheckDuration(test)
+	if err != nil {
+		srvrLogRejected(test.session.remoteIP, err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	buff := make([]byte, 16*1024)
+	switch r.Method {
+	case http.MethodGet:
+		size := uint64(len(buff))
+		if s := r.URL.Query().Get("size"); s != "" {
+			size, err = strconv.ParseUint(s, 10, 32)
+			if err != nil {
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.FormatUint(size, 10))
+		for size > 0 {
+			n := len(buff)
+			if uint64(n) > size {
+				n = int(size)
+			}
+			n, err := w.Write(buff[:n])
+			srvrAddHTTPBytes(test, n, true)
+			if err != nil {
+				ui.printDbg("Error sending data for HTTP test: %v", err)
+				return
+			}
+			size -= uint64(n)
+		}
+	case http.MethodPost, http.MethodPut:
+		for {
+			n, err := r.Body.Read(buff)
+			srvrAddHTTPBytes(test, n, false)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				ui.printDbg("Error receiving data for HTTP test: %v", err)
+				return
+			}
+		}
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func srvrAddHTTPBytes(test *ethrTest, n int, reverse bool) {
+	if n <= 0 {
+		return
+	}
+	atomic.AddUint64(&test.testResult.bw, uint64(n))
+	if reverse {
+		atomic.AddUint64(&test.testResult.totalRevBw, uint64(n))
+	} else {
+		atomic.AddUint64(&test.testResult.totalBw, uint64(n))
+	}
+	test.lastAccess = time.Now()
+	test.session.limiter.wait(n)
+}
+
 func srvrRunTCPBandwidthTest(test *ethrTest, clientParam EthrClientParam, conn net.Conn) {
 	size := clientParam.BufferSize
 	buff := make([]byte, size)
 	for i := uint32(0); i < size; i++ {
 		buff[i] = byte(i)
 	}
+	dp, err := newDataPath(conn, clientParam.ZeroCopy, buff, clientParam.Reverse)
+	if err != nil {
+		ui.printDbg("Failed to use zero copy mode %s, copying data instead. Error: %v", clientParam.ZeroCopy, err)
+		dp, _ = newDataPath(conn, "", buff, clientParam.Reverse)
+	}
+	defer dp.close()
 	bufferLen := len(buff)
-	totalBytesToSend := test.clientParam.BwRate
+	totalBytesToSend := clientParam.BwRate
 	sentBytes := uint64(0)
 	start, waitTime, bytesToSend := beginThrottle(totalBytesToSend, bufferLen)
+	if clientParam.Reverse {
+		// Data is sent on this connection, so it uses the congestion control
+		// algorithm that the client asked for, if any.
+		if clientParam.CongestionControl != "" {
+			err := setCongestionControl(conn, clientParam.CongestionControl)
+			if err != nil {
+				ui.printErr("Failed to set congestion control algorithm %s. Error: %v",
+					clientParam.CongestionControl, err)
+			}
+		}
+		test.recordCongestionControl(conn)
+	}
+	ec := test.newConn(conn, clientParam.Reverse)
+	defer test.delConn(conn)
 	for {
 		n := 0
 		var err error
 		if clientParam.Reverse {
-			n, err = conn.Write(buff[:bytesToSend])
+			n, err = dp.send(buff[:bytesToSend])
 		} else {
-			n, err = conn.Read(buff)
+			n, err = dp.recv(buff)
 		}
 		if err != nil {
 			ui.printDbg("Error sending/receiving data on a connection for bandwidth test: %v", err)
 			break
 		}
-		atomic.AddUint64(&test.testResult.bw, uint64(size))
+		atomic.AddUint64(&ec.bw, uint64(n))
+		atomic.AddUint64(&test.testResult.bw, uint64(n))
+		if clientParam.Reverse {
+			atomic.AddUint64(&test.testResult.totalRevBw, uint64(n))
+		} else {
+			atomic.AddUint64(&test.testResult.totalBw, uint64(n))
+		}
+		// Track the last transfer, as the connection may stay idle while it is
+		// being throttled, and the test ends when the client asks for results.
+		test.lastAccess = time.Now()
+		test.session.limiter.wait(n)
 		if clientParam.Reverse {
 			sentBytes += uint64(n)
 			start, waitTime, sentBytes, bytesToSend = enforceThrottle(start, waitTime, totalBytesToSend, sentBytes, bufferLen)
@@ -173,10 +706,39 @@ func srvrRunTCPBandwidthTest(test *ethrTest, clientParam EthrClientParam, conn n
 	}
 }
 
+func srvrSendTestResults(server string, conn net.Conn, clientVersion EthrMsgVer, clientFin *EthrMsgFin) {
+	if clientFin == nil {
+		ui.printDbg("Received an empty FIN message from client.")
+		return
+	}
+	fin := &EthrMsgFin{TestID: clientFin.TestID}
+	test := getTest(server, clientFin.TestID.Protocol, All)
+	if test != nil && clientFin.TestID.Protocol == QUIC {
+		srvrWaitQUICStreams(test)
+	}
+	if test != nil {
+		// Reset the totals once reported, so that results of the next test from
+		// the same client don't include this test.
+		fin.Bytes = atomic.SwapUint64(&test.testResult.totalBw, 0)
+		fin.ReverseBytes = atomic.SwapUint64(&test.testResult.totalRevBw, 0)
+		fin.Packets = atomic.SwapUint64(&test.testResult.totalPps, 0)
+		fin.Connections = atomic.SwapUint64(&test.testResult.totalCps, 0)
+		fin.Elapsed = test.lastAccess.Sub(test.startTime)
+		fin.CongestionControl = test.takeCongestionControl()
+		fin.CPUTime, fin.OtherTests = test.stopCPUTime()
+	}
+	ui.printDbg("Results for %s test from %s, client: %v, server: %v",
+		protoToString(fin.TestID.Protocol), server, *clientFin, *fin)
+	err := sendSessionMsg(conn, createFinMsg(clientVersion, fin))
+	if err != nil {
+		ui.printDbg("Failed to send FIN message to client. Error: %v", err)
+	}
+}
+
 func srvrRunTCPLatencyTest(test *ethrTest, clientParam EthrClientParam, conn net.Conn) {
 	bytes := make([]byte, clientParam.BufferSize)
 	rttCount := clientParam.RttCount
-	latencyNumbers := make([]time.Duration, rttCount)
+	hist := newHistogram()
 	for {
 		_, err := io.ReadFull(conn, bytes)
 		if err != nil {
@@ -196,39 +758,14 @@ func srvrRunTCPLatencyTest(test *ethrTest, clientParam EthrClientParam, conn net
 				return
 			}
 			e2 := time.Since(s1)
-			latencyNumbers[i] = e2
-		}
-		sum := int64(0)
-		for _, d := range latencyNumbers {
-			sum += d.Nanoseconds()
-		}
-		elapsed := time.Duration(sum / int64(rttCount))
-		sort.SliceStable(latencyNumbers, func(i, j int) bool {
-			return latencyNumbers[i] < latencyNumbers[j]
-		})
-		//
-		// Special handling for rttCount == 1. This prevents negative index
-		// in the latencyNumber index. The other option is to use
-		// roundUpToZero() but that is more expensive.
-		//
-		rttCountFixed := rttCount
-		if rttCountFixed == 1 {
-			rttCountFixed = 2
-		}
-		atomic.SwapUint64(&test.testResult.latency, uint64(elapsed.Nanoseconds()))
-		avg := elapsed
-		min := latencyNumbers[0]
-		max := latencyNumbers[rttCount-1]
-		p50 := latencyNumbers[((rttCountFixed*50)/100)-1]
-		p90 := latencyNumbers[((rttCountFixed*90)/100)-1]
-		p95 := latencyNumbers[((rttCountFixed*95)/100)-1]
-		p99 := latencyNumbers[((rttCountFixed*99)/100)-1]
-		p999 := latencyNumbers[uint64(((float64(rttCountFixed)*99.9)/100)-1)]
-		p9999 := latencyNumbers[uint64(((float64(rttCountFixed)*99.99)/100)-1)]
+			hist.record(e2)
+		}
+		atomic.SwapUint64(&test.testResult.latency, uint64(hist.avg().Nanoseconds()))
 		ui.emitLatencyResults(
 			test.session.remoteIP,
 			protoToString(test.testID.Protocol),
-			avg, min, max, p50, p90, p95, p99, p999, p9999)
+			hist, 0)
+		hist.reset()
 	}
 }
 
@@ -244,11 +781,9 @@ func srvrRunUDPServer() error {
 		return err
 	}
 	// Set socket buffer to 4MB per CPU so we can queue 4MB per CPU in case Ethr is not
-	// able to keep up temporarily.
-	err = l.SetReadBuffer(runtime.NumCPU() * 4 * 1024 * 1024)
-	if err != nil {
-		ui.printDbg("Failed to set ReadBuffer on UDP socket: %v", err)
-	}
+	// able to keep up temporarily. Clients can ask for a larger buffer.
+	gUDPConn = l
+	srvrSetUDPReadBuffer(runtime.NumCPU() * 4 * 1024 * 1024)
 	//
 	// We use NumCPU here instead of NumThreads passed from client. The
 	// reason is that for UDP, there is no connection, so all packets come
@@ -265,6 +800,7 @@ func srvrRunUDPPacketHandler(conn *net.UDPConn) {
 	// This local map aids in efficiency to look up a test based on client's IP
 	// address. We could use createOrGetTest but that takes a global lock.
 	tests := make(map[string]*ethrTest)
+	rejected := newRejectLog()
 	// For UDP, allocate buffer that can accomodate largest UDP datagram.
 	readBuffer := make([]byte, 64*1024)
 	n, remoteIP, err := 0, new(net.UDPAddr), error(nil)
@@ -289,37 +825,259 @@ func srvrRunUDPPacketHandler(conn *net.UDPConn) {
 					ui.printDbg("Deleting UDP test from server: %v, lastAccess: %v", k, v.lastAccess)
 					safeDeleteTest(v)
 					delete(tests, k)
+					srvrReleaseClient(parseClientIP(k))
 				}
 			}
 		}
 	}()
+	if isUDPBatchSupported() {
+		srvrReadUDPBatches(conn, tests, rejected)
+		return
+	}
 	for err == nil {
 		n, remoteIP, err = conn.ReadFromUDP(readBuffer)
 		if err != nil {
 			ui.printDbg("Error receiving data from UDP for bandwidth test: %v", err)
 			continue
 		}
-		ethrUnused(remoteIP)
-		ethrUnused(n)
-		server, port, _ := net.SplitHostPort(remoteIP.String())
-		test, found := tests[server]
-		if !found {
-			test, isNew := createOrGetTest(server, UDP, All)
-			if test != nil {
-				tests[server] = test
-			}
-			if isNew {
-				ui.printDbg("Creating UDP test from server: %v, lastAccess: %v", server, time.Now())
-				ui.emitTestHdr()
+		srvrHandleUDPPackets(conn, tests, rejected, readBuffer[:n], n, remoteIP)
+	}
+}
+
+//
+// srvrHandleUDPPackets accounts datagrams of a UDP test to the test of the
+// client that sent them, using the tests that the handler already looked up.
+// Datagrams that the kernel coalesced with GRO come in one buffer, split into
+// segments of segSize bytes, and share the look up of the test. Rejections
+// are logged using the handler's own log, rejected.
+//
+func srvrHandleUDPPackets(conn *net.UDPConn, tests map[string]*ethrTest, rejected *ethrRejectLog, readBuffer []byte, segSize int, remoteIP *net.UDPAddr) {
+	rerr := srvrCheckClient(remoteIP.IP)
+	if rerr != nil {
+		rejected.log(remoteIP.IP.String(), rerr)
+		return
+	}
+	// Echo latency probes back right away, before any bookkeeping, so that
+	// the measured round trip time includes as little server time as possible.
+	for rest := readBuffer; ; {
+		var d []byte
+		d, rest = nextUDPSegment(rest, segSize)
+		if len(d) >= udpLatencyHdrLen && binary.BigEndian.Uint32(d[0:]) == udpLatencyMagic {
+			_, werr := conn.WriteToUDP(d, remoteIP)
+			if werr != nil {
+				ui.printDbg("Error sending latency probe reply for UDP latency test: %v", werr)
 			}
 		}
+		if len(rest) == 0 {
+			break
+		}
+	}
+	key := remoteIP.String()
+	server, port, _ := net.SplitHostPort(key)
+	test, found := tests[server]
+	if !found {
+		rerr = srvrAdmitClient(remoteIP.IP)
+		if rerr != nil {
+			rejected.log(server, rerr)
+			return
+		}
+		var isNew bool
+		test, isNew = createOrGetTest(server, UDP, All)
 		if test != nil {
-			test.isDormant = false
-			test.lastAccess = time.Now()
-			atomic.AddUint64(&test.testResult.pps, 1)
-			atomic.AddUint64(&test.testResult.bw, uint64(n))
+			tests[server] = test
+		} else {
+			srvrReleaseClient(remoteIP.IP)
+		}
+		if isNew {
+			ui.printDbg("Creating UDP test from server: %v, lastAccess: %v", server, time.Now())
+			ui.emitTestHdr()
+		}
+	}
+	if test == nil {
+		ui.printDbg("Unable to create test for UDP traffic on port %s from %s port %s", gEthrPortStr, server, port)
+		return
+	}
+	test.isDormant = false
+	test.lastAccess = time.Now()
+	if atomic.LoadUint64(&test.testResult.totalPps) > 0 {
+		rerr = srvrCheckDuration(test)
+		if rerr != nil {
+			rejected.log(server, rerr)
+			return
+		}
+	}
+	pkts, bytes := uint64(0), uint64(0)
+	for rest := readBuffer; ; {
+		var d []byte
+		d, rest = nextUDPSegment(rest, segSize)
+		// Packets above the bandwidth limit are dropped before these are
+		// tracked, so that these show up as lost.
+		if test.session.limiter.allow(len(d)) {
+			if len(d) >= udpDataHdrLen && binary.BigEndian.Uint32(d[0:]) == udpDataMagic {
+				rerr = test.trackUDPFlow(key, d, test.lastAccess)
+				if rerr != nil {
+					rejected.log(server, rerr)
+					break
+				}
+			}
+			pkts++
+			bytes += uint64(len(d))
+		}
+		if len(rest) == 0 {
+			break
+		}
+	}
+	if pkts == 0 {
+		return
+	}
+	atomic.AddUint64(&test.testResult.pps, pkts)
+	atomic.AddUint64(&test.testResult.bw, bytes)
+	if atomic.AddUint64(&test.testResult.totalPps, pkts) == pkts {
+		test.startTime = test.lastAccess
+		test.startCPUTime()
+	}
+	atomic.AddUint64(&test.testResult.totalBw, bytes)
+}
+
+//
+// nextUDPSegment returns the first datagram of a buffer of datagrams of
+// segSize bytes, except the last one, which may be shorter, and the rest.
+//
+func nextUDPSegment(b []byte, segSize int) (d, rest []byte) {
+	if segSize <= 0 || segSize > len(b) {
+		return b, nil
+	}
+	return b[:segSize], b[segSize:]
+}
+
+//
+// Sequence numbers within this window behind the highest sequence number are
+// remembered, so that duplicates can be told apart from reordered packets.
+//
+const udpSeqWindow = 4096
+
+type ethrUDPFlow struct {
+	baseSeq uint64
+	maxSeq  uint64
+	rcvd    uint64
+	dup     uint64
+	ooo     uint64
+	window  [udpSeqWindow / 64]uint64
+	transit int64
+	jitter  float64
+}
+
+type ethrUDPStats struct {
+	expected uint64
+	rcvd     uint64
+	dup      uint64
+	ooo      uint64
+}
+
+func (flow *ethrUDPFlow) isSeen(seq uint64) bool {
+	i := seq % udpSeqWindow
+	return flow.window[i/64]&(1<<(i%64)) != 0
+}
+
+func (flow *ethrUDPFlow) setSeen(seq uint64, seen bool) {
+	i := seq % udpSeqWindow
+	if seen {
+		flow.window[i/64] |= 1 << (i % 64)
+	} else {
+		flow.window[i/64] &^= 1 << (i % 64)
+	}
+}
+
+//
+// trackUDPFlow tracks a packet of the flow given by key. Packets of new flows
+// beyond the maximum streams per client are rejected.
+//
+func (test *ethrTest) trackUDPFlow(key string, data []byte, arrival time.Time) error {
+	seq := binary.BigEndian.Uint64(data[4:])
+	sent := int64(binary.BigEndian.Uint64(data[12:]))
+	test.udpLock.Lock()
+	defer test.udpLock.Unlock()
+	if test.udpFlows == nil {
+		test.udpFlows = make(map[string]*ethrUDPFlow)
+	}
+	flow, found := test.udpFlows[key]
+	if !found && gServerLimits.MaxStreams > 0 && uint32(len(test.udpFlows)) >= gServerLimits.MaxStreams {
+		return fmt.Errorf("client has %d UDP flows, the most allowed per client by the server", len(test.udpFlows))
+	}
+	if !found {
+		flow = &ethrUDPFlow{baseSeq: seq, maxSeq: seq}
+		test.udpFlows[key] = flow
+	} else if seq > flow.maxSeq {
+		if seq-flow.maxSeq >= udpSeqWindow {
+			flow.window = [udpSeqWindow / 64]uint64{}
 		} else {
-			ui.printDbg("Unable to create test for UDP traffic on port %s from %s port %s", gEthrPortStr, server, port)
+			for s := flow.maxSeq + 1; s < seq; s++ {
+				flow.setSeen(s, false)
+			}
+		}
+		flow.maxSeq = seq
+	} else if flow.maxSeq-seq < udpSeqWindow && seq >= flow.baseSeq {
+		if flow.isSeen(seq) {
+			flow.dup++
+			return nil
+		}
+		flow.ooo++
+	} else {
+		// Too old to tell if it is a duplicate, count it as reordered.
+		flow.ooo++
+		if seq < flow.baseSeq {
+			flow.baseSeq = seq
 		}
 	}
+	flow.setSeen(seq, true)
+	flow.rcvd++
+
+	// Interarrival jitter as defined in RFC 3550, section 6.4.1. Clocks of
+	// the client and server need not be synchronized, as only the difference
+	// in transit time of successive packets is used.
+	transit := arrival.UnixNano() - sent
+	if flow.rcvd > 1 {
+		d := transit - flow.transit
+		if d < 0 {
+			d = -d
+		}
+		flow.jitter += (float64(d) - flow.jitter) / 16
+	}
+	flow.transit = transit
+	return nil
+}
+
+//
+// getUDPStats returns loss, reordering and duplication since the last call,
+// along with the average jitter across all flows of the test.
+//
+func (test *ethrTest) getUDPStats() (stats ethrUDPStats, jitter time.Duration) {
+	test.udpLock.Lock()
+	defer test.udpLock.Unlock()
+	cur := ethrUDPStats{}
+	totalJitter := float64(0)
+	for _, flow := range test.udpFlows {
+		cur.expected += flow.maxSeq - flow.baseSeq + 1
+		cur.rcvd += flow.rcvd
+		cur.dup += flow.dup
+		cur.ooo += flow.ooo
+		totalJitter += flow.jitter
+	}
+	if len(test.udpFlows) > 0 {
+		jitter = time.Duration(totalJitter / float64(len(test.udpFlows)))
+	}
+	prev := test.udpStats
+	test.udpStats = cur
+	stats.expected = subOrZero(cur.expected, prev.expected)
+	stats.rcvd = subOrZero(cur.rcvd, prev.rcvd)
+	stats.dup = subOrZero(cur.dup, prev.dup)
+	stats.ooo = subOrZero(cur.ooo, prev.ooo)
+	return
+}
+
+func subOrZero(a, b uint64) uint64 {
+	if a > b {
+		return a - b
+	}
+	return 0
 }
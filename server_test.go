@@ -0,0 +1,117 @@
+//-----------------------------------------------------------------------------
+// Copyright (C) Microsoft. All rights reserved.
+// Licensed under the MIT license.
+// See LICENSE.txt file in the project root for full license information.
+//-----------------------------------------------------------------------------
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func udpDataPacket(seq uint64, sent time.Time) []byte {
+	d := make([]byte, udpDataHdrLen)
+	binary.BigEndian.PutUint32(d[0:], udpDataMagic)
+	binary.BigEndian.PutUint64(d[4:], seq)
+	binary.BigEndian.PutUint64(d[12:], uint64(sent.UnixNano()))
+	return d
+}
+
+func TestTrackUDPFlow(t *testing.T) {
+	tests := []struct {
+		name  string
+		seqs  []uint64
+		stats ethrUDPStats
+	}{
+		{"in order", []uint64{1, 2, 3, 4, 5}, ethrUDPStats{expected: 5, rcvd: 5}},
+		{"first packets lost", []uint64{3, 4, 5}, ethrUDPStats{expected: 3, rcvd: 3}},
+		{"lost", []uint64{1, 2, 4, 5, 8}, ethrUDPStats{expected: 8, rcvd: 5}},
+		{"reordered", []uint64{1, 3, 2, 4}, ethrUDPStats{expected: 4, rcvd: 4, ooo: 1}},
+		{"duplicate", []uint64{1, 2, 2, 3}, ethrUDPStats{expected: 3, rcvd: 3, dup: 1}},
+		{"duplicate of reordered", []uint64{1, 3, 2, 2}, ethrUDPStats{expected: 3, rcvd: 3, ooo: 1, dup: 1}},
+		{"reordered before first", []uint64{2, 3, 1}, ethrUDPStats{expected: 3, rcvd: 3, ooo: 1}},
+		{"lost after gap", []uint64{1, 5, 3, 3}, ethrUDPStats{expected: 5, rcvd: 3, ooo: 1, dup: 1}},
+		{"jump beyond window", []uint64{1, udpSeqWindow + 10, 2}, ethrUDPStats{expected: udpSeqWindow + 10, rcvd: 3, ooo: 1}},
+		// Packets too old to be in the window can't be told apart from
+		// duplicates, so these are counted as reordered.
+		{"duplicate beyond window", []uint64{1, udpSeqWindow + 10, 1}, ethrUDPStats{expected: udpSeqWindow + 10, rcvd: 3, ooo: 1}},
+		{"window edge", []uint64{1, udpSeqWindow, 1, 1}, ethrUDPStats{expected: udpSeqWindow, rcvd: 2, dup: 2}},
+	}
+	for _, tt := range tests {
+		test := &ethrTest{}
+		now := time.Now()
+		for _, seq := range tt.seqs {
+			err := test.trackUDPFlow("flow", udpDataPacket(seq, now), now)
+			if err != nil {
+				t.Fatalf("%s: failed to track packet %d: %v", tt.name, seq, err)
+			}
+		}
+		stats, _ := test.getUDPStats()
+		if stats != tt.stats {
+			t.Errorf("%s: got %+v, want %+v", tt.name, stats, tt.stats)
+		}
+	}
+}
+
+func TestUDPStatsInterval(t *testing.T) {
+	test := &ethrTest{}
+	now := time.Now()
+	for _, seq := range []uint64{1, 2, 4} {
+		test.trackUDPFlow("flow", udpDataPacket(seq, now), now)
+	}
+	stats, _ := test.getUDPStats()
+	if want := (ethrUDPStats{expected: 4, rcvd: 3}); stats != want {
+		t.Fatalf("first interval: got %+v, want %+v", stats, want)
+	}
+	// The packet that was missing in the first interval arrives late, so it
+	// is counted as received in the second interval, after the first interval
+	// counted it as lost.
+	for _, seq := range []uint64{3, 5, 6} {
+		test.trackUDPFlow("flow", udpDataPacket(seq, now), now)
+	}
+	stats, _ = test.getUDPStats()
+	if want := (ethrUDPStats{expected: 2, rcvd: 3, ooo: 1}); stats != want {
+		t.Fatalf("second interval: got %+v, want %+v", stats, want)
+	}
+	stats, _ = test.getUDPStats()
+	if want := (ethrUDPStats{}); stats != want {
+		t.Fatalf("empty interval: got %+v, want %+v", stats, want)
+	}
+}
+
+func TestUDPJitter(t *testing.T) {
+	tests := []struct {
+		name    string
+		transit []time.Duration
+		jitter  float64
+	}{
+		{"constant transit", []time.Duration{100, 100, 100}, 0},
+		{"one change", []time.Duration{100, 260}, 10},
+		{"changes", []time.Duration{100, 260, 100}, 10 + (160-10)/16.0},
+		{"single packet", []time.Duration{500}, 0},
+	}
+	for _, tt := range tests {
+		test := &ethrTest{}
+		sent := time.Now()
+		for i, transit := range tt.transit {
+			sent = sent.Add(time.Millisecond)
+			test.trackUDPFlow("flow", udpDataPacket(uint64(i+1), sent), sent.Add(transit))
+		}
+		_, jitter := test.getUDPStats()
+		if jitter != time.Duration(tt.jitter) {
+			t.Errorf("%s: got %v, want %v", tt.name, jitter, time.Duration(tt.jitter))
+		}
+	}
+	// Jitter of a test is the average of its flows.
+	test := &ethrTest{}
+	sent := time.Now()
+	for i, transit := range []time.Duration{100, 260} {
+		test.trackUDPFlow("flow1", udpDataPacket(uint64(i+1), sent), sent.Add(transit))
+		test.trackUDPFlow("flow2", udpDataPacket(uint64(i+1), sent), sent.Add(100))
+	}
+	if _, jitter := test.getUDPStats(); jitter != 5 {
+		t.Errorf("two flows: got %v, want %v", jitter, time.Duration(5))
+	}
+}
@@ -30,6 +30,9 @@ func initServerUI(showUI bool) {
 	gAggregateTestResults[TCP] = &ethrTestResultAggregate{}
 	gAggregateTestResults[UDP] = &ethrTestResultAggregate{}
 	gAggregateTestResults[ICMP] = &ethrTestResultAggregate{}
+	gAggregateTestResults[HTTP] = &ethrTestResultAggregate{}
+	gAggregateTestResults[HTTPS] = &ethrTestResultAggregate{}
+	gAggregateTestResults[QUIC] = &ethrTestResultAggregate{}
 	if !showUI || !initServerTui() {
 		initServerCli()
 	}
@@ -114,6 +117,11 @@ func initServerTuiInternal() error {
 	tui.errY = h - botScnH + 1
 	tui.errW = w - tui.msgW - 1
 	tui.res = table{6, []int{13, 5, 7, 7, 7, 8}, 0, 2, 0, justifyRight, noBorder}
+	if tui.resW >= 88 {
+		// Loss, reordering, duplicates and jitter of UDP tests are only shown
+		// when the terminal is wide enough for them.
+		tui.res = table{10, []int{13, 5, 7, 7, 7, 8, 7, 7, 7, 8}, 0, 2, 0, justifyRight, noBorder}
+	}
 	tui.results = make([][]string, 0)
 	tui.msg = table{1, []int{tui.msgW}, tui.msgX, tui.msgY, 0, justifyLeft, noBorder}
 	tui.msgRing = make([]string, botScnH-1)
@@ -182,7 +190,9 @@ func (u *serverTui) emitTestResultBegin() {
 }
 
 func (u *serverTui) emitTestResult(s *ethrSession, proto EthrProtocol, seconds uint64) {
-	str := getTestResults(s, proto, seconds)
+	// The table of results has no room for each connection, so the state of
+	// TCP connections is only written to the log.
+	str, _ := getTestResults(s, proto, seconds)
 	if len(str) > 0 {
 		ui.printTestResults(str)
 	}
@@ -200,15 +210,15 @@ func (u *serverTui) emitTestResultEnd() {
 }
 
 func (u *serverTui) emitTestHdr() {
-	s := []string{"RemoteAddress", "Proto", "Bits/s", "Conn/s", "Pkts/s", "Latency"}
+	s := []string{"RemoteAddress", "Proto", "Bits/s", "Conn/s", "Pkts/s", "Latency", "Loss", "OOO", "Dup", "Jitter"}
 	u.resultHdr = s
 }
 
 func (u *serverTui) emitLatencyHdr() {
 }
 
-func (u *serverTui) emitLatencyResults(remote, proto string, avg, min, max, p50, p90, p95, p99, p999, p9999 time.Duration) {
-	logLatency(remote, proto, avg, min, max, p50, p90, p95, p99, p999, p9999)
+func (u *serverTui) emitLatencyResults(remote, proto string, h *ethrHistogram, lost uint32) {
+	logLatency(remote, proto, h, lost)
 }
 
 func (u *serverTui) paint(seconds uint64) {
@@ -290,6 +300,12 @@ func (u *serverTui) emitStats(netStats ethrNetStat) {
 	gCurNetStats = netStats
 }
 
+func (u *serverTui) emitTestSummary(test *ethrTest, clientFin, serverFin *EthrMsgFin) {
+}
+
+func (u *serverTui) emitAggregateSummary(tests []*ethrTest, clientFins, serverFins []*EthrMsgFin) {
+}
+
 //
 // Simple command window based output
 //
@@ -342,9 +358,12 @@ func (u *serverCli) emitTestResultBegin() {
 }
 
 func (u *serverCli) emitTestResult(s *ethrSession, proto EthrProtocol, seconds uint64) {
-	str := getTestResults(s, proto, seconds)
+	str, conns := getTestResults(s, proto, seconds)
 	if len(str) > 0 {
 		ui.printTestResults(str)
+		for _, c := range conns {
+			fmt.Println(c)
+		}
 	}
 }
 
@@ -353,29 +372,36 @@ func (u *serverCli) emitTestResultEnd() {
 }
 
 func (u *serverCli) emitTestHdr() {
-	s := []string{"RemoteAddress", "Proto", "Bits/s", "Conn/s", "Pkt/s", "Latency"}
-	fmt.Println("-----------------------------------------------------------")
-	fmt.Printf("[%13s]  %5s  %7s  %7s  %7s  %8s\n", s[0], s[1], s[2], s[3], s[4], s[5])
+	s := []string{"RemoteAddress", "Proto", "Bits/s", "Conn/s", "Pkt/s", "Latency", "Loss", "OOO", "Dup", "Jitter"}
+	fmt.Println("-----------------------------------------------------------------------------------------")
+	fmt.Printf("[%13s]  %5s  %7s  %7s  %7s  %8s  %7s  %7s  %7s  %8s\n",
+		s[0], s[1], s[2], s[3], s[4], s[5], s[6], s[7], s[8], s[9])
 }
 
 func (u *serverCli) emitLatencyHdr() {
 }
 
-func (u *serverCli) emitLatencyResults(remote, proto string, avg, min, max, p50, p90, p95, p99, p999, p9999 time.Duration) {
-	logLatency(remote, proto, avg, min, max, p50, p90, p95, p99, p999, p9999)
+func (u *serverCli) emitLatencyResults(remote, proto string, h *ethrHistogram, lost uint32) {
+	logLatency(remote, proto, h, lost)
 }
 
 func (u *serverCli) emitStats(netStats ethrNetStat) {
 }
 
+func (u *serverCli) emitTestSummary(test *ethrTest, clientFin, serverFin *EthrMsgFin) {
+}
+
+func (u *serverCli) emitAggregateSummary(tests []*ethrTest, clientFins, serverFins []*EthrMsgFin) {
+}
+
 func (u *serverCli) printTestResults(s []string) {
 	logResults(s)
-	fmt.Printf("[%13s]  %5s  %7s  %7s  %7s  %8s\n", truncateStringFromStart(s[0], 13),
-		s[1], s[2], s[3], s[4], s[5])
+	fmt.Printf("[%13s]  %5s  %7s  %7s  %7s  %8s  %7s  %7s  %7s  %8s\n", truncateStringFromStart(s[0], 13),
+		s[1], s[2], s[3], s[4], s[5], s[6], s[7], s[8], s[9])
 }
 
 func emitAggregateResults() {
-	var protoList = []EthrProtocol{TCP, UDP, ICMP}
+	var protoList = []EthrProtocol{TCP, UDP, ICMP, HTTP, HTTPS, QUIC}
 	for _, proto := range protoList {
 		emitAggregate(proto)
 	}
@@ -389,7 +415,10 @@ func emitAggregate(proto EthrProtocol) {
 			bytesToRate(aggTestResult.bw),
 			cpsToString(aggTestResult.cps),
 			ppsToString(aggTestResult.pps),
-			""}
+			"", "", "", "", ""}
+		csvAddResult(ethrCSVResult{resultType: csvAggregateResult, proto: protoToString(proto),
+			bw: aggTestResult.bw * 8, pps: aggTestResult.pps, cps: aggTestResult.cps,
+			bwOn: aggTestResult.cbw > 0, ppsOn: aggTestResult.cpps > 0, cpsOn: aggTestResult.ccps > 0})
 	}
 	aggTestResult.bw = 0
 	aggTestResult.cps = 0
@@ -402,9 +431,17 @@ func emitAggregate(proto EthrProtocol) {
 	}
 }
 
-func getTestResults(s *ethrSession, proto EthrProtocol, seconds uint64) []string {
-	var bwTestOn, cpsTestOn, ppsTestOn, latTestOn bool
+//
+// getTestResults returns the results of the test of the protocol in the
+// session for the interval, and on Linux the state of each TCP connection of
+// Bandwidth tests, for UIs that have room for these.
+//
+func getTestResults(s *ethrSession, proto EthrProtocol, seconds uint64) ([]string, []string) {
+	var conns []string
+	var bwTestOn, cpsTestOn, ppsTestOn, latTestOn, lossTestOn bool
 	var bw, cps, pps, latency uint64
+	var udpStats ethrUDPStats
+	var jitter time.Duration
 	aggTestResult, _ := gAggregateTestResults[proto]
 	test, found := s.tests[EthrTestID{proto, All}]
 	if found && test.isActive {
@@ -414,7 +451,8 @@ func getTestResults(s *ethrSession, proto EthrProtocol, seconds uint64) []string
 		aggTestResult.bw += bw
 		aggTestResult.cbw++
 
-		if proto == TCP {
+		// For HTTP, requests per second are shown in place of connections per second.
+		if proto == TCP || proto == HTTP || proto == HTTPS || proto == QUIC {
 			cpsTestOn = true
 			cps = atomic.SwapUint64(&test.testResult.cps, 0)
 			cps /= seconds
@@ -428,22 +466,48 @@ func getTestResults(s *ethrSession, proto EthrProtocol, seconds uint64) []string
 			pps /= seconds
 			aggTestResult.pps += pps
 			aggTestResult.cpps++
+
+			udpStats, jitter = test.getUDPStats()
+			if udpStats.expected > 0 {
+				lossTestOn = true
+			}
 		}
 
-		if proto == TCP {
+		if proto == TCP || proto == QUIC {
 			latency = atomic.LoadUint64(&test.testResult.latency)
 			if latency > 0 {
 				latTestOn = true
 			}
+			test.connListDo(func(ec *ethrConn) {
+				cbw := atomic.SwapUint64(&ec.bw, 0) / seconds
+				// The server sends data of connections in reverse mode.
+				dir := "RX"
+				if ec.reverse {
+					dir = "TX"
+				}
+				ti, retrans, ok := ec.getTCPInfo()
+				if ok {
+					logConnResults(s.remoteIP, protoToString(proto), ec.fd, cbw, ti, retrans)
+					conns = append(conns, fmt.Sprintf("[%13s]  %5s  %7s  Retr %d  RTT %s  RTTVar %s  Cwnd %d  Pacing %s",
+						fmt.Sprintf("conn %d", ec.fd), dir, bytesToRate(cbw), retrans, durationToString(ti.rtt),
+						durationToString(ti.rttVar), ti.cwnd, bytesToRate(ti.pacingRate)))
+				}
+				r := newCSVResult(csvConnResult, test)
+				r.connID = fmt.Sprintf("%d", ec.fd)
+				r.dir = dir
+				r.bw, r.bwOn = cbw*8, true
+				csvAddResult(r)
+			})
 		}
 
 		if test.isDormant && !((bwTestOn && bw != 0) || (cpsTestOn && cps != 0) || (ppsTestOn && pps != 0) || (latTestOn && latency != 0)) {
-			return []string{}
+			return []string{}, nil
 		}
 	}
 
 	if bwTestOn || cpsTestOn || ppsTestOn || latTestOn {
 		var bwStr, cpsStr, ppsStr, latStr string = "--  ", "--  ", "--  ", "--  "
+		var lossStr, oooStr, dupStr, jitterStr string = "--  ", "--  ", "--  ", "--  "
 		if bwTestOn {
 			bwStr = bytesToRate(bw)
 		}
@@ -456,10 +520,23 @@ func getTestResults(s *ethrSession, proto EthrProtocol, seconds uint64) []string
 		if latTestOn {
 			latStr = durationToString(time.Duration(latency))
 		}
+		if lossTestOn {
+			lost := subOrZero(udpStats.expected, udpStats.rcvd)
+			lossStr = fmt.Sprintf("%.2f%%", float64(lost)*100/float64(udpStats.expected))
+			oooStr = numberToUnit(udpStats.ooo)
+			dupStr = numberToUnit(udpStats.dup)
+			jitterStr = durationToString(jitter)
+		}
+		metricsAddResult(ethrMetricsResult{s.remoteIP, protoToString(proto), test.title,
+			bw, cps, pps, latency, bwTestOn, cpsTestOn, ppsTestOn, latTestOn})
+		r := newCSVResult(csvTestResult, test)
+		r.bw, r.pps, r.cps, r.latency = bw*8, pps, cps, latency
+		r.bwOn, r.ppsOn, r.cpsOn, r.latOn = bwTestOn, ppsTestOn, cpsTestOn, latTestOn
+		csvAddResult(r)
 		str := []string{s.remoteIP, protoToString(proto),
-			bwStr, cpsStr, ppsStr, latStr}
-		return str
+			bwStr, cpsStr, ppsStr, latStr, lossStr, oooStr, dupStr, jitterStr}
+		return str, conns
 	}
 
-	return []string{}
+	return []string{}, nil
 }
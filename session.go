@@ -8,8 +8,10 @@ package main
 import (
 	"bytes"
 	"container/list"
+	"crypto/tls"
 	"encoding/binary"
 	"encoding/gob"
+	"encoding/json"
 	"io"
 	"net"
 	"os"
@@ -37,6 +39,9 @@ const (
 	TCP EthrProtocol = iota
 	UDP
 	ICMP
+	HTTP
+	HTTPS
+	QUIC
 )
 
 const (
@@ -44,6 +49,30 @@ const (
 	ICMPv6 = 58 // ICMP for IPv6
 )
 
+//
+// UDP latency probes start with a magic marker followed by a sequence number.
+// The marker lets the server tell probes apart from bandwidth and packets/s
+// traffic so that it can echo them back, and the sequence number lets the
+// client discard late replies to probes that have already timed out.
+//
+const (
+	udpLatencyMagic   = 0x45544c50 // "ETLP"
+	udpLatencyHdrLen  = 12
+	udpLatencyTimeout = time.Second
+)
+
+//
+// UDP bandwidth and packets/s datagrams start with a magic marker, followed
+// by a per flow sequence number and the send time in nanoseconds. These let
+// the server measure loss, reordering, duplication and jitter of the path.
+// Packets/s datagrams are 1 byte by default, same as in older versions of
+// Ethr, and only carry these if they are large enough.
+//
+const (
+	udpDataMagic  = 0x45544450 // "ETDP"
+	udpDataHdrLen = 20
+)
+
 type EthrTestID struct {
 	Protocol EthrProtocol
 	Type     EthrTestType
@@ -55,23 +84,117 @@ const (
 	EthrInv EthrMsgType = iota
 	EthrSyn
 	EthrAck
+	EthrFin
 )
 
 type EthrMsgVer uint32
 
+//
+// Version of control messages. Both sides use the highest version that both
+// support, so it is raised whenever older versions of Ethr can't understand
+// the messages. Version 0 is used by versions of Ethr from before messages
+// had a version, and their servers don't advertise what they support.
+// Messages are encoded using JSON from ethrMsgVersionJSON on, and using gob
+// for older versions, so that older clients still work. The SYN message of
+// the client is always encoded using gob, as the client doesn't know the
+// version of the server yet, so that older servers still work as well.
+//
+const (
+	ethrMsgVersion     EthrMsgVer = 2
+	ethrMsgVersionJSON EthrMsgVer = 2
+)
+
+//
+// Every control message is prefixed with its length. JSON messages are also
+// prefixed with a magic marker, which gob messages can't start with, since
+// their length is never larger than ethrMaxMsgSize. The marker is lowercase,
+// so that the server doesn't take it for the method of an HTTP request. See
+// README.md for the format of the messages.
+//
+const (
+	ethrJSONMsgMagic = 0x65746a73 // "etjs"
+	ethrMaxMsgSize   = 16384
+)
+
 type EthrMsg struct {
 	Version EthrMsgVer
 	Type    EthrMsgType
 	Syn     *EthrMsgSyn
 	Ack     *EthrMsgAck
+	Fin     *EthrMsgFin
 }
 
 type EthrMsgSyn struct {
 	TestID      EthrTestID
 	ClientParam EthrClientParam
+	Title       string
+	Auth        []byte
 }
 
+//
+// EthrMsgAck accepts the SYN message of the client, and advertises the
+// version of the server, the tests it supports, its limits, and the
+// congestion control algorithms and zero copy modes that it can use for TCP
+// tests. SockOpts are the socket options in effect on the server's end of the
+// connection of a TCP test, or of its UDP socket in the ACK of the session of
+// the client. If the server requires authentication, it first replies with a
+// Challenge, and if the client is rejected, Error tells the reason.
+//
 type EthrMsgAck struct {
+	Challenge          []byte
+	Error              string
+	ServerVersion      string
+	Tests              []EthrTestID
+	TLS                bool
+	Limits             EthrLimits
+	CongestionControls []string
+	ZeroCopyModes      []string
+	SockOpts           *EthrSockOpts
+}
+
+//
+// EthrLimits are the limits that the server enforces on each test. Limits
+// other than MaxBufferSize are not enforced if 0. MaxStreams and MaxBandwidth,
+// in bytes/s, apply to all tests of a client together.
+//
+type EthrLimits struct {
+	MaxBufferSize uint32
+	MaxStreams    uint32
+	MaxDuration   time.Duration
+	MaxBandwidth  uint64
+}
+
+//
+// EthrSockOpts are the socket options in effect on one end of a test, as
+// granted by the OS. MSS and NoDelay only apply to TCP, and GRO to UDP.
+//
+type EthrSockOpts struct {
+	SendBufferSize uint32
+	RecvBufferSize uint32
+	MSS            uint32
+	NoDelay        bool
+	GRO            bool
+}
+
+//
+// EthrMsgFin carries the totals measured by one side of a test. The client
+// sends its own totals once the test ends, and the server replies with what
+// it measured for the same test, so that both can be compared. Congestion
+// control is the algorithm of the TCP connections that the side sent data on.
+// CPUTime is the CPU time that Ethr used on the side during the test, for all
+// of its tests together, and OtherTests is the number of other tests that ran
+// on the side during the test, whose CPU time is included.
+//
+type EthrMsgFin struct {
+	TestID            EthrTestID
+	Bytes             uint64
+	ReverseBytes      uint64
+	Packets           uint64
+	Connections       uint64
+	Elapsed           time.Duration
+	CongestionControl string
+	CPUTime           time.Duration
+	OtherTests        uint32
 }
 
 type ethrTestResult struct {
@@ -80,6 +203,13 @@ type ethrTestResult struct {
 	pps     uint64
 	latency uint64
 	// clatency uint64
+	// Totals for the whole test, these are not reset by the stats timer.
+	// Bytes sent from server to client, i.e. in reverse direction, are
+	// counted in totalRevBw instead of totalBw.
+	totalBw    uint64
+	totalRevBw uint64
+	totalCps   uint64
+	totalPps   uint64
 }
 
 type ethrTest struct {
@@ -93,10 +223,27 @@ type ethrTest struct {
 	refCount    int32
 	testID      EthrTestID
 	clientParam EthrClientParam
+	title       string
 	testResult  ethrTestResult
 	done        chan struct{}
 	connList    *list.List
+	connLock    sync.RWMutex
+	startTime   time.Time
 	lastAccess  time.Time
+	wg          sync.WaitGroup
+	udpLock     sync.Mutex
+	udpFlows    map[string]*ethrUDPFlow
+	udpStats    ethrUDPStats
+	tlsConfig   *tls.Config
+	httpURL     string
+	quicAddr    string
+	authConn    net.Conn
+	noResults   bool
+	ccLock      sync.Mutex
+	cc          string
+	startCPU    time.Duration
+	otherTests  uint32
+	msgVersion  uint32
 }
 
 type ethrIPVer uint32
@@ -108,38 +255,74 @@ const (
 )
 
 type EthrClientParam struct {
-	NumThreads  uint32
-	BufferSize  uint32
-	RttCount    uint32
-	Reverse     bool
-	Duration    time.Duration
-	Gap         time.Duration
-	WarmupCount uint32
-	BwRate      uint64
-	ToS         uint8
+	NumThreads        uint32
+	BufferSize        uint32
+	RttCount          uint32
+	Reverse           bool
+	Duration          time.Duration
+	Gap               time.Duration
+	WarmupCount       uint32
+	BwRate            uint64
+	ToS               uint8
+	Bidirectional     bool
+	CongestionControl string
+	SendBufferSize    uint32
+	RecvBufferSize    uint32
+	MSS               uint32
+	Nagle             bool
+	ZeroCopy          string
+	Batch             uint32
+	UDPOffload        bool
 }
 
 type ethrServerParam struct {
-	showUI bool
+	showUI       bool
+	metricsAddr  string
+	certFile     string
+	keyFile      string
+	psk          []byte
+	allowList    []*net.IPNet
+	denyList     []*net.IPNet
+	maxSessions  uint32
+	maxStreams   uint32
+	maxDuration  time.Duration
+	maxBandwidth uint64
 }
 
 var gIPVersion ethrIPVer = ethrIPAny
 var gIsExternalClient bool
 
 type ethrConn struct {
-	bw      uint64
-	pps     uint64
-	test    *ethrTest
-	conn    net.Conn
-	elem    *list.Element
-	fd      uintptr
-	retrans uint64
+	bw       uint64
+	pps      uint64
+	test     *ethrTest
+	conn     net.Conn
+	elem     *list.Element
+	fd       uintptr
+	retrans  uint64
+	reverse  bool
+	subflows map[string]*ethrSubflow
+}
+
+//
+// ethrTCPInfo is the state of a TCP connection, as reported by the OS. It is
+// only available on Linux.
+//
+type ethrTCPInfo struct {
+	rtt           time.Duration
+	rttVar        time.Duration
+	cwnd          uint32
+	retrans       uint32
+	pacingRate    uint64
+	bytesAcked    uint64
+	bytesReceived uint64
 }
 
 type ethrSession struct {
 	remoteIP  string
 	testCount uint32
 	tests     map[EthrTestID]*ethrTest
+	limiter   *ethrBwLimiter
 }
 
 var gSessions = make(map[string]*ethrSession)
@@ -170,6 +353,7 @@ func newTestInternal(remoteIP string, testID EthrTestID, clientParam EthrClientP
 		session = &ethrSession{}
 		session.remoteIP = remoteIP
 		session.tests = make(map[EthrTestID]*ethrTest)
+		session.limiter = srvrNewBwLimiter()
 		gSessions[remoteIP] = session
 		gSessionKeys = append(gSessionKeys, remoteIP)
 	}
@@ -186,7 +370,9 @@ func newTestInternal(remoteIP string, testID EthrTestID, clientParam EthrClientP
 	test.clientParam = clientParam
 	test.done = make(chan struct{})
 	test.connList = list.New()
-	test.lastAccess = time.Now()
+	test.startTime = time.Now()
+	test.lastAccess = test.startTime
+	test.startCPU = getCPUTime()
 	test.isDormant = true
 	session.tests[testID] = test
 
@@ -219,6 +405,7 @@ func deleteTestInternal(test *ethrTest) {
 	//
 	delete(session.tests, testID)
 	session.testCount--
+	test.stopCPUTime()
 
 	if session.testCount == 0 {
 		deleteKey(session.remoteIP)
@@ -257,6 +444,40 @@ func createOrGetTest(remoteIP string, proto EthrProtocol, testType EthrTestType)
 	return
 }
 
+//
+// CPU time is only measured for the whole process, so the tests that measure
+// it are tracked, to tell how many other tests ran during each of them.
+//
+var gCPUTestsLock sync.Mutex
+var gCPUTests = make(map[*ethrTest]bool)
+
+//
+// startCPUTime starts measuring the CPU time of the test, again if the test
+// already measured it.
+//
+func (test *ethrTest) startCPUTime() {
+	gCPUTestsLock.Lock()
+	defer gCPUTestsLock.Unlock()
+	delete(gCPUTests, test)
+	for t := range gCPUTests {
+		t.otherTests++
+	}
+	test.otherTests = uint32(len(gCPUTests))
+	gCPUTests[test] = true
+	test.startCPU = getCPUTime()
+}
+
+//
+// stopCPUTime returns the CPU time since the test started measuring it, and
+// the number of other tests that measured it at any time in between.
+//
+func (test *ethrTest) stopCPUTime() (cpu time.Duration, otherTests uint32) {
+	gCPUTestsLock.Lock()
+	defer gCPUTestsLock.Unlock()
+	delete(gCPUTests, test)
+	return getCPUTime() - test.startCPU, test.otherTests
+}
+
 func safeDeleteTest(test *ethrTest) bool {
 	gSessionLock.Lock()
 	defer gSessionLock.Unlock()
@@ -274,18 +495,48 @@ func addRef(test *ethrTest) {
 	atomic.AddInt32(&test.refCount, 1)
 }
 
-func (test *ethrTest) newConn(conn net.Conn) (ec *ethrConn) {
-	gSessionLock.Lock()
-	defer gSessionLock.Unlock()
+func (test *ethrTest) newConn(conn net.Conn, reverse bool) (ec *ethrConn) {
+	fd := getFd(conn)
+	if s, ok := conn.(*ethrQUICStream); ok {
+		// Streams of a QUIC connection share its socket, so these are told
+		// apart by their stream ID instead.
+		fd = uintptr(s.StreamID())
+	}
+	return test.newConnWithFd(conn, fd, reverse)
+}
+
+//
+// The list of connections of a test has its own lock, so that connections can
+// come and go while the results of all tests are emitted under gSessionLock.
+//
+func (test *ethrTest) newConnWithFd(conn net.Conn, fd uintptr, reverse bool) (ec *ethrConn) {
+	test.connLock.Lock()
+	defer test.connLock.Unlock()
 	ec = &ethrConn{}
 	ec.test = test
 	ec.conn = conn
-	ec.fd = getFd(conn)
+	ec.fd = fd
+	ec.reverse = reverse
 	ec.elem = test.connList.PushBack(ec)
 	return
 }
 
+//
+// getTCPInfo reads the state of the TCP connection, along with the number of
+// segments retransmitted since it was last read.
+//
+func (ec *ethrConn) getTCPInfo() (ti ethrTCPInfo, retrans uint64, ok bool) {
+	ti, ok = getTCPInfo(ec.conn)
+	if !ok {
+		return
+	}
+	retrans = uint64(ti.retrans) - atomic.SwapUint64(&ec.retrans, uint64(ti.retrans))
+	return
+}
+
 func (test *ethrTest) delConn(conn net.Conn) {
+	test.connLock.Lock()
+	defer test.connLock.Unlock()
 	for e := test.connList.Front(); e != nil; e = e.Next() {
 		ec := e.Value.(*ethrConn)
 		if ec.conn == conn {
@@ -296,28 +547,72 @@ func (test *ethrTest) delConn(conn net.Conn) {
 }
 
 func (test *ethrTest) connListDo(f func(*ethrConn)) {
-	gSessionLock.RLock()
-	defer gSessionLock.RUnlock()
+	test.connLock.RLock()
+	defer test.connLock.RUnlock()
 	for e := test.connList.Front(); e != nil; e = e.Next() {
 		ec := e.Value.(*ethrConn)
 		f(ec)
 	}
 }
 
-func createSynMsg(testID EthrTestID, clientParam EthrClientParam) (ethrMsg *EthrMsg) {
-	ethrMsg = &EthrMsg{Version: 0, Type: EthrSyn}
+//
+// recordCongestionControl records the congestion control algorithm of a TCP
+// connection that the test sends data on, and takeCongestionControl returns
+// it for the results of the test, so that the next test starts afresh.
+//
+func (test *ethrTest) recordCongestionControl(conn net.Conn) {
+	cc := getCongestionControl(conn)
+	test.ccLock.Lock()
+	defer test.ccLock.Unlock()
+	test.cc = cc
+}
+
+func (test *ethrTest) takeCongestionControl() string {
+	test.ccLock.Lock()
+	defer test.ccLock.Unlock()
+	cc := test.cc
+	test.cc = ""
+	return cc
+}
+
+func createSynMsg(testID EthrTestID, clientParam EthrClientParam, title string) (ethrMsg *EthrMsg) {
+	ethrMsg = &EthrMsg{Version: ethrMsgVersion, Type: EthrSyn}
 	ethrMsg.Syn = &EthrMsgSyn{}
 	ethrMsg.Syn.TestID = testID
 	ethrMsg.Syn.ClientParam = clientParam
+	ethrMsg.Syn.Title = title
 	return
 }
 
-func createAckMsg() (ethrMsg *EthrMsg) {
-	ethrMsg = &EthrMsg{Version: 0, Type: EthrAck}
+//
+// createAckMsg creates an ACK message, using the version of messages
+// negotiated with a peer that supports up to peerVersion.
+//
+func createAckMsg(peerVersion EthrMsgVer) (ethrMsg *EthrMsg) {
+	ethrMsg = &EthrMsg{Type: EthrAck}
+	ethrMsg.Version = negotiateMsgVersion(peerVersion)
 	ethrMsg.Ack = &EthrMsgAck{}
 	return
 }
 
+func createFinMsg(peerVersion EthrMsgVer, fin *EthrMsgFin) (ethrMsg *EthrMsg) {
+	ethrMsg = &EthrMsg{Type: EthrFin}
+	ethrMsg.Version = negotiateMsgVersion(peerVersion)
+	ethrMsg.Fin = fin
+	return
+}
+
+//
+// negotiateMsgVersion returns the version of messages to use with a peer that
+// supports up to the given version.
+//
+func negotiateMsgVersion(peerVersion EthrMsgVer) EthrMsgVer {
+	if peerVersion > ethrMsgVersion {
+		return ethrMsgVersion
+	}
+	return peerVersion
+}
+
 func recvSessionMsg(conn net.Conn) (ethrMsg *EthrMsg) {
 	ethrMsg = &EthrMsg{}
 	ethrMsg.Type = EthrInv
@@ -328,8 +623,17 @@ func recvSessionMsg(conn net.Conn) (ethrMsg *EthrMsg) {
 		return
 	}
 	msgSize := binary.BigEndian.Uint32(msgBytes[0:])
-	// TODO: Assuming max ethr message size as 16K sent over gob.
-	if msgSize > 16384 {
+	isJSON := msgSize == ethrJSONMsgMagic
+	if isJSON {
+		_, err = io.ReadFull(conn, msgBytes)
+		if err != nil {
+			ui.printDbg("Error receiving message on control channel. Error: %v", err)
+			return
+		}
+		msgSize = binary.BigEndian.Uint32(msgBytes[0:])
+	}
+	if msgSize > ethrMaxMsgSize {
+		ui.printDbg("Message on control channel of %d bytes is larger than %d bytes.", msgSize, ethrMaxMsgSize)
 		return
 	}
 	msgBytes = make([]byte, msgSize)
@@ -338,7 +642,11 @@ func recvSessionMsg(conn net.Conn) (ethrMsg *EthrMsg) {
 		ui.printDbg("Error receiving message on control channel. Error: %v", err)
 		return
 	}
-	ethrMsg = decodeMsg(msgBytes)
+	if isJSON {
+		ethrMsg = decodeJSONMsg(msgBytes)
+	} else {
+		ethrMsg = decodeMsg(msgBytes)
+	}
 	return
 }
 
@@ -347,20 +655,28 @@ func recvSessionMsgFromBuffer(msgBytes []byte) (ethrMsg *EthrMsg) {
 	return
 }
 
+//
+// sendSessionMsg sends the message using JSON, or using gob if its version
+// is older than ethrMsgVersionJSON, i.e. when talking to older peers, or if it
+// is a SYN message.
+//
 func sendSessionMsg(conn net.Conn, ethrMsg *EthrMsg) (err error) {
-	msgBytes, err := encodeMsg(ethrMsg)
-	if err != nil {
-		ui.printDbg("Error sending message on control channel. Message: %v, Error: %v", ethrMsg, err)
-		return
+	var msgBytes, hdrBytes []byte
+	if ethrMsg.Version >= ethrMsgVersionJSON && ethrMsg.Type != EthrSyn {
+		msgBytes, err = encodeJSONMsg(ethrMsg)
+		hdrBytes = make([]byte, 8)
+		binary.BigEndian.PutUint32(hdrBytes[0:], ethrJSONMsgMagic)
+		binary.BigEndian.PutUint32(hdrBytes[4:], uint32(len(msgBytes)))
+	} else {
+		msgBytes, err = encodeMsg(ethrMsg)
+		hdrBytes = make([]byte, 4)
+		binary.BigEndian.PutUint32(hdrBytes[0:], uint32(len(msgBytes)))
 	}
-	msgSize := len(msgBytes)
-	tempBuf := make([]byte, 4)
-	binary.BigEndian.PutUint32(tempBuf[0:], uint32(msgSize))
-	_, err = conn.Write(tempBuf)
 	if err != nil {
 		ui.printDbg("Error sending message on control channel. Message: %v, Error: %v", ethrMsg, err)
+		return
 	}
-	_, err = conn.Write(msgBytes)
+	_, err = conn.Write(append(hdrBytes, msgBytes...))
 	if err != nil {
 		ui.printDbg("Error sending message on control channel. Message: %v, Error: %v", ethrMsg, err)
 	}
@@ -390,3 +706,21 @@ func encodeMsg(ethrMsg *EthrMsg) (msgBytes []byte, err error) {
 	msgBytes = writeBuffer.Bytes()
 	return
 }
+
+func decodeJSONMsg(msgBytes []byte) (ethrMsg *EthrMsg) {
+	ethrMsg = &EthrMsg{}
+	err := json.Unmarshal(msgBytes, ethrMsg)
+	if err != nil {
+		ui.printDbg("Failed to decode message using JSON: %v", err)
+		ethrMsg = &EthrMsg{Type: EthrInv}
+	}
+	return
+}
+
+func encodeJSONMsg(ethrMsg *EthrMsg) (msgBytes []byte, err error) {
+	msgBytes, err = json.Marshal(ethrMsg)
+	if err != nil {
+		ui.printDbg("Failed to encode message using JSON: %v", err)
+	}
+	return
+}
@@ -0,0 +1,211 @@
+//-----------------------------------------------------------------------------
+// Copyright (C) Microsoft. All rights reserved.
+// Licensed under the MIT license.
+// See LICENSE.txt file in the project root for full license information.
+//-----------------------------------------------------------------------------
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+//
+// legacyMsg is a control message as encoded by versions of Ethr from before
+// JSON messages, which only know gob frames prefixed with their length.
+//
+type legacyMsg struct {
+	Version EthrMsgVer
+	Type    EthrMsgType
+	Syn     *legacyMsgSyn
+	Ack     *legacyMsgAck
+}
+
+type legacyMsgSyn struct {
+	TestID      EthrTestID
+	ClientParam legacyClientParam
+}
+
+type legacyClientParam struct {
+	NumThreads  uint32
+	BufferSize  uint32
+	RttCount    uint32
+	Reverse     bool
+	Duration    time.Duration
+	Gap         time.Duration
+	WarmupCount uint32
+	BwRate      uint64
+	ToS         uint8
+}
+
+type legacyMsgAck struct {
+	ServerVersion string
+}
+
+//
+// bufConn is a connection that writes to and reads from the same buffer.
+//
+type bufConn struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (c *bufConn) Read(b []byte) (int, error) {
+	return c.buf.Read(b)
+}
+
+func (c *bufConn) Write(b []byte) (int, error) {
+	return c.buf.Write(b)
+}
+
+func init() {
+	initClientUI("")
+}
+
+func legacySend(t *testing.T, conn net.Conn, msg *legacyMsg) {
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(msg); err != nil {
+		t.Fatalf("failed to encode legacy message: %v", err)
+	}
+	hdr := make([]byte, 4)
+	binary.BigEndian.PutUint32(hdr, uint32(b.Len()))
+	conn.Write(append(hdr, b.Bytes()...))
+}
+
+func legacyRecv(t *testing.T, conn net.Conn) *legacyMsg {
+	hdr := make([]byte, 4)
+	if _, err := io.ReadFull(conn, hdr); err != nil {
+		t.Fatalf("failed to read length of message: %v", err)
+	}
+	size := binary.BigEndian.Uint32(hdr)
+	if size > ethrMaxMsgSize {
+		t.Fatalf("older peer drops message of %d bytes, larger than %d bytes", size, ethrMaxMsgSize)
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		t.Fatalf("failed to read message: %v", err)
+	}
+	msg := &legacyMsg{}
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(msg); err != nil {
+		t.Fatalf("older peer failed to decode message: %v", err)
+	}
+	return msg
+}
+
+func isJSONFrame(conn *bufConn) bool {
+	b := conn.buf.Bytes()
+	return len(b) >= 4 && binary.BigEndian.Uint32(b) == ethrJSONMsgMagic
+}
+
+func TestSessionMsgGobRoundTrip(t *testing.T) {
+	conn := &bufConn{}
+	fin := &EthrMsgFin{Bytes: 1000, Packets: 10, Elapsed: time.Second}
+	if err := sendSessionMsg(conn, createFinMsg(1, fin)); err != nil {
+		t.Fatalf("failed to send message: %v", err)
+	}
+	if isJSONFrame(conn) {
+		t.Fatalf("message of version 1 is sent as a JSON frame")
+	}
+	msg := recvSessionMsg(conn)
+	if msg.Type != EthrFin || msg.Version != 1 || msg.Fin == nil || *msg.Fin != *fin {
+		t.Fatalf("unexpected message: %+v", msg)
+	}
+}
+
+func TestSessionMsgJSONRoundTrip(t *testing.T) {
+	conn := &bufConn{}
+	ack := createAckMsg(ethrMsgVersionJSON)
+	ack.Ack.ServerVersion = "test"
+	ack.Ack.Tests = []EthrTestID{{TCP, Bandwidth}, {UDP, Pps}}
+	if err := sendSessionMsg(conn, ack); err != nil {
+		t.Fatalf("failed to send message: %v", err)
+	}
+	if !isJSONFrame(conn) {
+		t.Fatalf("message of version %d is not sent as a JSON frame", ethrMsgVersionJSON)
+	}
+	msg := recvSessionMsg(conn)
+	if msg.Type != EthrAck || msg.Version != ethrMsgVersionJSON || msg.Ack == nil ||
+		msg.Ack.ServerVersion != "test" || len(msg.Ack.Tests) != 2 || msg.Ack.Tests[1] != (EthrTestID{UDP, Pps}) {
+		t.Fatalf("unexpected message: %+v", msg)
+	}
+}
+
+func TestSessionMsgNewClientOldServer(t *testing.T) {
+	conn := &bufConn{}
+	testID := EthrTestID{TCP, Bandwidth}
+	syn := createSynMsg(testID, EthrClientParam{NumThreads: 4, BufferSize: 16384}, "title")
+	if err := sendSessionMsg(conn, syn); err != nil {
+		t.Fatalf("failed to send SYN: %v", err)
+	}
+	if isJSONFrame(conn) {
+		t.Fatalf("SYN is sent as a JSON frame, which older servers drop")
+	}
+	msg := legacyRecv(t, conn)
+	if msg.Type != EthrSyn || msg.Syn == nil || msg.Syn.TestID != testID ||
+		msg.Syn.ClientParam.NumThreads != 4 || msg.Syn.ClientParam.BufferSize != 16384 {
+		t.Fatalf("unexpected SYN on older server: %+v", msg)
+	}
+	// Servers from before messages had a version reply with version 0, and
+	// later servers with the version they support, using gob.
+	for _, version := range []EthrMsgVer{0, 1} {
+		legacySend(t, conn, &legacyMsg{Version: version, Type: EthrAck, Ack: &legacyMsgAck{}})
+		ack := recvSessionMsg(conn)
+		if ack.Type != EthrAck || ack.Version != version {
+			t.Fatalf("unexpected ACK of older server: %+v", ack)
+		}
+		if negotiateMsgVersion(ack.Version) != version {
+			t.Fatalf("version %d of older server is not used", version)
+		}
+	}
+}
+
+func TestSessionMsgOldClientNewServer(t *testing.T) {
+	conn := &bufConn{}
+	testID := EthrTestID{UDP, Pps}
+	legacySend(t, conn, &legacyMsg{Type: EthrSyn, Syn: &legacyMsgSyn{TestID: testID,
+		ClientParam: legacyClientParam{NumThreads: 2, Duration: time.Second}}})
+	syn := recvSessionMsg(conn)
+	if syn.Type != EthrSyn || syn.Version != 0 || syn.Syn == nil || syn.Syn.TestID != testID ||
+		syn.Syn.ClientParam.NumThreads != 2 || syn.Syn.ClientParam.Duration != time.Second {
+		t.Fatalf("unexpected SYN of older client: %+v", syn)
+	}
+	ack := createAckMsg(syn.Version)
+	ack.Ack.ServerVersion = "test"
+	if err := sendSessionMsg(conn, ack); err != nil {
+		t.Fatalf("failed to send ACK: %v", err)
+	}
+	if isJSONFrame(conn) {
+		t.Fatalf("ACK to older client is sent as a JSON frame")
+	}
+	msg := legacyRecv(t, conn)
+	if msg.Type != EthrAck || msg.Version != 0 || msg.Ack == nil || msg.Ack.ServerVersion != "test" {
+		t.Fatalf("unexpected ACK on older client: %+v", msg)
+	}
+}
+
+func TestSessionMsgNewClientNewServer(t *testing.T) {
+	conn := &bufConn{}
+	syn := createSynMsg(EthrTestID{TCP, Latency}, EthrClientParam{RttCount: 100}, "title")
+	if err := sendSessionMsg(conn, syn); err != nil {
+		t.Fatalf("failed to send SYN: %v", err)
+	}
+	msg := recvSessionMsg(conn)
+	if msg.Type != EthrSyn || msg.Version != ethrMsgVersion || msg.Syn == nil || msg.Syn.Title != "title" {
+		t.Fatalf("unexpected SYN: %+v", msg)
+	}
+	if err := sendSessionMsg(conn, createAckMsg(msg.Version)); err != nil {
+		t.Fatalf("failed to send ACK: %v", err)
+	}
+	if !isJSONFrame(conn) {
+		t.Fatalf("ACK to client of version %d is not sent as a JSON frame", ethrMsgVersion)
+	}
+	ack := recvSessionMsg(conn)
+	if ack.Type != EthrAck || negotiateMsgVersion(ack.Version) != ethrMsgVersion {
+		t.Fatalf("unexpected ACK: %+v", ack)
+	}
+}
@@ -0,0 +1,205 @@
+//-----------------------------------------------------------------------------
+// Copyright (C) Microsoft. All rights reserved.
+// Licensed under the MIT license.
+// See LICENSE.txt file in the project root for full license information.
+//-----------------------------------------------------------------------------
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+//
+// The client can set the socket buffer sizes, the MSS and Nagle's algorithm
+// of the sockets of a test, and sends these to the server in the SYN message,
+// so that both ends of the test use them. The client sets these before it
+// connects, so that the window scale and MSS in the SYN follow them, whereas
+// the server sets these once the connection is accepted. UDP tests share a
+// single socket on the server, so the server only ever grows its receive
+// buffer to the size that a client asks for. The OS may grant sizes other
+// than asked for, e.g. Linux doubles buffer sizes for its own bookkeeping and
+// caps them to the system limits, so the sizes in effect are shown instead.
+//
+
+// Socket options of the connections of tests on the client, sizes of 0 leave
+// the default of the OS.
+var gSendBufferSize = uint32(0)
+var gRecvBufferSize = uint32(0)
+var gMSS = uint32(0)
+var gNagle = false
+
+func sockOptsRequested(clientParam EthrClientParam) bool {
+	return clientParam.SendBufferSize > 0 || clientParam.RecvBufferSize > 0 ||
+		clientParam.MSS > 0 || clientParam.Nagle
+}
+
+func ethrSetBufferSizes(fd uintptr, sndBuf, rcvBuf uint32) {
+	if sndBuf > 0 {
+		setSockOptInt(fd, syscall.SOL_SOCKET, syscall.SO_SNDBUF, int(sndBuf))
+	}
+	if rcvBuf > 0 {
+		setSockOptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF, int(rcvBuf))
+	}
+}
+
+func ethrSetMSS(fd uintptr, mss uint32) {
+	if mss > 0 {
+		setSockOptInt(fd, syscall.IPPROTO_TCP, tcpMaxSeg, int(mss))
+	}
+}
+
+//
+// ethrSetNagle enables Nagle's algorithm, i.e. clears TCP_NODELAY, which Go
+// sets on every TCP connection once connected.
+//
+func ethrSetNagle(fd uintptr, nagle bool) {
+	if nagle {
+		setSockOptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_NODELAY, 0)
+	}
+}
+
+//
+// srvrSetSockOpts sets the socket options that the client asks for on a TCP
+// connection of a test, and returns the options in effect.
+//
+func srvrSetSockOpts(conn net.Conn, clientParam EthrClientParam) *EthrSockOpts {
+	rc := getRawConn(conn)
+	if rc == nil {
+		return nil
+	}
+	rc.Control(func(fd uintptr) {
+		ethrSetBufferSizes(fd, clientParam.SendBufferSize, clientParam.RecvBufferSize)
+		ethrSetMSS(fd, clientParam.MSS)
+		ethrSetNagle(fd, clientParam.Nagle)
+	})
+	opts, ok := getSockOpts(conn, TCP)
+	if !ok {
+		return nil
+	}
+	return &opts
+}
+
+var gUDPConn *net.UDPConn
+var gUDPConnLock sync.Mutex
+var gUDPReadBuffer int
+var gUDPGRO bool
+
+//
+// srvrSetUDPReadBuffer sets the receive buffer of the UDP socket of the server,
+// unless it is already larger, and returns the options in effect.
+//
+func srvrSetUDPReadBuffer(size int) *EthrSockOpts {
+	gUDPConnLock.Lock()
+	defer gUDPConnLock.Unlock()
+	if gUDPConn == nil {
+		return nil
+	}
+	if size > gUDPReadBuffer {
+		err := gUDPConn.SetReadBuffer(size)
+		if err != nil {
+			ui.printDbg("Failed to set ReadBuffer on UDP socket: %v", err)
+		} else {
+			gUDPReadBuffer = size
+		}
+	}
+	opts, ok := getSockOpts(gUDPConn, UDP)
+	if !ok {
+		return nil
+	}
+	opts.GRO = gUDPGRO
+	return &opts
+}
+
+//
+// srvrEnableUDPGRO enables UDP GRO on the UDP socket of the server, unless it
+// is already enabled.
+//
+func srvrEnableUDPGRO() {
+	gUDPConnLock.Lock()
+	defer gUDPConnLock.Unlock()
+	if gUDPConn == nil || gUDPGRO {
+		return
+	}
+	err := setUDPGRO(gUDPConn)
+	if err != nil {
+		ui.printDbg("Failed to enable GRO on UDP socket: %v", err)
+		return
+	}
+	gUDPGRO = true
+}
+
+func getSockOpts(conn net.Conn, p EthrProtocol) (opts EthrSockOpts, ok bool) {
+	rc := getRawConn(conn)
+	if rc == nil {
+		return
+	}
+	var err error
+	cerr := rc.Control(func(fd uintptr) {
+		var v int
+		v, err = getSockOptInt(fd, syscall.SOL_SOCKET, syscall.SO_SNDBUF)
+		if err != nil {
+			return
+		}
+		opts.SendBufferSize = uint32(v)
+		v, err = getSockOptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+		if err != nil {
+			return
+		}
+		opts.RecvBufferSize = uint32(v)
+		if p != TCP {
+			return
+		}
+		// Not all platforms report the MSS, so it is left out if it fails.
+		v, mssErr := getSockOptInt(fd, syscall.IPPROTO_TCP, tcpMaxSeg)
+		if mssErr == nil {
+			opts.MSS = uint32(v)
+		}
+		v, err = getSockOptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_NODELAY)
+		opts.NoDelay = v != 0
+	})
+	ok = cerr == nil && err == nil
+	return
+}
+
+func sockOptsToString(opts EthrSockOpts, p EthrProtocol) string {
+	s := []string{
+		"send buffer " + numberToUnit(uint64(opts.SendBufferSize)) + "B",
+		"receive buffer " + numberToUnit(uint64(opts.RecvBufferSize)) + "B",
+	}
+	if p == TCP {
+		if opts.MSS > 0 {
+			s = append(s, fmt.Sprintf("MSS %d", opts.MSS))
+		}
+		if opts.NoDelay {
+			s = append(s, "nodelay on")
+		} else {
+			s = append(s, "nodelay off")
+		}
+	}
+	if opts.GRO {
+		s = append(s, "GRO on")
+	}
+	return strings.Join(s, ", ")
+}
+
+//
+// clientPrintSockOpts shows the socket options in effect on a connection of a
+// test, and on the server's end of it, as the server tells in its ACK message,
+// if the client asked for any options.
+//
+func clientPrintSockOpts(test *ethrTest, fd uintptr, conn net.Conn, p EthrProtocol, ack *EthrMsgAck) {
+	if !sockOptsRequested(test.clientParam) {
+		return
+	}
+	opts, ok := getSockOpts(conn, p)
+	if ok {
+		ui.printMsg("[%3d] client socket: %s", fd, sockOptsToString(opts, p))
+	}
+	if ack != nil && ack.SockOpts != nil {
+		ui.printMsg("[%3d] server socket: %s", fd, sockOptsToString(*ack.SockOpts, p))
+	}
+}
@@ -107,6 +107,7 @@ func startStatsTimer() {
 	SleepUntilNextWholeSecond()
 
 	lastStatsTime = time.Now()
+	csvStartNetStats()
 	ticker := time.NewTicker(time.Second)
 	statsEnabled = true
 	go func() {
@@ -139,10 +140,16 @@ func emitStats() {
 	if seconds < 1 {
 		seconds = 1
 	}
+	metricsBegin()
+	csvBegin()
 	ui.emitTestResultBegin()
 	emitTestResults(uint64(seconds))
 	ui.emitTestResultEnd()
-	ui.emitStats(getNetworkStats())
+	metricsEnd()
+	netStats := getNetworkStats()
+	csvAddNetStats(netStats, uint64(seconds))
+	csvEnd()
+	ui.emitStats(netStats)
 	ui.paint(uint64(seconds))
 }
 
@@ -154,5 +161,8 @@ func emitTestResults(s uint64) {
 		ui.emitTestResult(v, TCP, s)
 		ui.emitTestResult(v, UDP, s)
 		ui.emitTestResult(v, ICMP, s)
+		ui.emitTestResult(v, HTTP, s)
+		ui.emitTestResult(v, HTTPS, s)
+		ui.emitTestResult(v, QUIC, s)
 	}
 }
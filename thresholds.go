@@ -0,0 +1,248 @@
+//-----------------------------------------------------------------------------
+// Copyright (C) Microsoft. All rights reserved.
+// Licensed under the MIT license.
+// See LICENSE.txt file in the project root for full license information.
+//-----------------------------------------------------------------------------
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+//
+// A run of the client can be judged against thresholds, so that Ethr can be
+// used as a gate, e.g. in a pipeline that rolls out network changes. At the
+// end of the run, Ethr shows each threshold with the result of the run and a
+// verdict, and exits with a code that tells why the run failed. Bandwidth,
+// connections/s and the p99 latency are averaged over all intervals of the
+// run, the same as for a comparison with a baseline, and packet loss is the
+// share of lost packets or probes of the whole run. A threshold is violated
+// as well when the run has no result for it.
+//
+const (
+	exitCodeThreshold      = 3
+	exitCodeConnectFailed  = 4
+	exitCodeServerRejected = 5
+)
+
+type ethrThresholds struct {
+	minBw     uint64
+	minCps    uint64
+	maxP99    time.Duration
+	maxLoss   float64
+	minBwOn   bool
+	minCpsOn  bool
+	maxP99On  bool
+	maxLossOn bool
+}
+
+func (t ethrThresholds) isSet() bool {
+	return t.minBwOn || t.minCpsOn || t.maxP99On || t.maxLossOn
+}
+
+//
+// ethrRunStatus keeps what the verdict needs beyond the results of the run:
+// whether connections to each address of the server failed, whether the
+// server rejected the client, the packets that were lost, and whether the
+// run was interrupted.
+//
+type ethrRunStatus struct {
+	lock        sync.Mutex
+	dials       map[string]*ethrDialCount
+	dialOrder   []string
+	rejectErr   error
+	sent        uint64
+	lost        uint64
+	interrupted bool
+}
+
+type ethrDialCount struct {
+	ok     uint64
+	failed uint64
+}
+
+var gRunStatus = ethrRunStatus{dials: make(map[string]*ethrDialCount)}
+
+//
+// resetRunStatus starts a new run, e.g. the next step of a scenario.
+//
+func resetRunStatus() {
+	gRunStatus.lock.Lock()
+	defer gRunStatus.lock.Unlock()
+	gRunStatus.dials = make(map[string]*ethrDialCount)
+	gRunStatus.dialOrder = nil
+	gRunStatus.rejectErr = nil
+	gRunStatus.sent, gRunStatus.lost = 0, 0
+	gRunStatus.interrupted = false
+}
+
+func recordDial(dialAddr string, err error) {
+	gRunStatus.lock.Lock()
+	defer gRunStatus.lock.Unlock()
+	d, found := gRunStatus.dials[dialAddr]
+	if !found {
+		d = &ethrDialCount{}
+		gRunStatus.dials[dialAddr] = d
+		gRunStatus.dialOrder = append(gRunStatus.dialOrder, dialAddr)
+	}
+	if err == nil {
+		d.ok++
+	} else {
+		d.failed++
+	}
+}
+
+func recordServerReject(err error) {
+	gRunStatus.lock.Lock()
+	defer gRunStatus.lock.Unlock()
+	if gRunStatus.rejectErr == nil {
+		gRunStatus.rejectErr = err
+	}
+}
+
+func recordStopReason(reason int) {
+	if reason != interrupt {
+		return
+	}
+	gRunStatus.lock.Lock()
+	gRunStatus.interrupted = true
+	gRunStatus.lock.Unlock()
+}
+
+func isRunInterrupted() bool {
+	gRunStatus.lock.Lock()
+	defer gRunStatus.lock.Unlock()
+	return gRunStatus.interrupted
+}
+
+func recordLoss(sent, lost uint64) {
+	gRunStatus.lock.Lock()
+	defer gRunStatus.lock.Unlock()
+	gRunStatus.sent += sent
+	gRunStatus.lost += lost
+}
+
+//
+// recordTestLoss records the UDP packets of a test that the receiver didn't
+// get, from the totals that the client and the server exchanged at its end.
+//
+func recordTestLoss(test *ethrTest, clientFin, serverFin *EthrMsgFin) {
+	if serverFin == nil || test.testID.Protocol != UDP || test.clientParam.Bidirectional {
+		return
+	}
+	sent, rcvd := clientFin.Packets, serverFin.Packets
+	if test.clientParam.Reverse {
+		sent, rcvd = rcvd, sent
+	}
+	if sent == 0 {
+		return
+	}
+	lost := uint64(0)
+	if sent > rcvd {
+		lost = sent - rcvd
+	}
+	recordLoss(sent, lost)
+}
+
+//
+// unreachableAddr returns an address of the server that the client dialed
+// but couldn't connect to at all.
+//
+func unreachableAddr() string {
+	gRunStatus.lock.Lock()
+	defer gRunStatus.lock.Unlock()
+	for _, addr := range gRunStatus.dialOrder {
+		d := gRunStatus.dials[addr]
+		if d.ok == 0 && d.failed > 0 {
+			return addr
+		}
+	}
+	return ""
+}
+
+func getRunLoss() (loss float64, ok bool) {
+	gRunStatus.lock.Lock()
+	defer gRunStatus.lock.Unlock()
+	if gRunStatus.sent == 0 {
+		return
+	}
+	return float64(gRunStatus.lost) * 100 / float64(gRunStatus.sent), true
+}
+
+//
+// checkThresholds shows each threshold with the result of the run, and
+// returns whether any of them is violated.
+//
+func checkThresholds(t ethrThresholds, results *ethrRunResults, proto string) (violated bool) {
+	ui.printMsg("- - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - -")
+	ui.printMsg("Thresholds:")
+	ui.printMsg("Metric               Threshold       Result   Verdict")
+	check := func(metric, threshold, result string, pass bool) {
+		verdict := "PASS"
+		if !pass {
+			verdict = "FAIL"
+			violated = true
+		}
+		ui.printMsg("  %-14s   %11s   %10s   %s", metric, threshold, result, verdict)
+	}
+	if t.minBwOn {
+		v, ok := results.get(proto, "Bits/s")
+		check("Bits/s", ">= "+numberToUnit(t.minBw), runValueToString(ok, numberToUnit(uint64(v))),
+			ok && uint64(v) >= t.minBw)
+	}
+	if t.minCpsOn {
+		v, ok := results.get(proto, "Conn/s")
+		check("Conn/s", ">= "+numberToUnit(t.minCps), runValueToString(ok, numberToUnit(uint64(v))),
+			ok && uint64(v) >= t.minCps)
+	}
+	if t.maxP99On {
+		v, ok := results.get(proto, "Latency P99")
+		check("Latency P99", "<= "+durationToString(t.maxP99), runValueToString(ok, durationToString(time.Duration(v))),
+			ok && time.Duration(v) <= t.maxP99)
+	}
+	if t.maxLossOn {
+		v, ok := getRunLoss()
+		check("Packet loss", fmt.Sprintf("<= %.2f%%", t.maxLoss), runValueToString(ok, fmt.Sprintf("%.2f%%", v)),
+			ok && v <= t.maxLoss)
+	}
+	return
+}
+
+func runValueToString(ok bool, s string) string {
+	if !ok {
+		return "--"
+	}
+	return s
+}
+
+//
+// judgeRun shows the verdict of the run and returns it, with the exit code
+// for it. When a run fails for more than one reason, the exit code is that of
+// the most basic one, i.e. a rejection by the server comes before a failure
+// to connect, which comes before violated thresholds and regressions.
+//
+func judgeRun(t ethrThresholds, results *ethrRunResults, proto string, regressed, judged bool) (code int, verdict string) {
+	violated := false
+	if t.isSet() {
+		violated = checkThresholds(t, results, proto)
+	}
+	gRunStatus.lock.Lock()
+	rejectErr := gRunStatus.rejectErr
+	gRunStatus.lock.Unlock()
+	code, verdict = 0, "PASS"
+	if rejectErr != nil {
+		code, verdict = exitCodeServerRejected, fmt.Sprintf("FAIL, server rejected the client: %v", rejectErr)
+	} else if addr := unreachableAddr(); addr != "" {
+		code, verdict = exitCodeConnectFailed, fmt.Sprintf("FAIL, could not connect to %s", addr)
+	} else if violated {
+		code, verdict = exitCodeThreshold, "FAIL, threshold violated"
+	} else if regressed {
+		code, verdict = exitCodeRegression, "FAIL, regression against the baseline"
+	}
+	if judged || code != 0 {
+		ui.printMsg("Verdict: %s", verdict)
+	}
+	return
+}
@@ -0,0 +1,199 @@
+//-----------------------------------------------------------------------------
+// Copyright (C) Microsoft. All rights reserved.
+// Licensed under the MIT license.
+// See LICENSE.txt file in the project root for full license information.
+//-----------------------------------------------------------------------------
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+
+	"golang.org/x/net/ipv4"
+)
+
+//
+// Sending and receiving one datagram per system call limits UDP tests to far
+// fewer packets/s than the kernel and NIC can handle. On Linux, the client can
+// send a batch of datagrams in each call using sendmmsg(2), and the server
+// always receives datagrams in batches using recvmmsg(2). With UDP offload,
+// the client also sends the datagrams of a batch as a few large buffers that
+// the kernel, or the NIC, splits into datagrams (UDP GSO), and the server
+// asks the kernel to deliver datagrams of a flow coalesced (UDP GRO), which
+// it splits again. The server socket is shared by all clients, so once a
+// client asks for GRO, it stays enabled.
+//
+const (
+	udpMaxBatch         = 1024
+	udpServerBatch      = 16
+	udpGSOMaxSegments   = 64
+	udpGSOMaxBufferSize = 65507
+)
+
+//
+// ethrBatchConn sends and receives batches of datagrams. Messages of ipv4 and
+// ipv6 are the same type, and either works on sockets of both families.
+//
+type ethrBatchConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+func newBatchConn(conn *net.UDPConn) ethrBatchConn {
+	return ipv4.NewPacketConn(conn)
+}
+
+//
+// ethrUDPBatchSender sends the datagrams of UDP Bandwidth and Packets/s tests
+// in batches.
+//
+type ethrUDPBatchSender struct {
+	conn    ethrBatchConn
+	buff    []byte
+	msgs    []ipv4.Message
+	offload bool
+}
+
+func newUDPBatchSender(conn ethrBatchConn, batch, bufferLen int, offload bool) *ethrUDPBatchSender {
+	s := &ethrUDPBatchSender{
+		conn:    conn,
+		buff:    make([]byte, batch*bufferLen),
+		msgs:    make([]ipv4.Message, batch),
+		offload: offload,
+	}
+	for i := range s.msgs {
+		s.msgs[i].Buffers = make([][]byte, 1)
+	}
+	return s
+}
+
+//
+// udpGSOSegments returns the number of datagrams of the given size that are
+// sent in each buffer with UDP GSO.
+//
+func udpGSOSegments(size int) int {
+	segs := udpGSOMaxBufferSize / size
+	if segs > udpGSOMaxSegments {
+		segs = udpGSOMaxSegments
+	}
+	if segs < 1 {
+		segs = 1
+	}
+	return segs
+}
+
+//
+// udpSendBatch returns the number of datagrams that the client sends in each
+// system call. With UDP offload, that is at least the datagrams of one GSO
+// buffer, so that offload works without a batch.
+//
+func udpSendBatch(batch, size int, offload bool) int {
+	if offload && batch < udpGSOSegments(size) {
+		batch = udpGSOSegments(size)
+	}
+	if batch < 1 {
+		batch = 1
+	}
+	return batch
+}
+
+//
+// send sends count datagrams of size bytes, numbered from seq+1 on, and
+// returns the number of bytes sent. seq is updated to the last datagram.
+// Datagrams that are too small for the header are sent as they are.
+//
+func (s *ethrUDPBatchSender) send(seq *uint64, count, size int) (int, error) {
+	now := uint64(time.Now().UnixNano())
+	for i := 0; i < count && size >= udpDataHdrLen; i++ {
+		d := s.buff[i*size : (i+1)*size]
+		*seq++
+		binary.BigEndian.PutUint32(d[0:], udpDataMagic)
+		binary.BigEndian.PutUint64(d[4:], *seq)
+		binary.BigEndian.PutUint64(d[12:], now)
+	}
+	segs := 1
+	var oob []byte
+	if s.offload {
+		segs = udpGSOSegments(size)
+		oob = udpSegmentOOB(size)
+	}
+	nmsgs := 0
+	for i := 0; i < count; i += segs {
+		end := i + segs
+		if end > count {
+			end = count
+		}
+		m := &s.msgs[nmsgs]
+		m.Buffers[0] = s.buff[i*size : end*size]
+		m.OOB = nil
+		if end-i > 1 {
+			m.OOB = oob
+		}
+		nmsgs++
+	}
+	bytes := 0
+	for sent := 0; sent < nmsgs; {
+		n, err := s.conn.WriteBatch(s.msgs[sent:nmsgs], 0)
+		for _, m := range s.msgs[sent : sent+n] {
+			bytes += m.N
+		}
+		if err != nil {
+			return bytes, err
+		}
+		sent += n
+	}
+	return bytes, nil
+}
+
+//
+// udpBatchCount returns the number of datagrams to send in the next batch,
+// which doesn't send more than the bytes left to send in this second, if the
+// bandwidth is limited.
+//
+func udpBatchCount(batch int, totalBytesToSend, sentBytes uint64, size int) int {
+	if totalBytesToSend == 0 || sentBytes >= totalBytesToSend {
+		return batch
+	}
+	count := int((totalBytesToSend - sentBytes) / uint64(size))
+	if count < 1 {
+		count = 1
+	}
+	if count > batch {
+		count = batch
+	}
+	return count
+}
+
+//
+// srvrReadUDPBatches receives datagrams of UDP tests in batches, and splits
+// datagrams that the kernel coalesced with GRO.
+//
+func srvrReadUDPBatches(conn *net.UDPConn, tests map[string]*ethrTest, rejected *ethrRejectLog) {
+	bc := newBatchConn(conn)
+	msgs := make([]ipv4.Message, udpServerBatch)
+	for i := range msgs {
+		// For UDP, allocate buffer that can accomodate largest UDP datagram,
+		// which is also the largest buffer that GRO coalesces datagrams into.
+		msgs[i].Buffers = [][]byte{make([]byte, 64*1024)}
+		msgs[i].OOB = make([]byte, 64)
+	}
+	for {
+		n, err := bc.ReadBatch(msgs, 0)
+		if err != nil {
+			ui.printDbg("Error receiving data from UDP for bandwidth test: %v", err)
+			return
+		}
+		for _, m := range msgs[:n] {
+			remoteIP, ok := m.Addr.(*net.UDPAddr)
+			if !ok {
+				continue
+			}
+			seg := getUDPGROSize(m.OOB[:m.NN])
+			if seg <= 0 {
+				seg = m.N
+			}
+			srvrHandleUDPPackets(conn, tests, rejected, m.Buffers[0][:m.N], seg, remoteIP)
+		}
+	}
+}
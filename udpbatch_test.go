@@ -0,0 +1,129 @@
+//-----------------------------------------------------------------------------
+// Copyright (C) Microsoft. All rights reserved.
+// Licensed under the MIT license.
+// See LICENSE.txt file in the project root for full license information.
+//-----------------------------------------------------------------------------
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"golang.org/x/net/ipv4"
+)
+
+//
+// batchRecorder is an ethrBatchConn that records the messages written to it,
+// writing at most max messages in each call, if max isn't 0.
+//
+type batchRecorder struct {
+	max  int
+	msgs []ipv4.Message
+}
+
+func (c *batchRecorder) ReadBatch(ms []ipv4.Message, flags int) (int, error) {
+	return 0, nil
+}
+
+func (c *batchRecorder) WriteBatch(ms []ipv4.Message, flags int) (int, error) {
+	n := len(ms)
+	if c.max > 0 && n > c.max {
+		n = c.max
+	}
+	for i := range ms[:n] {
+		ms[i].N = len(ms[i].Buffers[0])
+		m := ipv4.Message{Buffers: [][]byte{append([]byte{}, ms[i].Buffers[0]...)}, OOB: ms[i].OOB}
+		c.msgs = append(c.msgs, m)
+	}
+	return n, nil
+}
+
+func TestUDPBatchSend(t *testing.T) {
+	tests := []struct {
+		name    string
+		offload bool
+		max     int
+		count   int
+		size    int
+		// Number of datagrams in each message.
+		segs []int
+	}{
+		{"batch", false, 0, 5, 100, []int{1, 1, 1, 1, 1}},
+		{"partial writes", false, 2, 5, 100, []int{1, 1, 1, 1, 1}},
+		{"offload", true, 0, 100, 1000, []int{64, 36}},
+		{"offload, last datagram alone", true, 0, 65, 1000, []int{64, 1}},
+		{"offload, large datagrams", true, 0, 5, 20000, []int{3, 2}},
+		{"too small for header", false, 0, 3, 1, []int{1, 1, 1}},
+	}
+	for _, tt := range tests {
+		c := &batchRecorder{max: tt.max}
+		s := newUDPBatchSender(c, tt.count, tt.size, tt.offload)
+		seq := uint64(10)
+		n, err := s.send(&seq, tt.count, tt.size)
+		if err != nil || n != tt.count*tt.size {
+			t.Errorf("%s: sent %d bytes, error %v, want %d bytes", tt.name, n, err, tt.count*tt.size)
+		}
+		if len(c.msgs) != len(tt.segs) {
+			t.Errorf("%s: sent %d messages, want %d", tt.name, len(c.msgs), len(tt.segs))
+			continue
+		}
+		next := uint64(11)
+		for i, m := range c.msgs {
+			b := m.Buffers[0]
+			if len(b) != tt.segs[i]*tt.size {
+				t.Errorf("%s: message %d has %d bytes, want %d", tt.name, i, len(b), tt.segs[i]*tt.size)
+				continue
+			}
+			// Only buffers of more than one datagram ask the kernel to split them.
+			if tt.segs[i] > 1 && !bytes.Equal(m.OOB, udpSegmentOOB(tt.size)) {
+				t.Errorf("%s: message %d has control message %v, want %v", tt.name, i, m.OOB, udpSegmentOOB(tt.size))
+			}
+			if tt.segs[i] == 1 && m.OOB != nil {
+				t.Errorf("%s: message %d of one datagram has control message %v", tt.name, i, m.OOB)
+			}
+			if tt.size < udpDataHdrLen {
+				continue
+			}
+			for d := b; len(d) > 0; d = d[tt.size:] {
+				magic, seq := binary.BigEndian.Uint32(d[0:]), binary.BigEndian.Uint64(d[4:])
+				if magic != udpDataMagic || seq != next {
+					t.Errorf("%s: datagram has magic %x and sequence %d, want %x and %d",
+						tt.name, magic, seq, udpDataMagic, next)
+				}
+				next++
+			}
+		}
+		want := uint64(10)
+		if tt.size >= udpDataHdrLen {
+			want += uint64(tt.count)
+		}
+		if seq != want {
+			t.Errorf("%s: last sequence is %d, want %d", tt.name, seq, want)
+		}
+	}
+}
+
+func TestUDPSendBatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		batch   int
+		size    int
+		offload bool
+		want    int
+	}{
+		{"no batch", 1, 1000, false, 1},
+		{"batch", 32, 1000, false, 32},
+		{"offload without batch", 1, 1000, true, udpGSOMaxSegments},
+		{"offload with small batch", 8, 1000, true, udpGSOMaxSegments},
+		{"offload with large batch", 1024, 1000, true, 1024},
+		{"offload of large datagrams", 1, 30000, true, 2},
+		{"offload of largest datagrams", 1, udpGSOMaxBufferSize, true, 1},
+		{"zero batch", 0, 1000, false, 1},
+	}
+	for _, tt := range tests {
+		if got := udpSendBatch(tt.batch, tt.size, tt.offload); got != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
@@ -8,7 +8,6 @@ package main
 import (
 	"fmt"
 	"math"
-	"time"
 
 	"github.com/mattn/go-runewidth"
 	tm "github.com/nsf/termbox-go"
@@ -218,12 +217,14 @@ type ethrUI interface {
 	paint(uint64)
 	emitTestHdr()
 	emitLatencyHdr()
-	emitLatencyResults(remote, proto string, avg, min, max, p50, p90, p95, p99, p999, p9999 time.Duration)
+	emitLatencyResults(remote, proto string, h *ethrHistogram, lost uint32)
 	emitTestResultBegin()
 	emitTestResult(*ethrSession, EthrProtocol, uint64)
 	printTestResults([]string)
 	emitTestResultEnd()
 	emitStats(ethrNetStat)
+	emitTestSummary(test *ethrTest, clientFin, serverFin *EthrMsgFin)
+	emitAggregateSummary(tests []*ethrTest, clientFins, serverFins []*EthrMsgFin)
 }
 
 var ui ethrUI
@@ -6,6 +6,8 @@
 package main
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
 	"os"
@@ -24,6 +26,12 @@ var gClientPort = uint16(0)
 var gTOS = uint8(0)
 var gTTL = uint8(0)
 
+var errCongestionControlUnsupported = errors.New("congestion control algorithm can't be selected on this platform")
+var errZeroCopyUnsupported = errors.New("zero copy is not supported on this platform")
+var errZeroCopyTLS = errors.New("zero copy is not supported on TLS connections")
+var errUDPOffloadUnsupported = errors.New("UDP offload is not supported on this platform")
+var errQUICNoCertificate = errors.New("no TLS certificate for QUIC tests")
+
 const (
 	UNO  = 1
 	KILO = 1000
@@ -166,6 +174,12 @@ func protoToString(proto EthrProtocol) string {
 		return "UDP"
 	case ICMP:
 		return "ICMP"
+	case HTTP:
+		return "HTTP"
+	case HTTPS:
+		return "HTTPS"
+	case QUIC:
+		return "QUIC"
 	}
 	return ""
 }
@@ -226,6 +240,15 @@ func splitString(longString string, maxLen int) []string {
 	return splits
 }
 
+func isStringInList(s string, list []string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
 func max(x, y uint64) uint64 {
 	if x < y {
 		return y
@@ -279,27 +302,61 @@ func roundUpToZero(n int64) int64 {
 
 func getFd(conn net.Conn) uintptr {
 	var fd uintptr
+	rc := getRawConn(conn)
+	if rc == nil {
+		return 0
+	}
+	fn := func(s uintptr) {
+		fd = s
+	}
+	rc.Control(fn)
+	return fd
+}
+
+func getRawConn(conn net.Conn) syscall.RawConn {
 	var rc syscall.RawConn
 	var err error
 	switch ct := conn.(type) {
 	case *net.TCPConn:
 		rc, err = ct.SyscallConn()
-		if err != nil {
-			return 0
-		}
 	case *net.UDPConn:
 		rc, err = ct.SyscallConn()
-		if err != nil {
-			return 0
-		}
-	default:
-		return 0
+	case *ethrTLSConn:
+		return getRawConn(ct.rawConn)
+	case *ethrPeekConn:
+		return getRawConn(ct.Conn)
 	}
-	fn := func(s uintptr) {
-		fd = s
+	if err != nil {
+		return nil
 	}
-	rc.Control(fn)
-	return fd
+	return rc
+}
+
+//
+// ethrTLSConn keeps the underlying connection of a TLS connection, so that
+// socket level operations such as getFd still work on it.
+//
+type ethrTLSConn struct {
+	*tls.Conn
+	rawConn net.Conn
+}
+
+//
+// ethrPeekConn returns the bytes already read from a connection, e.g. to
+// detect the protocol in use, before reading from the connection again.
+//
+type ethrPeekConn struct {
+	net.Conn
+	peeked []byte
+}
+
+func (c *ethrPeekConn) Read(b []byte) (int, error) {
+	if len(c.peeked) > 0 {
+		n := copy(b, c.peeked)
+		c.peeked = c.peeked[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
 }
 
 type tcpKeepAliveListener struct {
@@ -346,19 +403,38 @@ func ethrSetTOS(fd uintptr, tos int) {
 }
 
 func ethrDial(p EthrProtocol, dialAddr string) (conn net.Conn, err error) {
-	return ethrDialEx(p, dialAddr, gLocalIP, gClientPort, int(gTTL), int(gTOS))
+	conn, err = ethrDialEx(p, dialAddr, gLocalIP, gClientPort, int(gTTL), int(gTOS))
+	ethrRecordDial(p, dialAddr, err)
+	return
 }
 
 func ethrDialInc(p EthrProtocol, dialAddr string, inc uint16) (conn net.Conn, err error) {
 	if gClientPort != 0 {
-		return ethrDialEx(p, dialAddr, gLocalIP, gClientPort+inc, int(gTTL), int(gTOS))
+		conn, err = ethrDialEx(p, dialAddr, gLocalIP, gClientPort+inc, int(gTTL), int(gTOS))
+		ethrRecordDial(p, dialAddr, err)
+		return
 	} else {
 		return ethrDial(p, dialAddr)
 	}
 }
 
 func ethrDialAll(p EthrProtocol, dialAddr string) (conn net.Conn, err error) {
-	return ethrDialEx(p, dialAddr, gLocalIP, 0, int(gTTL), int(gTOS))
+	conn, err = ethrDialEx(p, dialAddr, gLocalIP, 0, int(gTTL), int(gTOS))
+	ethrRecordDial(p, dialAddr, err)
+	return
+}
+
+//
+// Only TCP connections are recorded for the verdict of the run, as dialing
+// UDP doesn't reach the server. Dials that don't carry the test itself, i.e.
+// the session and the exchange of results, which UDP tests can do without,
+// and dials with a limited TTL, e.g. for TraceRoute, call ethrDialEx directly
+// and aren't recorded.
+//
+func ethrRecordDial(p EthrProtocol, dialAddr string, err error) {
+	if p == TCP {
+		recordDial(dialAddr, err)
+	}
 }
 
 func ethrDialEx(p EthrProtocol, dialAddr, localIP string, localPortNum uint16, ttl int, tos int) (conn net.Conn, err error) {
@@ -384,11 +460,18 @@ func ethrDialEx(p EthrProtocol, dialAddr, localIP string, localPortNum uint16, t
 			return c.Control(func(fd uintptr) {
 				ethrSetTTL(fd, ttl)
 				ethrSetTOS(fd, tos)
+				ethrSetBufferSizes(fd, gSendBufferSize, gRecvBufferSize)
+				if p == TCP {
+					ethrSetMSS(fd, gMSS)
+				}
 			})
 		},
 	}
 	dialer.LocalAddr = la
 	dialer.Timeout = time.Second
+	if p == TCP && gMPTCP {
+		dialer.SetMultipathTCP(true)
+	}
 	conn, err = dialer.Dial(network, dialAddr)
 	if err != nil {
 		ui.printDbg("ethrTCPDial Error: %v", err)
@@ -396,9 +479,12 @@ func ethrDialEx(p EthrProtocol, dialAddr, localIP string, localPortNum uint16, t
 		tcpconn, ok := conn.(*net.TCPConn)
 		if ok {
 			tcpconn.SetLinger(0)
+			if gNagle {
+				tcpconn.SetNoDelay(false)
+			}
 		}
 		udpconn, ok := conn.(*net.UDPConn)
-		if ok {
+		if ok && gSendBufferSize == 0 {
 			err = udpconn.SetWriteBuffer(4 * 1024 * 1024)
 			if err != nil {
 				ui.printDbg("Failed to set ReadBuffer on UDP socket: %v", err)
@@ -0,0 +1,81 @@
+//-----------------------------------------------------------------------------
+// Copyright (C) Microsoft. All rights reserved.
+// Licensed under the MIT license.
+// See LICENSE.txt file in the project root for full license information.
+//-----------------------------------------------------------------------------
+package main
+
+import (
+	"net"
+)
+
+//
+// TCP bandwidth tests normally copy their buffer into the kernel on every
+// write and out of it on every read, so on fast links Ethr may run out of CPU
+// before the link is saturated. In zero copy modes, the sender either uses
+// sendfile(2) from a memory backed file that holds the buffer, or send(2)
+// with MSG_ZEROCOPY, and the receiver uses splice(2) to move the data through
+// a pipe into /dev/null, so that it never reaches user space. The client
+// sends the mode to the server in the SYN message, so that both ends of the
+// test use it. CPU time of both ends is reported with the results, so that
+// the modes can be compared. Only supported on Linux.
+//
+const (
+	zeroCopySendfile = "sendfile"
+	zeroCopyMsg      = "msg"
+)
+
+//
+// ethrDataPath sends and receives the data of a TCP bandwidth test. The
+// sender only ever sends the buffer that the data path is created with, or
+// the start of it.
+//
+type ethrDataPath interface {
+	send(b []byte) (int, error)
+	recv(b []byte) (int, error)
+	close()
+}
+
+type ethrCopyDataPath struct {
+	conn net.Conn
+}
+
+func (p *ethrCopyDataPath) send(b []byte) (int, error) {
+	return p.conn.Write(b)
+}
+
+func (p *ethrCopyDataPath) recv(b []byte) (int, error) {
+	return p.conn.Read(b)
+}
+
+func (p *ethrCopyDataPath) close() {
+}
+
+//
+// newDataPath returns the data path of a connection of a TCP bandwidth test,
+// which copies data as usual, unless a zero copy mode is given.
+//
+func newDataPath(conn net.Conn, mode string, buff []byte, sender bool) (ethrDataPath, error) {
+	if mode == "" {
+		return &ethrCopyDataPath{conn}, nil
+	}
+	if !isPlainConn(conn) {
+		return nil, errZeroCopyTLS
+	}
+	return newZeroCopyDataPath(conn, mode, buff, sender)
+}
+
+//
+// isPlainConn tells if data can be sent and received on the socket of a
+// connection directly, i.e. it doesn't use TLS, and there are no bytes that
+// were already read from it, e.g. to detect the protocol in use.
+//
+func isPlainConn(conn net.Conn) bool {
+	switch ct := conn.(type) {
+	case *ethrTLSConn:
+		return false
+	case *ethrPeekConn:
+		return len(ct.peeked) == 0 && isPlainConn(ct.Conn)
+	}
+	return true
+}